@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"time"
 
 	"github.com/nicholasss/async-messages/internal/client"
 )
@@ -12,10 +16,16 @@ func main() {
 		fmt.Printf("unable to create new client config due to: %q\n", err)
 		return
 	}
+	defer c.Close()
 
-	err = c.StartClient()
+	// run until interrupted, then shut down with Stop so that sends can finish
+	interrupted, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = c.StartClient(context.Background())
 	if err != nil {
 		fmt.Printf("unable to start new client due to: %q\n", err)
+		return
 	}
 
 	err = c.WriteMessageIntoQueue("Bob", "Snow", "Shovel", "We should get going on tuesday.")
@@ -23,10 +33,15 @@ func main() {
 		fmt.Printf("cannot write message due to: %q\n", err)
 	}
 
-	err = c.SendAllFromQueue()
+	<-interrupted.Done()
+
+	// wait a little for anything in flight before printing what is left
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = c.Stop(shutdownCtx)
 	if err != nil {
-		fmt.Printf("cannot send due to: %q\n", err)
+		fmt.Printf("stopped before everything finished due to: %q\n", err)
 	}
-
 	fmt.Printf("Queue Summary: %s\n", c.Outbox.QueueSummary())
+	fmt.Printf("Inbox Summary: %s\n", c.Inbox.QueueSummary())
 }
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// *** Types ***
+
+// Backoff is how long to wait between attempts to reach the server.
+// Each attempt waits Multiplier times longer than the last, up to Max,
+// and is moved up or down at random by up to the Jitter fraction so that
+// clients which lost the server together do not all come back together.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+	// Random returns a number from 0 up to 1 to jitter with, rand.Float64 when nil
+	Random func() float64
+}
+
+// *** Internal Types ***
+
+// retryHold is how long sending is held off after temporary failures,
+// and how many there have been since the last message got through
+type retryHold struct {
+	attempt int
+	until   time.Time
+}
+
+// DefaultBackoff is used when a clients backoff is not set
+var DefaultBackoff = Backoff{
+	Initial:    time.Second,
+	Max:        5 * time.Minute,
+	Multiplier: 2,
+	Jitter:     0.5,
+}
+
+// *** Functions ***
+
+// Delay returns how long to wait before the attempt, starting at 0
+func (b Backoff) Delay(attempt int) time.Duration {
+	random := b.Random
+	if random == nil {
+		random = rand.Float64
+	}
+	if b.Initial <= 0 {
+		b = DefaultBackoff
+	}
+	maxDelay := b.Max
+	if maxDelay <= 0 {
+		maxDelay = DefaultBackoff.Max
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := math.Min(float64(b.Initial)*math.Pow(multiplier, float64(attempt)), float64(maxDelay))
+
+	// anywhere from delay*(1-jitter) to delay*(1+jitter)
+	jitter := min(max(b.Jitter, 0), 1)
+	delay *= 1 + jitter*(2*random()-1)
+
+	return time.Duration(delay)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as a date,
+// returning 0 when it is missing or cannot be read
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	date, err := http.ParseTime(value)
+	if err == nil {
+		return max(date.Sub(now), 0)
+	}
+	return 0
+}
+
+// extend holds off for the next backoff delay, or retryAfter if the server asked for longer
+func (h *retryHold) extend(backoff Backoff, retryAfter time.Duration, now time.Time) time.Duration {
+	delay := max(backoff.Delay(h.attempt), retryAfter)
+	h.attempt++
+	h.until = now.Add(delay)
+	return delay
+}
+
+// holdFor backs off sending after a temporary failure sending a message to recipient.
+// A full mailbox only holds off that recipient, anything else holds off the whole server.
+func (c *Config) holdFor(recipient msg.UserVessel, statusErr *StatusError) {
+	if statusErr.StatusCode == http.StatusTooManyRequests {
+		c.holdRecipient(recipient, statusErr.RetryAfter)
+		return
+	}
+	c.holdServer(statusErr.RetryAfter)
+}
+
+// holdServer backs off sending anything to the server
+func (c *Config) holdServer(retryAfter time.Duration) {
+	c.holdMux.Lock()
+	delay := c.serverHold.extend(c.Backoff, retryAfter, time.Now())
+	c.holdMux.Unlock()
+
+	fmt.Printf("Server is not taking messages for now. Sending again in %s...\n", delay.Round(time.Millisecond))
+}
+
+// holdRecipient backs off sending to the recipient, while messages for others are still sent
+func (c *Config) holdRecipient(recipient msg.UserVessel, retryAfter time.Duration) {
+	c.holdMux.Lock()
+	if c.recipientHolds == nil {
+		c.recipientHolds = make(map[msg.UserVessel]*retryHold)
+	}
+	hold, ok := c.recipientHolds[recipient]
+	if !ok {
+		hold = &retryHold{}
+		c.recipientHolds[recipient] = hold
+	}
+	delay := hold.extend(c.Backoff, retryAfter, time.Now())
+	c.holdMux.Unlock()
+
+	fmt.Printf("Mailbox of %s is full. Sending to them again in %s...\n", recipient.String(), delay.Round(time.Millisecond))
+}
+
+// clearHolds starts backing off from the beginning again once a message to recipient got through
+func (c *Config) clearHolds(recipient msg.UserVessel) {
+	c.holdMux.Lock()
+	c.serverHold = retryHold{}
+	delete(c.recipientHolds, recipient)
+	c.holdMux.Unlock()
+}
+
+// waitServerHold waits until the server can be sent to again, or ctx is done
+func (c *Config) waitServerHold(ctx context.Context) error {
+	c.holdMux.Lock()
+	until := c.serverHold.until
+	c.holdMux.Unlock()
+
+	delay := time.Until(until)
+	if delay <= 0 {
+		return nil
+	}
+	wait := time.NewTimer(delay)
+	defer wait.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-wait.C:
+		return nil
+	}
+}
+
+// holdIfHeld keeps the lease back from sending while its recipient is held off,
+// reporting whether it was kept. It goes back into the outbox with releaseHeld.
+func (c *Config) holdIfHeld(lease msg.Lease) bool {
+	c.holdMux.Lock()
+	defer c.holdMux.Unlock()
+
+	hold, ok := c.recipientHolds[lease.Message.To]
+	if !ok || !time.Now().Before(hold.until) {
+		return false
+	}
+	c.held = append(c.held, lease)
+	return true
+}
+
+// releaseHeld puts messages whose recipient is no longer held off back into the outbox,
+// or every held message when all is set. Returns when the next one is due, or zero if none are held.
+func (c *Config) releaseHeld(all bool) time.Time {
+	c.holdMux.Lock()
+	defer c.holdMux.Unlock()
+
+	now := time.Now()
+	var next time.Time
+	var release []msg.Lease
+	kept := c.held[:0]
+	for _, lease := range c.held {
+		hold, ok := c.recipientHolds[lease.Message.To]
+		if all || !ok || !now.Before(hold.until) {
+			release = append(release, lease)
+			continue
+		}
+		kept = append(kept, lease)
+		if next.IsZero() || hold.until.Before(next) {
+			next = hold.until
+		}
+	}
+	c.held = kept
+
+	// requeued to the front, so the oldest goes last to keep their order
+	for i := len(release) - 1; i >= 0; i-- {
+		c.Outbox.Requeue(release[i].ID)
+	}
+	return next
+}
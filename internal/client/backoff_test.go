@@ -0,0 +1,105 @@
+package client
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// noJitter always lands in the middle of the jitter, leaving the delay as is
+func noJitter() float64 {
+	return 0.5
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff Backoff
+		attempt int
+		want    time.Duration
+	}{
+		{"first attempt", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2}, 0, time.Second},
+		{"doubles", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2}, 1, 2 * time.Second},
+		{"doubles again", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2}, 4, 16 * time.Second},
+		{"other multiplier", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 3}, 2, 9 * time.Second},
+		{"capped", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2}, 6, time.Minute},
+		{"stays capped", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2}, 1000, time.Minute},
+		{"multiplier below one", Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 0.5}, 3, time.Second},
+		{"no max", Backoff{Initial: time.Second, Multiplier: 2}, 20, DefaultBackoff.Max},
+		{"unset", Backoff{}, 2, 4 * DefaultBackoff.Initial},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.backoff.Random = noJitter
+			got := tt.backoff.Delay(tt.attempt)
+			if got != tt.want {
+				t.Errorf("Delay mismatch. got=%s want=%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	tests := []struct {
+		name    string
+		jitter  float64
+		random  float64
+		attempt int
+		want    time.Duration
+	}{
+		{"lowest", 0.5, 0, 0, 500 * time.Millisecond},
+		{"highest", 0.5, 1, 0, 1500 * time.Millisecond},
+		{"quarter", 0.5, 0.25, 1, 1500 * time.Millisecond},
+		{"no jitter", 0, 0, 1, 2 * time.Second},
+		{"jitter above one", 2, 0, 1, 0},
+		{"negative jitter", -1, 0, 1, 2 * time.Second},
+		// jitter is applied after the cap, so capped delays still spread out
+		{"capped", 0.5, 1, 10, 90 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backoff := Backoff{
+				Initial:    time.Second,
+				Max:        time.Minute,
+				Multiplier: 2,
+				Jitter:     tt.jitter,
+				Random:     func() float64 { return tt.random },
+			}
+			got := backoff.Delay(tt.attempt)
+			if got != tt.want {
+				t.Errorf("Delay mismatch. got=%s want=%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffJitterBounds(t *testing.T) {
+	random := rand.New(rand.NewPCG(1, 2))
+	backoff := Backoff{
+		Initial:    time.Second,
+		Max:        time.Minute,
+		Multiplier: 2,
+		Jitter:     0.25,
+		Random:     random.Float64,
+	}
+
+	for attempt := range 10 {
+		delay := min(time.Second<<attempt, time.Minute)
+		low := time.Duration(float64(delay) * 0.75)
+		high := time.Duration(float64(delay) * 1.25)
+
+		seen := make(map[time.Duration]bool)
+		for range 100 {
+			got := backoff.Delay(attempt)
+			if got < low || got > high {
+				t.Fatalf("attempt %d out of bounds. got=%s want=%s-%s", attempt, got, low, high)
+			}
+			seen[got] = true
+		}
+		if len(seen) < 50 {
+			t.Errorf("attempt %d barely jittered. distinct=%d", attempt, len(seen))
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// limits on a batch of messages sent at once. Batches are kept small so that
+// a transfer which fails over a poor link does not cost much to send again.
+const (
+	maxBatchMessages     = 100
+	defaultMaxBatchBytes = 64 << 10
+)
+
+// *** Internal Types ***
+
+// batchItem is a message reserved for a batch, and how large it is encoded
+type batchItem struct {
+	lease msg.Lease
+	size  int
+}
+
+// *** Functions ***
+
+// reserveBatch adds as many more messages from the outbox to the reserved one as fit into a batch.
+// The first message is always sent, even if it is larger than a batch on its own.
+func (c *Config) reserveBatch(first msg.Lease) []batchItem {
+	maxBytes := c.MaxBatchBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBatchBytes
+	}
+
+	batch := []batchItem{{lease: first, size: c.encodedSize(first.Message)}}
+	// the brackets around the batch, or its count
+	size := 2 + batch[0].size
+	for len(batch) < maxBatchMessages {
+		lease, ok := c.Outbox.Reserve()
+		if !ok {
+			break
+		}
+
+		if c.holdIfHeld(lease) {
+			continue
+		}
+
+		item := batchItem{lease: lease, size: c.encodedSize(lease.Message)}
+		if size+item.size+1 > maxBytes {
+			c.Outbox.Requeue(lease.ID)
+			break
+		}
+		batch = append(batch, item)
+		size += item.size + 1
+	}
+	return batch
+}
+
+// sendBatch sends messages reserved from the outbox to the server in one request.
+// Each message is only removed once the server has accepted it, or moved to the dead
+// letters once rejected, otherwise it goes back to the front of the outbox. Servers
+// that do not take batches are sent each message on its own.
+// Returns the rejected messages joined together, and why any others could not be sent.
+func (c *Config) sendBatch(ctx context.Context, batch []batchItem) (rejected error, err error) {
+	var rejections, errs []error
+
+	// messages the server would only reject are not worth sending
+	sendable := make([]batchItem, 0, len(batch))
+	for _, item := range batch {
+		checkErr := c.checkSendable(&item.lease.Message)
+		if checkErr != nil {
+			rejections, errs = c.rejectItem(item, checkErr, rejections, errs)
+			continue
+		}
+		sendable = append(sendable, item)
+	}
+	if len(sendable) == 0 {
+		return errors.Join(rejections...), errors.Join(errs...)
+	}
+	if c.noBatches.Load() || len(sendable) == 1 {
+		return c.sendEach(ctx, sendable, rejections, errs)
+	}
+
+	messages := make([]msg.PackagedMessage, 0, len(sendable))
+	for _, item := range sendable {
+		messages = append(messages, item.lease.Message)
+	}
+	body, contentType, err := c.encodeBatch(messages)
+	if err != nil {
+		c.requeueBatch(sendable)
+		return errors.Join(rejections...), errors.Join(append(errs, err)...)
+	}
+
+	results, err := c.postBatch(ctx, body, contentType)
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusMethodNotAllowed):
+		// an older server, which only takes one message at a time
+		fmt.Printf("Server does not take batches of messages, sending them one at a time.\n")
+		c.noBatches.Store(true)
+		return c.sendEach(ctx, sendable, rejections, errs)
+
+	case errors.As(err, &statusErr) && !statusErr.Temporary():
+		// the batch as a whole was refused, sending each one finds the messages at fault
+		return c.sendEach(ctx, sendable, rejections, errs)
+
+	case errors.As(err, &statusErr) && statusErr.Temporary():
+		// the batch as a whole was turned away, so nothing is sent for a while
+		c.holdServer(statusErr.RetryAfter)
+		c.requeueBatch(sendable)
+		return errors.Join(rejections...), errors.Join(append(errs, err)...)
+
+	case err != nil:
+		c.requeueBatch(sendable)
+		return errors.Join(rejections...), errors.Join(append(errs, err)...)
+	}
+
+	var requeue []batchItem
+	for i, item := range sendable {
+		// results are in the order the messages were sent, as messages from before
+		// ids were added all share the empty id. Anything the server did not answer is sent again
+		if i >= len(results) || results[i].ID != item.lease.Message.ID {
+			requeue = append(requeue, item)
+			continue
+		}
+		result := results[i]
+
+		if result.Status >= 200 && result.Status < 300 {
+			c.clearHolds(item.lease.Message.To)
+			errs = append(errs, c.commitReserved(item.lease))
+			continue
+		}
+
+		resultErr := &StatusError{
+			Action:     "send message",
+			Status:     fmt.Sprintf("%d %s", result.Status, http.StatusText(result.Status)),
+			StatusCode: result.Status,
+			RetryAfter: time.Duration(result.RetryAfter) * time.Second,
+		}
+		if resultErr.Temporary() {
+			// back off just as if the message had been sent on its own
+			c.holdFor(item.lease.Message.To, resultErr)
+			requeue = append(requeue, item)
+			errs = append(errs, resultErr)
+			continue
+		}
+		rejectErr := fmt.Errorf("%w: message %s: %w: %s", ErrMessageRejected, item.lease.Message.ID, resultErr, result.Error)
+		rejections, errs = c.rejectItem(item, rejectErr, rejections, errs)
+	}
+	c.requeueBatch(requeue)
+
+	return errors.Join(rejections...), errors.Join(errs...)
+}
+
+// rejectItem moves a message of a batch the server will not accept to the dead letters, adding why to
+// rejections. When it cannot be, it went back into the outbox and the error is added to errs instead.
+func (c *Config) rejectItem(item batchItem, reason error, rejections, errs []error) ([]error, []error) {
+	err := c.rejectReserved(item.lease, reason)
+	if errors.Is(err, ErrMessageRejected) {
+		return append(rejections, err), errs
+	}
+	return rejections, append(errs, err)
+}
+
+// postBatch sends the encoded batch to the server, returning the result of each message
+func (c *Config) postBatch(ctx context.Context, body []byte, contentType string) ([]msg.SendResult, error) {
+	req, cancel, err := c.newRequest(ctx, http.MethodPost, "/send-messages", body)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	req.Header.Set("Content-Type", contentType)
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// check return status
+	statusErr := checkStatus(res, "send messages")
+	if statusErr != nil {
+		return nil, statusErr
+	}
+
+	var results []msg.SendResult
+	err = json.NewDecoder(res.Body).Decode(&results)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// sendEach sends the messages one at a time, stopping at the first that could not be sent
+// other than to a full mailbox, which only holds off that recipient.
+// Returns the rejected messages joined with rejections, and why the sending stopped joined with errs.
+func (c *Config) sendEach(ctx context.Context, batch []batchItem, rejections, errs []error) (rejected error, err error) {
+	for i, item := range batch {
+		err = c.sendReserved(ctx, item.lease)
+		if errors.Is(err, ErrMessageRejected) {
+			rejections = append(rejections, err)
+			continue
+		}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests {
+			errs = append(errs, err)
+			continue
+		}
+		if err != nil {
+			c.requeueBatch(batch[i+1:])
+			return errors.Join(rejections...), errors.Join(append(errs, err)...)
+		}
+	}
+	return errors.Join(rejections...), errors.Join(errs...)
+}
+
+// requeueBatch puts the messages back into the outbox, keeping their order
+func (c *Config) requeueBatch(batch []batchItem) {
+	for i := len(batch) - 1; i >= 0; i-- {
+		c.Outbox.Requeue(batch[i].lease.ID)
+	}
+}
+
+// encodedSize returns how large the message is within a batch
+func (c *Config) encodedSize(pkgMsg msg.PackagedMessage) int {
+	data, _, err := c.encodeMessage(&pkgMsg)
+	if err != nil {
+		// a message that does not encode is rejected before the batch is sent
+		return 0
+	}
+	return len(data)
+}
@@ -0,0 +1,310 @@
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// testSendServer answers health checks, and each message sent with the status status returns for it
+type testSendServer struct {
+	status func(pkgMsg msg.PackagedMessage) (int, int)
+	sent   map[string]int
+	mux    sync.Mutex
+}
+
+func (s *testSendServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/health":
+		json.NewEncoder(w).Encode(HealthCheck{Health: "OK"})
+
+	case "/send-message":
+		var pkgMsg msg.PackagedMessage
+		json.NewDecoder(r.Body).Decode(&pkgMsg)
+		status, retryAfter := s.send(pkgMsg)
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		}
+		w.WriteHeader(status)
+
+	case "/send-messages":
+		var batch []msg.PackagedMessage
+		json.NewDecoder(r.Body).Decode(&batch)
+		results := make([]msg.SendResult, 0, len(batch))
+		for _, pkgMsg := range batch {
+			status, retryAfter := s.send(pkgMsg)
+			results = append(results, msg.SendResult{ID: pkgMsg.ID, Status: status, RetryAfter: retryAfter})
+		}
+		json.NewEncoder(w).Encode(results)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *testSendServer) send(pkgMsg msg.PackagedMessage) (int, int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.sent == nil {
+		s.sent = make(map[string]int)
+	}
+	s.sent[pkgMsg.Subject]++
+	return s.status(pkgMsg)
+}
+
+func (s *testSendServer) sentCount(subject string) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.sent[subject]
+}
+
+func TestFullMailboxOnlyHoldsOffRecipient(t *testing.T) {
+	sendServer := &testSendServer{status: func(pkgMsg msg.PackagedMessage) (int, int) {
+		if pkgMsg.To.Name == "Bob" {
+			return http.StatusTooManyRequests, 60
+		}
+		return http.StatusOK, 0
+	}}
+	server := httptest.NewServer(sendServer)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	c.Backoff = Backoff{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 1}
+	c.LongPoll = true
+
+	err := c.WriteMessageIntoQueue("Bob", "Snow", "to bob", "your mailbox is full")
+	if err != nil {
+		t.Fatalf("Unable to queue message due to: %q", err)
+	}
+	err = c.WriteMessageIntoQueue("Anna", "Snow", "to anna", "yours is not")
+	if err != nil {
+		t.Fatalf("Unable to queue message due to: %q", err)
+	}
+
+	err = c.StartClient(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start client due to: %q", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// anna was sent to while bob waits out the Retry-After, rather than being sent to again and again
+	if sent := sendServer.sentCount("to anna"); sent != 1 {
+		t.Errorf("Expected the message to anna to be sent once. got=%d", sent)
+	}
+	if sent := sendServer.sentCount("to bob"); sent != 1 {
+		t.Errorf("Expected the message to bob to be sent once while held off. got=%d", sent)
+	}
+	if !c.Online.getValue() {
+		t.Errorf("Expected a full mailbox to not take the client offline")
+	}
+
+	err = c.Stop(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to stop client due to: %q", err)
+	}
+	// the held message is still waiting to be sent
+	if size := c.Outbox.Size(); size != 1 {
+		t.Errorf("Expected the message to bob to stay in the outbox. size=%d", size)
+	}
+}
+
+func TestServerErrorsBackOff(t *testing.T) {
+	sendServer := &testSendServer{status: func(pkgMsg msg.PackagedMessage) (int, int) {
+		return http.StatusServiceUnavailable, 0
+	}}
+	server := httptest.NewServer(sendServer)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	c.Backoff = Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	c.LongPoll = true
+
+	err := c.WriteMessageIntoQueue("Bob", "Snow", "to bob", "the server is struggling")
+	if err != nil {
+		t.Fatalf("Unable to queue message due to: %q", err)
+	}
+
+	err = c.StartClient(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start client due to: %q", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	err = c.Stop(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to stop client due to: %q", err)
+	}
+
+	// sent at 0, then after about 100ms and 300ms. Without backing off it would be hundreds of times
+	if sent := sendServer.sentCount("to bob"); sent < 2 || sent > 4 {
+		t.Errorf("Expected the message to be sent a few times while backing off. got=%d", sent)
+	}
+	if size := c.Outbox.Size(); size != 1 {
+		t.Errorf("Expected the message to stay in the outbox. size=%d", size)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{name: "missing", value: "", want: 0},
+		{name: "seconds", value: "30", want: 30 * time.Second},
+		{name: "date", value: now.Add(time.Minute).Format(http.TimeFormat), want: time.Minute},
+		{name: "date passed", value: now.Add(-time.Minute).Format(http.TimeFormat), want: 0},
+		{name: "negative", value: "-5", want: 0},
+		{name: "unreadable", value: "soon", want: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseRetryAfter(tc.value, now)
+			if got != tc.want {
+				t.Errorf("Retry-After mismatch. got=%s want=%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSendBatchPartialFailure(t *testing.T) {
+	sendServer := &testSendServer{status: func(pkgMsg msg.PackagedMessage) (int, int) {
+		if pkgMsg.Subject == "refused" {
+			return http.StatusBadRequest, 0
+		}
+		return http.StatusOK, 0
+	}}
+	server := httptest.NewServer(sendServer)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	for _, subject := range []string{"Tuesday", "refused", "Wednesday"} {
+		err := c.WriteMessageIntoQueue("Bob", "Snow", subject, "I am planning on proceeding on tuesday")
+		if err != nil {
+			t.Fatalf("Unable to queue message due to: %q", err)
+		}
+	}
+
+	err := c.SendAllFromQueue(context.Background())
+	if !errors.Is(err, ErrMessageRejected) {
+		t.Errorf("Expected ErrMessageRejected, but got %v", err)
+	}
+
+	// each message was sent once, in one batch
+	for _, subject := range []string{"Tuesday", "refused", "Wednesday"} {
+		if sent := sendServer.sentCount(subject); sent != 1 {
+			t.Errorf("Expected %q to be sent once. got=%d", subject, sent)
+		}
+	}
+	if size := c.Outbox.Size() + c.Outbox.InFlight(); size != 0 {
+		t.Errorf("Expected the outbox to be empty. size=%d", size)
+	}
+	deadLetters := c.DeadLetters.List()
+	if len(deadLetters) != 1 || deadLetters[0].Message.Subject != "refused" {
+		t.Errorf("Expected only the refused message to be a dead letter. got=%d", len(deadLetters))
+	}
+}
+
+func TestSendBatchOfLegacyMessages(t *testing.T) {
+	sendServer := &testSendServer{status: func(pkgMsg msg.PackagedMessage) (int, int) {
+		if pkgMsg.Subject == "refused" {
+			return http.StatusBadRequest, 0
+		}
+		return http.StatusOK, 0
+	}}
+	server := httptest.NewServer(sendServer)
+	defer server.Close()
+
+	key := []byte("kevin's key")
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", key)
+	for _, subject := range []string{"refused", "Tuesday"} {
+		// queued before ids were added, so both have the same empty id
+		pkgMsg := msg.PackagedMessage{
+			To:      msg.UserVessel{Name: "Bob", Vessel: "Snow"},
+			From:    msg.UserVessel{Name: "Kevin", Vessel: "Liberty"},
+			Subject: subject,
+			Body:    "I am planning on proceeding on tuesday",
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(pkgMsg.To.String() + "|" + pkgMsg.From.String() + "|" + pkgMsg.Subject + "|" + pkgMsg.Body))
+		pkgMsg.Signature = hex.EncodeToString(mac.Sum(nil))
+
+		err := c.queueMessage(&pkgMsg)
+		if err != nil {
+			t.Fatalf("Unable to queue message due to: %q", err)
+		}
+	}
+
+	err := c.SendAllFromQueue(context.Background())
+	if !errors.Is(err, ErrMessageRejected) {
+		t.Errorf("Expected ErrMessageRejected, but got %v", err)
+	}
+
+	// each result was matched to its own message, not to every message with the empty id
+	deadLetters := c.DeadLetters.List()
+	if len(deadLetters) != 1 || deadLetters[0].Message.Subject != "refused" {
+		t.Errorf("Expected the refused message to be a dead letter. got=%d", len(deadLetters))
+	}
+	if size := c.Outbox.Size() + c.Outbox.InFlight(); size != 0 {
+		t.Errorf("Expected the outbox to be empty. size=%d", size)
+	}
+}
+
+func TestRejectedMessageIsKeptWhenDeadLetterFails(t *testing.T) {
+	sendServer := &testSendServer{status: func(pkgMsg msg.PackagedMessage) (int, int) {
+		return http.StatusBadRequest, 0
+	}}
+	server := httptest.NewServer(sendServer)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	c.Online.setValue(true)
+	for _, subject := range []string{"Tuesday", "Wednesday"} {
+		err := c.WriteMessageIntoQueue("Bob", "Snow", subject, "the server will refuse this")
+		if err != nil {
+			t.Fatalf("Unable to queue message due to: %q", err)
+		}
+	}
+
+	// the dead letters cannot be journaled
+	c.Journal.Close()
+
+	tests := []struct {
+		name string
+		send func() error
+	}{
+		{"on its own", func() error { return c.SendOneFromQueue(context.Background()) }},
+		{"in a batch", func() error { return c.SendAllFromQueue(context.Background()) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.send()
+			if err == nil || errors.Is(err, ErrMessageRejected) {
+				t.Errorf("Expected a failed send rather than a rejection. got=%v", err)
+			}
+
+			// kept in the outbox to be tried again, rather than lost until the next run
+			if size := c.Outbox.Size(); size != 2 {
+				t.Errorf("Expected the messages to be back in the outbox. size=%d", size)
+			}
+			if size := c.DeadLetters.Size(); size != 0 {
+				t.Errorf("Expected no dead letters that were not journaled. size=%d", size)
+			}
+		})
+	}
+}
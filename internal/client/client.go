@@ -3,17 +3,56 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/nicholasss/async-messages/internal/msg"
+	"github.com/nicholasss/async-messages/internal/store"
+)
+
+// names of the boxes within the clients journal
+const (
+	outboxName     = "outbox"
+	inboxName      = "inbox"
+	deadLetterName = "deadletter"
+)
+
+// compactAfter is how many deleted messages the journal can hold before it is compacted
+const compactAfter = 1000
+
+// defaultDataDir is where the client keeps its data when 'CLIENT_DATA_DIR' is not set
+const defaultDataDir = "data"
+
+// defaultRequestTimeout bounds each request to the server when 'REQUEST_TIMEOUT' is not set,
+// so that a hung satellite link cannot block forever
+const defaultRequestTimeout = 30 * time.Second
+
+// how often the sync engine does its work
+const (
+	healthCheckInterval = 15 * time.Second
+	receiveInterval     = 5 * time.Second
+	// sendRetryInterval spaces out sends that failed while the server stayed online
+	sendRetryInterval = 500 * time.Millisecond
+	// longPollWait is how long the server is asked to hold a request for messages open
+	longPollWait = 25 * time.Second
+	// longPollMargin leaves time within the request timeout for the response to arrive
+	longPollMargin = 5 * time.Second
 )
 
 // *** Types ***
@@ -24,21 +63,121 @@ type HealthCheck struct {
 }
 
 type Config struct {
-	SecretKey []byte
-	Client    http.Client
-	Outbox    *msg.PackagedQueue
-	Inbox     *msg.PackagedQueue
-	Name      string
-	Vessel    string
-	Server    string
-	Online    *safeBool
+	Signer msg.Signer
+	// EncryptionKey opens messages that were encrypted for this user, it is optional
+	EncryptionKey *ecdh.PrivateKey
+	Client        http.Client
+	Outbox        *msg.PackagedQueue
+	Inbox         *msg.PackagedQueue
+	// DeadLetters holds sent messages that the server will not accept, and messages that expired
+	DeadLetters *msg.DeadLetterQueue
+	Journal     *store.Journal
+	// held for reading while journaling, and for writing while compacting
+	journalMux sync.RWMutex
+	Name       string
+	Vessel     string
+	Server     string
+	Online     *safeBool
+	// RequestTimeout bounds each request to the server, zero uses the default
+	RequestTimeout time.Duration
+	// Backoff spaces out checks while the server is offline, zero uses DefaultBackoff
+	Backoff Backoff
+	// MaxBatchBytes bounds how much is sent to the server in one request, zero uses the default
+	MaxBatchBytes int
+	// CompressMinBytes is how large a request body must be before it is compressed,
+	// zero uses the default and below zero never compresses
+	CompressMinBytes int
+	// LongPoll receives messages by long polling rather than streaming,
+	// for links behind proxies that break streams
+	LongPoll bool
+
+	// set once the server is found to only take one message at a time
+	noBatches atomic.Bool
+	// set while the server says it can decode gzip request bodies
+	serverGzip atomic.Bool
+	// set while the server says it takes messages in the binary encoding
+	serverBinary atomic.Bool
+	// set once the server is found to not stream messages
+	noStream atomic.Bool
+	// id of the last streamed message put into the inbox, the next stream resumes after it
+	lastEventID string
+	streamMux   sync.Mutex
+	// held while checking a delivery is not already in the inbox, then putting it there
+	inboxMux sync.Mutex
+
+	// PinnedKeys are public keys of recipients configured locally, the server is never asked for them
+	PinnedKeys map[msg.UserVessel]*ecdh.PublicKey
+	// KnownKeysPath keeps the keys the server has served, so that a changed key is noticed.
+	// When empty they are only kept while running.
+	KnownKeysPath string
+	// keys served by the server that were first seen or checked while running
+	knownKeys    map[msg.UserVessel]*ecdh.PublicKey
+	checkedKeys  map[msg.UserVessel]*ecdh.PublicKey
+	recipientMux sync.Mutex
+
+	// PinnedSenderKeys are public keys of senders configured locally, the server is never asked for them
+	PinnedSenderKeys map[msg.UserVessel]ed25519.PublicKey
+	// KnownSenderKeysPath keeps the public keys of senders the server has served, just as KnownKeysPath
+	KnownSenderKeysPath string
+	knownSenderKeys     map[msg.UserVessel]ed25519.PublicKey
+	checkedSenderKeys   map[msg.UserVessel]ed25519.PublicKey
+	senderMux           sync.Mutex
+
+	// temporary failures hold off sending to the server, or to a single recipient,
+	// backing off further each time until a message gets through
+	serverHold     retryHold
+	recipientHolds map[msg.UserVessel]*retryHold
+	// messages reserved from the outbox while their recipient is held off
+	held    []msg.Lease
+	holdMux sync.Mutex
+
+	// the running sync engine, stopSync is nil when it is not running.
+	// stopSync stops new work from starting, abortSync cancels work in progress
+	stopSync  context.CancelFunc
+	abortSync context.CancelFunc
+	syncWG    sync.WaitGroup
+	syncMux   sync.Mutex
+	// signalled when an urgent message is queued, so it does not wait out the backoff
+	urgent     chan struct{}
+	urgentOnce sync.Once
 }
 
+// NewMessage is a message to be written into the outbox
 type NewMessage struct {
 	ToName   string
 	ToVessel string
 	Subject  string
 	Body     string
+	// optional, the message expires at Expires or TTL after it is written
+	Expires time.Time
+	TTL     time.Duration
+	// Priority sends the message ahead of anything less urgent, it is routine when not set
+	Priority msg.Priority
+	// Seal encrypts the body, and the subject if SealSubject is set, for the recipient.
+	// Only clients signing with ed25519 can seal messages.
+	Seal        bool
+	SealSubject bool
+}
+
+// StatusError is returned when the server responds with a status other than 2xx
+type StatusError struct {
+	Action     string
+	Status     string
+	StatusCode int
+	// RetryAfter is how long the server asked to wait before trying again, if it did
+	RetryAfter time.Duration
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("attempted to %s. response status code of '%s %d'", err.Action, err.Status, err.StatusCode)
+}
+
+// Temporary reports whether the request could succeed if tried again later.
+// Server errors are temporary, while other client errors will fail the same way again.
+func (err *StatusError) Temporary() bool {
+	return err.StatusCode >= 500 ||
+		err.StatusCode == http.StatusRequestTimeout ||
+		err.StatusCode == http.StatusTooManyRequests
 }
 
 // *** Internal Types ***
@@ -46,6 +185,8 @@ type NewMessage struct {
 type safeBool struct {
 	mux  sync.RWMutex
 	bool bool
+	// closed when the value changes, only made while someone is waiting
+	changed chan struct{}
 }
 
 // *** Errors ***
@@ -53,6 +194,34 @@ type safeBool struct {
 // ErrServerOffline signifies that the server is offline
 var ErrServerOffline = errors.New("server is offline")
 
+// ErrMessageRejected is returned when the server will never accept a message,
+// so it is taken out of the outbox rather than blocking the messages behind it
+var ErrMessageRejected = errors.New("message was rejected")
+
+// ErrNoDeadLetter is returned when there is no dead letter for a message id
+var ErrNoDeadLetter = errors.New("no dead letter for message")
+
+// ErrNotSender is returned when retrying a dead letter that was sent by someone else
+var ErrNotSender = errors.New("message was not sent by this client")
+
+// ErrClientRunning is returned when starting a client that is already running
+var ErrClientRunning = errors.New("client is already running")
+
+// ErrNoEncryptionKey is returned when the recipient has not registered a key to encrypt messages for
+var ErrNoEncryptionKey = errors.New("recipient has no encryption key")
+
+// ErrEncryptionKeyChanged is returned when the server serves a different key for a recipient than before
+var ErrEncryptionKeyChanged = errors.New("recipient encryption key has changed")
+
+// ErrNoPublicKey is returned when the sender has not registered a public key to verify their messages with
+var ErrNoPublicKey = errors.New("sender has no public key")
+
+// ErrPublicKeyChanged is returned when the server serves a different public key for a sender than before
+var ErrPublicKeyChanged = errors.New("sender public key has changed")
+
+// ErrForgedMessage is returned when a delivered message is not signed by who it is from
+var ErrForgedMessage = errors.New("message is not signed by its sender")
+
 // *** New Config ***
 
 func NewClientConfig(name, vessel string) (*Config, error) {
@@ -69,11 +238,110 @@ func NewClientConfig(name, vessel string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	secretKey := []byte(os.Getenv("HMAC_SECRET"))
+	// each user only has their own key
+	signer, err := loadSigner(os.Getenv("SIGNING_ALGORITHM"), os.Getenv("SIGNING_KEY"))
+	if err != nil {
+		return nil, err
+	}
+
+	// only needed to read encrypted messages
+	var encryptionKey *ecdh.PrivateKey
+	if rawEncryptionKey := os.Getenv("ENCRYPTION_KEY"); rawEncryptionKey != "" {
+		encryptionKey, err = msg.ParseEncryptionKey(rawEncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse 'ENCRYPTION_KEY': %w", err)
+		}
+	}
+
+	// keys of recipients that are trusted without asking the server
+	var pinnedKeys map[msg.UserVessel]*ecdh.PublicKey
+	if pinnedKeysPath := os.Getenv("RECIPIENT_KEYS"); pinnedKeysPath != "" {
+		pinnedKeys, err = loadRecipientKeys(pinnedKeysPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load 'RECIPIENT_KEYS': %w", err)
+		}
+	}
+
+	// keys of senders that are trusted without asking the server
+	var pinnedSenderKeys map[msg.UserVessel]ed25519.PublicKey
+	if pinnedKeysPath := os.Getenv("SENDER_KEYS"); pinnedKeysPath != "" {
+		pinnedSenderKeys, err = loadSenderKeys(pinnedKeysPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load 'SENDER_KEYS': %w", err)
+		}
+	}
+
+	requestTimeout := defaultRequestTimeout
+	if rawTimeout := os.Getenv("REQUEST_TIMEOUT"); rawTimeout != "" {
+		requestTimeout, err = time.ParseDuration(rawTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse 'REQUEST_TIMEOUT': %w", err)
+		}
+	}
+
+	backoff, err := backoffFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	maxBatchBytes := defaultMaxBatchBytes
+	if rawBatchBytes := os.Getenv("MAX_BATCH_BYTES"); rawBatchBytes != "" {
+		maxBatchBytes, err = strconv.Atoi(rawBatchBytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse 'MAX_BATCH_BYTES': %w", err)
+		}
+	}
+
+	longPoll := false
+	if rawLongPoll := os.Getenv("LONG_POLL"); rawLongPoll != "" {
+		longPoll, err = strconv.ParseBool(rawLongPoll)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse 'LONG_POLL': %w", err)
+		}
+	}
+
+	compressMinBytes := defaultCompressMinBytes
+	if rawCompressBytes := os.Getenv("COMPRESS_MIN_BYTES"); rawCompressBytes != "" {
+		compressMinBytes, err = strconv.Atoi(rawCompressBytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse 'COMPRESS_MIN_BYTES': %w", err)
+		}
+	}
+
+	// inbox/outbox setup, restoring anything that was journaled
+	dataDir := os.Getenv("CLIENT_DATA_DIR")
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	journalPath := filepath.Join(dataDir, fmt.Sprintf("%s@%s.journal", name, vessel))
+	journal, boxes, err := store.Open(journalPath, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open journal '%s': %w", journalPath, err)
+	}
 
-	// inbox/outbox setup
 	outbox := msg.NewQueue()
+	for _, pkgMsg := range boxes[outboxName] {
+		outbox.Enqueue(pkgMsg)
+	}
 	inbox := msg.NewQueue()
+	for _, pkgMsg := range boxes[inboxName] {
+		inbox.Enqueue(pkgMsg)
+	}
+	knownKeysPath := filepath.Join(dataDir, fmt.Sprintf("%s@%s.keys", name, vessel))
+	knownKeys, err := loadRecipientKeys(knownKeysPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to load known keys '%s': %w", knownKeysPath, err)
+	}
+	knownSenderKeysPath := filepath.Join(dataDir, fmt.Sprintf("%s@%s.senders", name, vessel))
+	knownSenderKeys, err := loadSenderKeys(knownSenderKeysPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to load known sender keys '%s': %w", knownSenderKeysPath, err)
+	}
+
+	deadLetters := msg.NewDeadLetterQueue(0)
+	for _, deadLetter := range journal.DeadLetters()[deadLetterName] {
+		deadLetters.Restore(deadLetter)
+	}
 
 	// online setup
 	safeOnline := &safeBool{
@@ -82,75 +350,475 @@ func NewClientConfig(name, vessel string) (*Config, error) {
 	}
 
 	return &Config{
-		SecretKey: secretKey,
-		Client:    *http.DefaultClient,
-		Outbox:    outbox,
-		Inbox:     inbox,
-		Name:      name,
-		Vessel:    vessel,
-		Server:    "http://localhost:8080",
-		Online:    safeOnline,
+		Signer:         signer,
+		EncryptionKey:  encryptionKey,
+		Client:         http.Client{Timeout: requestTimeout},
+		Outbox:         outbox,
+		Inbox:          inbox,
+		DeadLetters:    deadLetters,
+		Journal:        journal,
+		Name:           name,
+		Vessel:         vessel,
+		Server:         "http://localhost:8080",
+		Online:         safeOnline,
+		RequestTimeout: requestTimeout,
+		Backoff:        backoff,
+
+		MaxBatchBytes:    maxBatchBytes,
+		CompressMinBytes: compressMinBytes,
+		LongPoll:         longPoll,
+
+		PinnedKeys:    pinnedKeys,
+		KnownKeysPath: knownKeysPath,
+		knownKeys:     knownKeys,
+
+		PinnedSenderKeys:    pinnedSenderKeys,
+		KnownSenderKeysPath: knownSenderKeysPath,
+		knownSenderKeys:     knownSenderKeys,
 	}, nil
 }
 
+// backoffFromEnv reads 'BACKOFF_INITIAL', 'BACKOFF_MAX', 'BACKOFF_MULTIPLIER' and 'BACKOFF_JITTER',
+// using DefaultBackoff for any that are not set
+func backoffFromEnv() (Backoff, error) {
+	backoff := DefaultBackoff
+
+	var err error
+	if rawInitial := os.Getenv("BACKOFF_INITIAL"); rawInitial != "" {
+		backoff.Initial, err = time.ParseDuration(rawInitial)
+		if err != nil {
+			return Backoff{}, fmt.Errorf("unable to parse 'BACKOFF_INITIAL': %w", err)
+		}
+	}
+	if rawMax := os.Getenv("BACKOFF_MAX"); rawMax != "" {
+		backoff.Max, err = time.ParseDuration(rawMax)
+		if err != nil {
+			return Backoff{}, fmt.Errorf("unable to parse 'BACKOFF_MAX': %w", err)
+		}
+	}
+	if rawMultiplier := os.Getenv("BACKOFF_MULTIPLIER"); rawMultiplier != "" {
+		backoff.Multiplier, err = strconv.ParseFloat(rawMultiplier, 64)
+		if err != nil {
+			return Backoff{}, fmt.Errorf("unable to parse 'BACKOFF_MULTIPLIER': %w", err)
+		}
+	}
+	if rawJitter := os.Getenv("BACKOFF_JITTER"); rawJitter != "" {
+		backoff.Jitter, err = strconv.ParseFloat(rawJitter, 64)
+		if err != nil {
+			return Backoff{}, fmt.Errorf("unable to parse 'BACKOFF_JITTER': %w", err)
+		}
+	}
+
+	return backoff, nil
+}
+
+// loadSigner creates the signer for the algorithm. hmac keys are used as is,
+// ed25519 keys are a base64 encoded 32 byte seed.
+func loadSigner(algorithm, rawKey string) (msg.Signer, error) {
+	if rawKey == "" {
+		return nil, errors.New("unable to find 'SIGNING_KEY' in './.env'")
+	}
+
+	switch algorithm {
+	case "", msg.AlgorithmHMACSHA256:
+		return msg.NewHMACSigner([]byte(rawKey)), nil
+
+	case msg.AlgorithmEd25519:
+		seed, err := base64.StdEncoding.DecodeString(rawKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode 'SIGNING_KEY': %w", err)
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("'SIGNING_KEY' must be a %d byte ed25519 seed", ed25519.SeedSize)
+		}
+		return msg.NewEd25519Signer(ed25519.NewKeyFromSeed(seed))
+
+	default:
+		return nil, fmt.Errorf("unknown 'SIGNING_ALGORITHM' %q", algorithm)
+	}
+}
+
 // *** Functions ***
 
-// StartClient will begin with checking if the server is online or not.
-func (c *Config) StartClient() error {
-	errChan := make(chan error, 1)
+// Close stops the sync engine and closes the clients journal.
+// Queued messages are kept for the next run.
+func (c *Config) Close() error {
+	// requests are bounded by the request timeout, so this does not wait forever
+	c.Stop(context.Background())
+	return c.Journal.Close()
+}
+
+// StartClient runs the sync engine in the background and returns straight away.
+// While the server is online the outbox is sent and the inbox is filled, and
+// while it is offline the server is checked until it comes back. Runs until
+// Stop is called, or ctx is done which also cancels any request in progress.
+func (c *Config) StartClient(ctx context.Context) error {
+	c.syncMux.Lock()
+	defer c.syncMux.Unlock()
+
+	if c.stopSync != nil {
+		return ErrClientRunning
+	}
+	requestCtx, abort := context.WithCancel(ctx)
+	loopCtx, stop := context.WithCancel(requestCtx)
+	c.stopSync, c.abortSync = stop, abort
+
+	c.syncWG.Add(3)
+	go c.checkServerLoop(loopCtx, requestCtx)
+	go c.sendLoop(loopCtx, requestCtx)
+	go c.receiveLoop(loopCtx, requestCtx)
+	return nil
+}
 
+// Stop shuts down the sync engine, waiting for any send or receive in progress
+// to finish. If ctx is done first they are cancelled, and ctx's error is returned.
+// Safe to call when the client was never started.
+func (c *Config) Stop(ctx context.Context) error {
+	c.syncMux.Lock()
+	defer c.syncMux.Unlock()
+
+	if c.stopSync == nil {
+		return nil
+	}
+	c.stopSync()
+
+	stopped := make(chan struct{})
 	go func() {
-		checkServer, err := time.ParseDuration("15s")
-		if err != nil {
-			fmt.Printf("Unable to parse duration.\n")
-			errChan <- err
-		}
-		tryCheckServer := time.NewTicker(checkServer)
-
-		// every 15 seconds check server
-		for ; ; <-tryCheckServer.C {
-			fmt.Printf("Checking server status...\n")
-
-			err := c.checkServerIsOnline()
-			if errors.Is(err, ErrServerOffline) {
-				// sleep 15 seconds if server is offline
-				fmt.Printf("Server is offline. Checking again in 15 seconds...\n")
-			} else if err != nil {
-				fmt.Printf("Not able to check server: %q\n", err)
-				errChan <- err
+		c.syncWG.Wait()
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = ctx.Err()
+		c.abortSync()
+		<-stopped
+	}
+
+	c.abortSync()
+	c.stopSync, c.abortSync = nil, nil
+	return err
+}
+
+// checkServerLoop checks the health of the server while it is offline, backing off
+// after each failed check. Queueing an urgent message checks again straight away.
+// New checks stop when ctx is done, requests are made with requestCtx.
+func (c *Config) checkServerLoop(ctx, requestCtx context.Context) {
+	defer c.syncWG.Done()
+
+	wait := time.NewTimer(0)
+	defer wait.Stop()
+
+	// check straight away, then back off until the server is back
+	attempt := 0
+	for {
+		// while online, only wait for the server to go offline
+		if c.Online.getValue() {
+			onlineSince := time.Now()
+			err := c.Online.waitFor(ctx, false)
+			if err != nil {
+				return
+			}
+
+			// a server that goes again soon after coming back keeps backing off,
+			// otherwise it is checked straight away
+			if time.Since(onlineSince) >= healthCheckInterval {
+				attempt = 0
 			}
+			delay := time.Duration(0)
+			if attempt > 0 {
+				delay = c.Backoff.Delay(attempt)
+				attempt++
+			}
+			wait.Reset(delay)
 		}
-	}()
 
-	go func() {
-		sendMessageDuration, err := time.ParseDuration("500ms")
+		select {
+		case <-ctx.Done():
+			return
+		case <-wait.C:
+		case <-c.urgentQueued():
+			// an urgent message should not wait out the backoff, so check now
+			attempt = 0
+			wait.Stop()
+		}
+
+		// a send may have already found the server while waiting, that is not news
+		wasOnline := c.Online.getValue()
+		err := c.checkServerIsOnline(requestCtx)
+		if err == nil {
+			if !wasOnline {
+				fmt.Printf("Server is online.\n")
+			}
+			continue
+		}
+
+		delay := c.Backoff.Delay(attempt)
+		attempt++
+		if errors.Is(err, ErrServerOffline) {
+			fmt.Printf("Server is offline. Checking again in %s...\n", delay.Round(time.Millisecond))
+		} else if requestCtx.Err() == nil {
+			fmt.Printf("Not able to check server: %q\n", err)
+		}
+		wait.Reset(delay)
+	}
+}
+
+// sendLoop sends messages as soon as they are written while the server is online,
+// in batches of whatever has built up in the outbox. Messages to recipients that are
+// held off are kept back until their hold is over, while the rest are still sent.
+// New work stops when ctx is done, requests are made with requestCtx.
+func (c *Config) sendLoop(ctx, requestCtx context.Context) {
+	defer c.syncWG.Done()
+	defer c.releaseHeld(true)
+
+	for ctx.Err() == nil {
+		err := c.Online.waitFor(ctx, true)
 		if err != nil {
-			fmt.Printf("Unable to parse duration.\n")
-			errChan <- err
-		}
-		trySendMessage := time.NewTicker(sendMessageDuration)
-
-		// 500 ms between each tick
-		for ; ; <-trySendMessage.C {
-			online := c.Online.getValue()
-			if online {
-				fmt.Printf("Server online, TODO: sending message...\n")
-			} else {
-				fmt.Printf("Waiting for server to come back online...\n")
+			return
+		}
+		err = c.waitServerHold(ctx)
+		if err != nil {
+			return
+		}
+
+		// wait for a message, or for a held one to be due
+		reserveCtx, cancel := ctx, context.CancelFunc(func() {})
+		next := c.releaseHeld(false)
+		if !next.IsZero() {
+			reserveCtx, cancel = context.WithDeadline(ctx, next)
+		}
+		lease, err := c.Outbox.ReserveWait(reserveCtx)
+		cancel()
+		if err != nil {
+			continue
+		}
+		// the server may have gone while waiting for a message
+		if !c.Online.getValue() {
+			c.Outbox.Requeue(lease.ID)
+			continue
+		}
+		if c.holdIfHeld(lease) {
+			continue
+		}
+
+		rejectedErr, err := c.sendBatch(requestCtx, c.reserveBatch(lease))
+		if rejectedErr != nil {
+			fmt.Printf("Unable to send messages: %q\n", rejectedErr)
+		}
+		if err == nil || requestCtx.Err() != nil {
+			continue
+		}
+		fmt.Printf("Unable to send messages: %q\n", err)
+
+		// a failure that leaves the server online, such as with the journal,
+		// would otherwise be retried straight away. Those the server answered with are already held off
+		var statusErr *StatusError
+		if c.Online.getValue() && !errors.As(err, &statusErr) {
+			wait := time.NewTimer(sendRetryInterval)
+			select {
+			case <-ctx.Done():
+			case <-wait.C:
 			}
+			wait.Stop()
+		}
+	}
+}
 
+// receiveLoop fills the inbox while the server is online. Messages are streamed as they arrive,
+// or long polled for when LongPoll is set or the server does not stream them.
+// New work stops when ctx is done, requests are made with requestCtx.
+func (c *Config) receiveLoop(ctx, requestCtx context.Context) {
+	defer c.syncWG.Done()
+
+	for ctx.Err() == nil && !c.noStream.Load() && !c.LongPoll {
+		err := c.Online.waitFor(ctx, true)
+		if err != nil {
+			return
 		}
-	}()
 
-	fmt.Printf("at bottom...\n")
+		err = c.streamMessages(ctx, requestCtx)
+		if ctx.Err() != nil {
+			return
+		}
+		if c.noStream.Load() {
+			fmt.Printf("Server does not stream messages, polling for them instead.\n")
+			break
+		}
+		if err != nil {
+			fmt.Printf("Unable to stream messages: %q\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(streamRetryInterval):
+		}
+	}
 
-	err := <-errChan
+	c.pollLoop(ctx)
+}
+
+// pollLoop asks the server for messages, which holds the request open until one arrives.
+// It asks again straight away after recieving messages, otherwise no more than every
+// receiveInterval, so that servers which do not hold requests open are not flooded.
+func (c *Config) pollLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := c.Online.waitFor(ctx, true)
+		if err != nil {
+			return
+		}
+
+		// a wait cut short by Stop loses nothing, as unacknowledged messages are delivered again
+		started := time.Now()
+		recieved, err := c.getMessagesFromServer(ctx, c.longPollWait())
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Unable to receive messages: %q\n", err)
+		}
+		if recieved > 0 && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(receiveInterval - time.Since(started)):
+		}
+	}
+}
+
+// longPollWait returns how long the server can hold a request for messages
+// open, leaving time for the response within the request timeout
+func (c *Config) longPollWait() time.Duration {
+	timeout := c.RequestTimeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	return max(min(longPollWait, timeout-longPollMargin), 0)
+}
+
+// sendUntilEmpty sends messages in batches with requestCtx until the outbox is empty, a send fails,
+// or ctx is done. A batch being sent when ctx is done is finished first.
+// Rejected messages do not stop the sending, and are returned together at the end.
+func (c *Config) sendUntilEmpty(ctx, requestCtx context.Context) error {
+	// messages to recipients that are held off are skipped, and left in the outbox
+	defer c.releaseHeld(true)
+
+	var rejected []error
+	for ctx.Err() == nil {
+		lease, ok := c.Outbox.Reserve()
+		if !ok {
+			return errors.Join(rejected...)
+		}
+		if c.holdIfHeld(lease) {
+			continue
+		}
+
+		rejectedErr, err := c.sendBatch(requestCtx, c.reserveBatch(lease))
+		if rejectedErr != nil {
+			rejected = append(rejected, rejectedErr)
+		}
+		if err != nil {
+			return errors.Join(append(rejected, err)...)
+		}
+	}
+	return errors.Join(append(rejected, ctx.Err())...)
+}
+
+// newRequest creates a request to the server that is bounded by the request timeout.
+// cancel must be called once the response has been read.
+func (c *Config) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, context.CancelFunc, error) {
+	timeout := c.RequestTimeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+
+	body, encoding, err := c.encodeBody(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	req, err := http.NewRequestWithContext(ctx, method, c.Server+path, bodyReader)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	return req, cancel, nil
+}
+
+// authorizeMailbox signs a request to the owners mailbox, covering its method, path and body.
+// body is the body before it was compressed, as the server checks it once decoded.
+func (c *Config) authorizeMailbox(req *http.Request, owner msg.UserVessel, body []byte) error {
+	mailboxReq, err := msg.NewMailboxRequest(owner, c.Signer, req.Method, req.URL.RequestURI(), body)
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Authorization", mailboxReq.Authorization())
 	return nil
 }
 
+// do sends a request to the server. The server is marked offline when it
+// cannot be reached or has an error of its own, but not when the caller
+// cancelled the request, or the server refused this one request.
+func (c *Config) do(req *http.Request) (*http.Response, error) {
+	return c.doWith(&c.Client, req)
+}
+
+// doStream sends a request whose response is read for as long as the stream is open,
+// so it is not bounded by the timeout of the client
+func (c *Config) doStream(req *http.Request) (*http.Response, error) {
+	streamClient := c.Client
+	streamClient.Timeout = 0
+	return c.doWith(&streamClient, req)
+}
+
+func (c *Config) doWith(client *http.Client, req *http.Request) (*http.Response, error) {
+	res, err := client.Do(req)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			c.Online.setValue(false)
+		}
+		return nil, err
+	}
+
+	// only compress requests, or send the binary encoding, to a server that says it can decode them
+	c.serverGzip.Store(acceptsGzip(res.Header.Get("Accept-Encoding")))
+	c.serverBinary.Store(acceptsBinary(res.Header.Get("Accept-Post")))
+	err = decodeResponse(res)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	// a server that answers is online, even when it is too busy to take a request.
+	// Senders back off from temporary failures themselves, see holdFor
+	return res, nil
+}
+
+// checkStatus returns a StatusError when the response is not 2xx
+func checkStatus(res *http.Response, action string) *StatusError {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	return &StatusError{
+		Action:     action,
+		Status:     res.Status,
+		StatusCode: res.StatusCode,
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
 // safely get the value of bool
 func (bo *safeBool) getValue() bool {
 	bo.mux.RLock()
@@ -162,14 +830,48 @@ func (bo *safeBool) getValue() bool {
 // safely set the value of bool
 func (bo *safeBool) setValue(val bool) {
 	bo.mux.Lock()
+	if bo.bool != val && bo.changed != nil {
+		close(bo.changed)
+		bo.changed = nil
+	}
 	bo.bool = val
 	bo.mux.Unlock()
 }
 
-func (c *Config) checkServerIsOnline() error {
-	res, err := c.Client.Get(c.Server + "/health")
+// waitFor blocks until the value is val, or ctx is done
+func (bo *safeBool) waitFor(ctx context.Context, val bool) error {
+	for {
+		bo.mux.Lock()
+		if bo.bool == val {
+			bo.mux.Unlock()
+			return nil
+		}
+		if bo.changed == nil {
+			bo.changed = make(chan struct{})
+		}
+		changed := bo.changed
+		bo.mux.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (c *Config) checkServerIsOnline(ctx context.Context) error {
+	req, cancel, err := c.newRequest(ctx, http.MethodGet, "/health", nil)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	res, err := c.do(req)
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
 	if err != nil {
-		c.Online.setValue(false)
 		return ErrServerOffline
 	}
 	defer res.Body.Close()
@@ -191,129 +893,576 @@ func (c *Config) checkServerIsOnline() error {
 	return nil
 }
 
-func (c *Config) getMessagesFromServer() error {
+// getMessagesFromServer puts the messages waiting on the server into the inbox, asking the
+// server to wait up to wait for one to arrive when there are none. Returns how many were recieved.
+func (c *Config) getMessagesFromServer(ctx context.Context, wait time.Duration) (int, error) {
+	owner := msg.UserVessel{Name: c.Name, Vessel: c.Vessel}
+	path := "/get-messages"
+	if wait > 0 {
+		path += "?" + url.Values{"wait": {wait.String()}}.Encode()
+	}
+
 	// get response for specific user
-	res, err := c.Client.Get(c.Server + "/get-messages")
+	req, cancel, err := c.newRequest(ctx, http.MethodGet, path, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer cancel()
+	req.Header.Set("Accept", acceptDeliveries)
+	err = c.authorizeMailbox(req, owner, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
 
 	// check return status
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return fmt.Errorf("attempted to send message. response status code of '%s %d'", res.Status, res.StatusCode)
+	statusErr := checkStatus(res, "get messages")
+	if statusErr != nil {
+		return 0, statusErr
+	}
+
+	deliveries, err := decodeDeliveries(res)
+	if err != nil {
+		return 0, err
+	}
+
+	var inboxErr error
+	ack := msg.Acknowledgement{Leases: make([]uint64, 0, len(deliveries))}
+	for _, delivery := range deliveries {
+		// only acknowledge once the message is safely in the inbox
+		inboxErr = c.putInInbox(ctx, delivery)
+		if inboxErr != nil {
+			break
+		}
+		ack.Leases = append(ack.Leases, delivery.Lease)
+	}
+
+	err = c.acknowledgeMessages(ctx, owner, ack)
+	if inboxErr != nil {
+		return len(ack.Leases), inboxErr
+	}
+	return len(ack.Leases), err
+}
+
+// putInInbox verifies a delivered message and journals it, then puts it into the inbox.
+// A message already in the inbox was delivered again as its acknowledgement was lost, and is skipped.
+// Messages not signed by their sender are moved to the dead letters instead.
+func (c *Config) putInInbox(ctx context.Context, delivery msg.Delivery) error {
+	// verified before waiting on the inbox, as the key of the sender may need to be fetched
+	keys, verifyErr := c.verifyDelivery(ctx, &delivery.Message)
+	if verifyErr != nil && !errors.Is(verifyErr, ErrForgedMessage) {
+		return verifyErr
+	}
+
+	c.inboxMux.Lock()
+	defer c.inboxMux.Unlock()
+
+	if delivery.Message.ID != "" && c.Inbox.Contains(delivery.Message.From, delivery.Message.ID) {
+		return nil
+	}
+	if verifyErr != nil {
+		fmt.Printf("WARNING: moving message %s to the dead letters due to: %q\n", delivery.Message.ID, verifyErr)
+		return c.deadLetter(delivery.Message, verifyErr)
 	}
 
+	pkgMsg := c.openMessage(delivery.Message, keys)
+
+	c.journalMux.RLock()
+	defer c.journalMux.RUnlock()
+
+	err := c.Journal.Put(inboxName, pkgMsg)
+	if err != nil {
+		return err
+	}
+	c.Inbox.Enqueue(pkgMsg)
 	return nil
 }
 
+// acknowledgeMessages tells the server that deliveries were recieved,
+// anything left unacknowledged will be delivered again later
+func (c *Config) acknowledgeMessages(ctx context.Context, owner msg.UserVessel, ack msg.Acknowledgement) error {
+	if len(ack.Leases) == 0 {
+		return nil
+	}
+
+	ackData, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+
+	req, cancel, err := c.newRequest(ctx, http.MethodPost, "/ack-messages", ackData)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	req.Header.Set("Content-Type", "application/json")
+	err = c.authorizeMailbox(req, owner, ackData)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// check return status
+	statusErr := checkStatus(res, "acknowledge messages")
+	if statusErr != nil {
+		return statusErr
+	}
+	return nil
+}
+
+// ReceiveMessages will retrieve every message waiting on the server
+// for this client and place them into the inbox.
+func (c *Config) ReceiveMessages(ctx context.Context) error {
+	online := c.Online.getValue()
+
+	// perform additional check
+	if !online {
+		err := c.checkServerIsOnline(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := c.getMessagesFromServer(ctx, 0)
+	return err
+}
+
 // WriteMessageIntoQueue crafts a message and inserts it into the clients queue.
 func (c *Config) WriteMessageIntoQueue(toName, toVessel, subject, body string) error {
-	newMessage := &msg.RawMessage{
-		ToName:     toName,
-		ToVessel:   toVessel,
+	newMessage := NewMessage{
+		ToName:   toName,
+		ToVessel: toVessel,
+		Subject:  subject,
+		Body:     body,
+	}
+
+	return c.WriteNewMessageIntoQueue(context.Background(), newMessage)
+}
+
+// WriteSealedMessageIntoQueue crafts a message with the body, and the subject if sealSubject is set,
+// encrypted so that only the recipient can read it. The recipients key is looked up on the server
+// the first time they are written to.
+func (c *Config) WriteSealedMessageIntoQueue(ctx context.Context, toName, toVessel, subject, body string, sealSubject bool) error {
+	newMessage := NewMessage{
+		ToName:      toName,
+		ToVessel:    toVessel,
+		Subject:     subject,
+		Body:        body,
+		Seal:        true,
+		SealSubject: sealSubject,
+	}
+
+	return c.WriteNewMessageIntoQueue(ctx, newMessage)
+}
+
+// WriteNewMessageIntoQueue crafts a message with any expiry, priority and sealing set on it,
+// and inserts it into the clients queue. Only sealing needs to reach the server.
+func (c *Config) WriteNewMessageIntoQueue(ctx context.Context, newMessage NewMessage) error {
+	rawMsg := &msg.RawMessage{
+		ToName:     newMessage.ToName,
+		ToVessel:   newMessage.ToVessel,
 		FromName:   c.Name,
 		FromVessel: c.Vessel,
-		Subject:    subject,
-		Body:       body,
+		Subject:    newMessage.Subject,
+		Body:       newMessage.Body,
+		Expires:    newMessage.Expires,
+		TTL:        newMessage.TTL,
+		Priority:   newMessage.Priority,
 	}
 
-	err := c.addToQueue(newMessage)
+	if !newMessage.Seal {
+		pkgMsg, err := rawMsg.ToPackagedMessageWith(c.Signer)
+		if err != nil {
+			return err
+		}
+		return c.queueMessage(pkgMsg)
+	}
+
+	recipient := msg.UserVessel{Name: newMessage.ToName, Vessel: newMessage.ToVessel}
+	recipientKey, err := c.recipientKey(ctx, recipient)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	pkgMsg, err := rawMsg.ToSealedMessage(c.Signer, recipientKey, newMessage.SealSubject)
+	if err != nil {
+		return err
+	}
+	return c.queueMessage(pkgMsg)
 }
 
-func (c *Config) addToQueue(rawMsg *msg.RawMessage) error {
-	pkgMsg, err := rawMsg.ToPackagedMessage(c.SecretKey)
+// queueMessage journals the packaged message then places it into the outbox
+func (c *Config) queueMessage(pkgMsg *msg.PackagedMessage) error {
+	c.journalMux.RLock()
+	err := c.Journal.Put(outboxName, *pkgMsg)
+	if err == nil {
+		c.Outbox.Enqueue(*pkgMsg)
+	}
+	c.journalMux.RUnlock()
 	if err != nil {
 		return err
 	}
 
-	c.Outbox.Enqueue(*pkgMsg)
+	if pkgMsg.Priority >= msg.PriorityUrgent {
+		select {
+		case c.urgentQueued() <- struct{}{}:
+		default:
+			// a check is already due
+		}
+	}
 	return nil
 }
 
+// urgentQueued returns the channel that is signalled when an urgent message is queued
+func (c *Config) urgentQueued() chan struct{} {
+	c.urgentOnce.Do(func() {
+		c.urgent = make(chan struct{}, 1)
+	})
+	return c.urgent
+}
+
+// openMessage decrypts a message that was encrypted for this user, once it is verified with the keys of its sender.
+// Messages that cannot be opened are kept as they are, so that nothing is lost.
+func (c *Config) openMessage(pkgMsg msg.PackagedMessage, keys msg.Keyring) msg.PackagedMessage {
+	if !pkgMsg.IsEncrypted() {
+		return pkgMsg
+	}
+	if c.EncryptionKey == nil {
+		fmt.Printf("Unable to open message %s as there is no 'ENCRYPTION_KEY'.\n", pkgMsg.ID)
+		return pkgMsg
+	}
+
+	opened, err := pkgMsg.Open(c.EncryptionKey, keys)
+	if err != nil {
+		fmt.Printf("Unable to open message %s: %q\n", pkgMsg.ID, err)
+		return pkgMsg
+	}
+	return opened
+}
+
+// ReadMessage removes the next message from the inbox.
+// Messages that expired before being read are moved to the dead letters instead.
+// Returns false if the inbox is empty.
+func (c *Config) ReadMessage() (msg.PackagedMessage, bool, error) {
+	for {
+		nextMsg, ok := c.Inbox.Dequeue()
+		if !ok {
+			return msg.PackagedMessage{}, false, nil
+		}
+
+		unread, err := c.takeFromInbox(nextMsg)
+		if unread {
+			return nextMsg, true, err
+		}
+		if err != nil {
+			return msg.PackagedMessage{}, false, err
+		}
+	}
+}
+
+// ReadMessageWait removes the next message from the inbox, waiting for one to be
+// recieved if the inbox is empty. Messages that expired before being read are moved
+// to the dead letters instead. Returns ctx's error if it is done first.
+func (c *Config) ReadMessageWait(ctx context.Context) (msg.PackagedMessage, error) {
+	for {
+		nextMsg, err := c.Inbox.DequeueWait(ctx)
+		if err != nil {
+			return msg.PackagedMessage{}, err
+		}
+
+		unread, err := c.takeFromInbox(nextMsg)
+		if unread {
+			return nextMsg, err
+		}
+		if err != nil {
+			return msg.PackagedMessage{}, err
+		}
+	}
+}
+
+// takeFromInbox journals that a message was taken out of the inbox. Returns false
+// if it had expired, and was moved to the dead letters rather than being read.
+func (c *Config) takeFromInbox(pkgMsg msg.PackagedMessage) (bool, error) {
+	if !pkgMsg.IsExpired(time.Now().UTC()) {
+		return true, c.journalDelete(inboxName, pkgMsg)
+	}
+
+	// journaled as a dead letter first, so a crash cannot lose it
+	err := c.deadLetter(pkgMsg, msg.ErrMessageExpired)
+	if err != nil {
+		return false, err
+	}
+	return false, c.journalDelete(inboxName, pkgMsg)
+}
+
 // internal method for sending messages
-func (c *Config) sendMessage(pkgMsg *msg.PackagedMessage) error {
-	// verify message before sending
-	// TODO: do something with messages that have invalid signatures?
-	err := pkgMsg.VerifyMessage(c.SecretKey)
+func (c *Config) sendMessage(ctx context.Context, pkgMsg *msg.PackagedMessage) error {
+	err := c.checkSendable(pkgMsg)
 	if err != nil {
 		return err
 	}
 
-	// marshal message into buffer
-	msgData, err := json.Marshal(pkgMsg)
+	// encode message as the server prefers
+	msgData, contentType, err := c.encodeMessage(pkgMsg)
 	if err != nil {
 		return err
 	}
-	msgDataReader := bytes.NewBuffer(msgData)
 
 	// post message
-	res, err := c.Client.Post(c.Server+"/send-message", "application/json", msgDataReader)
+	req, cancel, err := c.newRequest(ctx, http.MethodPost, "/send-message", msgData)
 	if err != nil {
-		c.Online.setValue(false)
 		return err
 	}
+	defer cancel()
+	req.Header.Set("Content-Type", contentType)
 
-	// check return status
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		c.Online.setValue(false)
-		return fmt.Errorf("attempted to send message. response status code of '%s %d'", res.Status, res.StatusCode)
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// check return status, sending again will not help unless the problem is temporary
+	statusErr := checkStatus(res, "send message")
+	if statusErr != nil && !statusErr.Temporary() {
+		return fmt.Errorf("%w: message %s: %w", ErrMessageRejected, pkgMsg.ID, statusErr)
+	}
+	if statusErr != nil {
+		return statusErr
 	}
 
 	// successful send
 	return nil
 }
 
-func (c *Config) SendOneFromQueue() error {
+// checkSendable returns an error wrapping ErrMessageRejected when the server would only reject the message
+func (c *Config) checkSendable(pkgMsg *msg.PackagedMessage) error {
+	// verify message before sending
+	err := pkgMsg.VerifyMessageBy(c.Signer)
+	if err != nil {
+		return fmt.Errorf("%w: message %s: %w", ErrMessageRejected, pkgMsg.ID, err)
+	}
+	// nor would it accept an expired message
+	if pkgMsg.IsExpired(time.Now().UTC()) {
+		return fmt.Errorf("%w: message %s: %w", ErrMessageRejected, pkgMsg.ID, msg.ErrMessageExpired)
+	}
+	return nil
+}
+
+// sendReserved sends a message reserved from the outbox. It is only removed once the server
+// has accepted it, or moved to the dead letters once rejected, otherwise it goes back to the front of the outbox.
+func (c *Config) sendReserved(ctx context.Context, lease msg.Lease) error {
+	err := c.sendMessage(ctx, &lease.Message)
+	if errors.Is(err, ErrMessageRejected) {
+		return c.rejectReserved(lease, err)
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.Temporary() {
+		c.holdFor(lease.Message.To, statusErr)
+	}
+	if err != nil {
+		c.Outbox.Requeue(lease.ID)
+		return err
+	}
+
+	c.clearHolds(lease.Message.To)
+	return c.commitReserved(lease)
+}
+
+// commitReserved removes a message the server has accepted from the outbox and journal
+func (c *Config) commitReserved(lease msg.Lease) error {
+	c.journalMux.RLock()
+	c.Outbox.Commit(lease.ID)
+	err := c.Journal.Delete(outboxName, lease.Message)
+	c.journalMux.RUnlock()
+
+	c.compactIfNeeded()
+	return err
+}
+
+// rejectReserved moves a message the server will not accept from the outbox to the dead letters.
+// Returns why it was rejected, along with any error journaling it. A message that cannot be
+// made a dead letter goes back into the outbox, and the error returned is not ErrMessageRejected
+// so that it is treated like any other failed send.
+func (c *Config) rejectReserved(lease msg.Lease, reason error) error {
+	fmt.Printf("Message %s was rejected, moving it to the dead letters: %q\n", lease.Message.ID, reason)
+
+	// journaled as a dead letter first, so a crash cannot lose it
+	err := c.deadLetter(lease.Message, reason)
+	if err != nil {
+		c.Outbox.Requeue(lease.ID)
+		return fmt.Errorf("unable to move rejected message %s to the dead letters: %w", lease.Message.ID, err)
+	}
+
+	c.journalMux.RLock()
+	c.Outbox.Commit(lease.ID)
+	err = c.Journal.Delete(outboxName, lease.Message)
+	c.journalMux.RUnlock()
+
+	c.compactIfNeeded()
+	return errors.Join(reason, err)
+}
+
+func (c *Config) SendOneFromQueue(ctx context.Context) error {
 	online := c.Online.getValue()
 
 	// perform additional check
 	if !online {
-		err := c.checkServerIsOnline()
+		err := c.checkServerIsOnline(ctx)
 		if err != nil {
 			return err
 		}
 	}
 	// continue if online
 
-	msgToSend, ok := c.Outbox.Dequeue()
+	lease, ok := c.Outbox.Reserve()
 	if !ok {
-		return errors.New("unable to dequeue message for sending")
+		return errors.New("unable to reserve message for sending")
 	}
 
-	c.sendMessage(&msgToSend)
-
-	return nil
+	return c.sendReserved(ctx, lease)
 }
 
 // SendAllFromQueue will go through the entire queue and
 // send messages until its empty.
-func (c *Config) SendAllFromQueue() error {
+func (c *Config) SendAllFromQueue(ctx context.Context) error {
 	online := c.Online.getValue()
 
 	// perform additional check
 	if !online {
-		err := c.checkServerIsOnline()
+		err := c.checkServerIsOnline(ctx)
 		if err != nil {
 			return err
 		}
 	}
 
 	// send until queue is empty
-	for !c.Outbox.IsEmpty() {
-		msgToSend, ok := c.Outbox.Dequeue()
-		if !ok {
-			return errors.New("unable to dequeue message for sending")
-		}
+	return c.sendUntilEmpty(ctx, ctx)
+}
+
+// deadLetter records a message that the server will not accept or that expired, and why
+func (c *Config) deadLetter(pkgMsg msg.PackagedMessage, reason error) error {
+	c.journalMux.RLock()
+	defer c.journalMux.RUnlock()
 
-		err := c.sendMessage(&msgToSend)
+	deadLetter, _, err := c.DeadLetters.Add(pkgMsg, reason.Error(), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("unable to dead letter message %s: %w", pkgMsg.ID, err)
+	}
+	err = c.Journal.PutDeadLetter(deadLetterName, deadLetter)
+	if err != nil && deadLetter.Attempts == 1 {
+		// a new dead letter is only kept once it is journaled, the message is still wherever it was
+		c.DeadLetters.Remove(pkgMsg.ID)
+	}
+	return err
+}
+
+// RetryDeadLetter sends a dead letter again as it was. It is removed from the dead
+// letters once the server accepts it, and has its attempts counted up if rejected again.
+func (c *Config) RetryDeadLetter(ctx context.Context, id string) error {
+	deadLetter, ok := c.DeadLetters.Get(id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoDeadLetter, id)
+	}
+	// expired messages from the inbox are dead letters too, but are not ours to send
+	if deadLetter.Message.From != (msg.UserVessel{Name: c.Name, Vessel: c.Vessel}) {
+		return fmt.Errorf("%w: %s", ErrNotSender, id)
+	}
+
+	err := c.sendMessage(ctx, &deadLetter.Message)
+	if errors.Is(err, ErrMessageRejected) {
+		return errors.Join(err, c.deadLetter(deadLetter.Message, err))
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.PurgeDeadLetter(id)
+}
+
+// PurgeDeadLetter removes a dead letter for good
+func (c *Config) PurgeDeadLetter(id string) error {
+	c.journalMux.RLock()
+	deadLetter, ok := c.DeadLetters.Remove(id)
+	var err error
+	if ok {
+		err = c.Journal.DeleteDeadLetter(deadLetterName, deadLetter)
+	}
+	c.journalMux.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoDeadLetter, id)
+	}
+
+	c.compactIfNeeded()
+	return err
+}
+
+// PurgeDeadLetters removes every dead letter for good, returning how many there were
+func (c *Config) PurgeDeadLetters() (int, error) {
+	c.journalMux.RLock()
+	purged := c.DeadLetters.Purge()
+	var err error
+	for _, deadLetter := range purged {
+		err = c.Journal.DeleteDeadLetter(deadLetterName, deadLetter)
 		if err != nil {
-			return err
+			break
 		}
 	}
+	c.journalMux.RUnlock()
 
-	return nil
+	c.compactIfNeeded()
+	return len(purged), err
+}
+
+// journalDelete journals a message being removed from a box
+func (c *Config) journalDelete(box string, pkgMsg msg.PackagedMessage) error {
+	c.journalMux.RLock()
+	err := c.Journal.Delete(box, pkgMsg)
+	c.journalMux.RUnlock()
+
+	c.compactIfNeeded()
+	return err
+}
+
+// compactIfNeeded rewrites the journal once enough messages have been removed from it,
+// so that a client which runs for a long time does not need a restart to reclaim the space
+func (c *Config) compactIfNeeded() {
+	if c.Journal.Garbage() < compactAfter {
+		return
+	}
+
+	c.journalMux.Lock()
+	defer c.journalMux.Unlock()
+
+	// another send or read may have compacted it while waiting
+	if c.Journal.Garbage() < compactAfter {
+		return
+	}
+
+	// messages being sent are still in the outbox until the server accepts them
+	outbox := make([]msg.PackagedMessage, 0)
+	for _, lease := range c.Outbox.Leases() {
+		outbox = append(outbox, lease.Message)
+	}
+	boxes := store.Boxes{
+		outboxName: append(outbox, c.Outbox.Messages()...),
+		inboxName:  c.Inbox.Messages(),
+	}
+	dead := store.DeadLetters{deadLetterName: c.DeadLetters.List()}
+
+	// the client remembers no message keys, as the server is the one to deduplicate
+	err := c.Journal.Compact(boxes, nil, dead)
+	if err != nil {
+		fmt.Printf("Unable to compact journal: %q\n", err)
+	}
 }
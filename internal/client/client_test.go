@@ -0,0 +1,424 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+	"github.com/nicholasss/async-messages/internal/store"
+)
+
+// newTestClient creates a client that signs with an hmac key, journaling into a temporary directory
+func newTestClient(t *testing.T, serverURL, name, vessel string, key []byte) *Config {
+	t.Helper()
+
+	journal, _, err := store.Open(filepath.Join(t.TempDir(), name+"@"+vessel+".journal"), 0)
+	if err != nil {
+		t.Fatalf("Unable to open journal due to: %q", err)
+	}
+	t.Cleanup(func() { journal.Close() })
+
+	return &Config{
+		Signer:      msg.NewHMACSigner(key),
+		Outbox:      msg.NewQueue(),
+		Inbox:       msg.NewQueue(),
+		DeadLetters: msg.NewDeadLetterQueue(0),
+		Journal:     journal,
+		Name:        name,
+		Vessel:      vessel,
+		Server:      serverURL,
+		Online:      &safeBool{},
+	}
+}
+
+func TestJournalCompactsWhileRunning(t *testing.T) {
+	c := newTestClient(t, "", "Kevin", "Liberty", []byte("kevin's key"))
+	path := filepath.Join(t.TempDir(), "compacted.journal")
+	journal, _, err := store.Open(path, 0)
+	if err != nil {
+		t.Fatalf("Unable to open journal due to: %q", err)
+	}
+	c.Journal = journal
+
+	// a message that is being sent when the journal is compacted
+	err = c.WriteMessageIntoQueue("Bob", "Snow", "in flight", "still being sent")
+	if err != nil {
+		t.Fatalf("Unable to queue message due to: %q", err)
+	}
+	inFlight, ok := c.Outbox.Reserve()
+	if !ok {
+		t.Fatalf("Unable to reserve message")
+	}
+
+	for range compactAfter {
+		err = c.WriteMessageIntoQueue("Bob", "Snow", "sent", "accepted by the server")
+		if err != nil {
+			t.Fatalf("Unable to queue message due to: %q", err)
+		}
+		lease, ok := c.Outbox.Reserve()
+		if !ok {
+			t.Fatalf("Unable to reserve message")
+		}
+		err = c.commitReserved(lease)
+		if err != nil {
+			t.Fatalf("Unable to commit message due to: %q", err)
+		}
+	}
+
+	if garbage := c.Journal.Garbage(); garbage != 0 {
+		t.Errorf("Expected the journal to be compacted. garbage=%d", garbage)
+	}
+
+	// the compacted journal only holds the message still being sent
+	c.Journal.Close()
+	journal, boxes, err := store.Open(path, 0)
+	if err != nil {
+		t.Fatalf("Unable to reopen journal due to: %q", err)
+	}
+	defer journal.Close()
+	if len(boxes[outboxName]) != 1 || boxes[outboxName][0].ID != inFlight.Message.ID {
+		t.Errorf("Expected only the in flight message in the outbox. got=%d messages", len(boxes[outboxName]))
+	}
+}
+
+func TestRedeliveredMessageIsNotDuplicated(t *testing.T) {
+	rawMsg := msg.RawMessage{
+		ToName:     "Kevin",
+		ToVessel:   "Liberty",
+		FromName:   "Bob",
+		FromVessel: "Snow",
+		Subject:    "Tuesday",
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+	}
+	pkgMsg, err := rawMsg.ToPackagedMessage([]byte("bob's key"))
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+
+	// the first acknowledgement is lost, so the message is delivered again
+	acks := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/get-messages":
+			json.NewEncoder(w).Encode([]msg.Delivery{{Lease: uint64(acks + 1), Message: *pkgMsg}})
+		case "/ack-messages":
+			acks++
+			if acks == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	for range 2 {
+		_, err = c.getMessagesFromServer(context.Background(), 0)
+		if err != nil && acks != 1 {
+			t.Fatalf("Unable to get messages due to: %q", err)
+		}
+	}
+
+	if acks != 2 {
+		t.Errorf("Expected both deliveries to be acknowledged. got=%d", acks)
+	}
+	if size := c.Inbox.Size(); size != 1 {
+		t.Errorf("Expected the message to be in the inbox once. size=%d", size)
+	}
+}
+
+func TestLongPollWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{name: "default timeout", timeout: 0, want: longPollWait},
+		{name: "short timeout", timeout: 10 * time.Second, want: 10*time.Second - longPollMargin},
+		{name: "too short to wait", timeout: 3 * time.Second, want: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Config{RequestTimeout: tc.timeout}
+			if got := c.longPollWait(); got != tc.want {
+				t.Errorf("wait mismatch. got=%s want=%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStopCancelsLongPoll(t *testing.T) {
+	// holds requests for messages open for as long as they ask, or until the client goes
+	waits := make(chan string, 10)
+	cancelled := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			json.NewEncoder(w).Encode(HealthCheck{Health: "OK"})
+		case "/get-messages":
+			rawWait := r.URL.Query().Get("wait")
+			waits <- rawWait
+			wait, _ := time.ParseDuration(rawWait)
+			select {
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+			case <-time.After(wait):
+				json.NewEncoder(w).Encode([]msg.Delivery{})
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	c.RequestTimeout = 10 * time.Second
+	c.LongPoll = true
+
+	err := c.StartClient(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start client due to: %q", err)
+	}
+	select {
+	case wait := <-waits:
+		if wait != c.longPollWait().String() {
+			t.Errorf("wait mismatch. got=%q want=%q", wait, c.longPollWait().String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the client to long poll for messages")
+	}
+
+	// stopping does not wait out the long poll
+	started := time.Now()
+	err = c.Stop(context.Background())
+	if err != nil {
+		t.Errorf("Did not expect error stopping: got=%q", err)
+	}
+	if stopped := time.Since(started); stopped > 2*time.Second {
+		t.Errorf("Expected stopping to cut the long poll short. took=%s", stopped)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the server to see the long poll cancelled")
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	// the server accepts every message sent to it
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/send-message" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	t.Chdir(dir)
+	err := os.WriteFile(".env", nil, 0o600)
+	if err != nil {
+		t.Fatalf("Unable to write .env due to: %q", err)
+	}
+	t.Setenv("SIGNING_KEY", "kevin's key")
+	t.Setenv("CLIENT_DATA_DIR", filepath.Join(dir, "data"))
+
+	c, err := NewClientConfig("Kevin", "Liberty")
+	if err != nil {
+		t.Fatalf("Unable to create client due to: %q", err)
+	}
+	c.Server = server.URL
+	c.Online.setValue(true)
+
+	for _, subject := range []string{"sent", "in flight", "waiting"} {
+		err = c.WriteMessageIntoQueue("Bob", "Snow", subject, "the weather is clearing")
+		if err != nil {
+			t.Fatalf("Unable to queue message due to: %q", err)
+		}
+	}
+	queued := c.Outbox.Messages()
+
+	// only the message the server confirmed is removed
+	err = c.SendOneFromQueue(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to send message due to: %q", err)
+	}
+	_, ok := c.Outbox.Reserve()
+	if !ok {
+		t.Fatalf("Unable to reserve message")
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatalf("Unable to close client due to: %q", err)
+	}
+
+	c, err = NewClientConfig("Kevin", "Liberty")
+	if err != nil {
+		t.Fatalf("Unable to reopen client due to: %q", err)
+	}
+	defer c.Close()
+
+	restored := c.Outbox.Messages()
+	if len(restored) != 2 {
+		t.Fatalf("Expected the unsent messages to be restored. got=%d", len(restored))
+	}
+	for i, pkgMsg := range restored {
+		if pkgMsg.ID != queued[i+1].ID {
+			t.Errorf("message %d mismatch. got=%s want=%s", i, pkgMsg.Subject, queued[i+1].Subject)
+		}
+	}
+}
+
+func TestStartClientSendsInBackground(t *testing.T) {
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	sendServer := &testSendServer{status: func(pkgMsg msg.PackagedMessage) (int, int) {
+		if pkgMsg.Subject == "slow" {
+			close(sending)
+			<-release
+		}
+		return http.StatusOK, 0
+	}}
+	server := httptest.NewServer(sendServer)
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	c.LongPoll = true
+
+	// returns straight away, leaving the sync engine running
+	err := c.StartClient(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start client due to: %q", err)
+	}
+	err = c.StartClient(context.Background())
+	if !errors.Is(err, ErrClientRunning) {
+		t.Errorf("Expected starting twice to fail. got=%v", err)
+	}
+
+	// messages written while running are sent without being asked to
+	err = c.WriteMessageIntoQueue("Bob", "Snow", "first", "sent in the background")
+	if err != nil {
+		t.Fatalf("Unable to queue message due to: %q", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for sendServer.sentCount("first") == 0 || c.Outbox.Size() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the message to be sent. outbox=%d", c.Outbox.Size())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stop waits for the send in progress to finish
+	err = c.WriteMessageIntoQueue("Bob", "Snow", "slow", "still being sent")
+	if err != nil {
+		t.Fatalf("Unable to queue message due to: %q", err)
+	}
+	select {
+	case <-sending:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the slow message to be sent")
+	}
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- c.Stop(context.Background())
+	}()
+	select {
+	case <-stopped:
+		t.Fatalf("Expected Stop to wait for the send in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	err = <-stopped
+	if err != nil {
+		t.Fatalf("Unable to stop client due to: %q", err)
+	}
+	if size := c.Outbox.Size(); size != 0 {
+		t.Errorf("Expected the finished send to be committed. size=%d", size)
+	}
+}
+
+func TestSendIsBoundedByContext(t *testing.T) {
+	// a hung link, that never answers
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	tests := []struct {
+		name           string
+		requestTimeout time.Duration
+		newCtx         func() (context.Context, context.CancelFunc)
+		wantErr        error
+	}{
+		{
+			name:           "deadline",
+			requestTimeout: time.Minute,
+			newCtx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 100*time.Millisecond)
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name:           "request timeout",
+			requestTimeout: 100 * time.Millisecond,
+			newCtx: func() (context.Context, context.CancelFunc) {
+				return context.Background(), func() {}
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+		{
+			name:           "cancelled",
+			requestTimeout: time.Minute,
+			newCtx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(100*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			wantErr: context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+			c.RequestTimeout = tt.requestTimeout
+			c.Online.setValue(true)
+			err := c.WriteMessageIntoQueue("Bob", "Snow", "Tuesday", "the link is down")
+			if err != nil {
+				t.Fatalf("Unable to queue message due to: %q", err)
+			}
+
+			ctx, cancel := tt.newCtx()
+			defer cancel()
+			started := time.Now()
+			err = c.SendOneFromQueue(ctx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected %q. got=%v", tt.wantErr, err)
+			}
+			if elapsed := time.Since(started); elapsed > 2*time.Second {
+				t.Errorf("Expected the send to give up promptly. took=%s", elapsed)
+			}
+
+			// the message is kept to be sent again
+			if size := c.Outbox.Size(); size != 1 {
+				t.Errorf("Expected the message to stay in the outbox. size=%d", size)
+			}
+			// giving up is not the server going offline
+			if tt.wantErr == context.Canceled && !c.Online.getValue() {
+				t.Errorf("Expected a cancelled send to leave the server online")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// defaultCompressMinBytes is how large a request body must be before it is compressed when
+// 'COMPRESS_MIN_BYTES' is not set, smaller bodies grow from the framing of the encoding
+const defaultCompressMinBytes = 1024
+
+// acceptEncoding is sent with every request, setting it means responses are decoded here rather than by net/http
+const acceptEncoding = "gzip, deflate"
+
+// *** Internal Types ***
+
+// decodedBody reads the decoded contents of a response body, closing the body once done
+type decodedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+// *** Functions ***
+
+func (d *decodedBody) Close() error {
+	return d.body.Close()
+}
+
+// encodeBody compresses a request body with gzip when the server has said it can decode it,
+// and the body is large enough to be worth it. Returns the encoding, "" when left as is.
+func (c *Config) encodeBody(body []byte) ([]byte, string, error) {
+	minBytes := c.CompressMinBytes
+	if minBytes == 0 {
+		minBytes = defaultCompressMinBytes
+	}
+	if minBytes < 0 || len(body) < minBytes || !c.serverGzip.Load() {
+		return body, "", nil
+	}
+
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	_, err := gzipWriter.Write(body)
+	if err != nil {
+		return nil, "", err
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// some bodies do not compress, those are sent as they are
+	if compressed.Len() >= len(body) {
+		return body, "", nil
+	}
+	return compressed.Bytes(), "gzip", nil
+}
+
+// decodeResponse replaces a compressed response body with its decoded contents
+func decodeResponse(res *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+
+	var decoded io.Reader
+	var err error
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		decoded, err = gzip.NewReader(res.Body)
+	case "deflate":
+		// http calls the zlib format deflate
+		decoded, err = zlib.NewReader(res.Body)
+	default:
+		return fmt.Errorf("response has unknown content encoding %q", encoding)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s response: %w", encoding, err)
+	}
+
+	res.Body = &decodedBody{Reader: decoded, body: res.Body}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return nil
+}
+
+// acceptsGzip reports whether an Accept-Encoding header sent by the server lists gzip
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		return strings.TrimSpace(params) != "q=0"
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestEncodeBody(t *testing.T) {
+	compressible := []byte(strings.Repeat("a", defaultCompressMinBytes))
+	// random bytes grow when compressed
+	incompressible := make([]byte, 4*defaultCompressMinBytes)
+	random := rand.NewChaCha8([32]byte{})
+	random.Read(incompressible)
+
+	tests := []struct {
+		name         string
+		body         []byte
+		minBytes     int
+		serverGzip   bool
+		wantEncoding string
+	}{
+		{"compressed", compressible, 0, true, "gzip"},
+		{"server cannot decode", compressible, 0, false, ""},
+		{"below threshold", compressible[1:], 0, true, ""},
+		{"lower threshold", compressible[1:], 16, true, "gzip"},
+		{"disabled", compressible, -1, true, ""},
+		{"incompressible", incompressible, 0, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{CompressMinBytes: tt.minBytes}
+			c.serverGzip.Store(tt.serverGzip)
+
+			encoded, encoding, err := c.encodeBody(tt.body)
+			if err != nil {
+				t.Fatalf("Unable to encode body due to: %q", err)
+			}
+			if encoding != tt.wantEncoding {
+				t.Fatalf("Encoding mismatch. got=%q want=%q", encoding, tt.wantEncoding)
+			}
+			if encoding == "" {
+				if !bytes.Equal(encoded, tt.body) {
+					t.Errorf("Expected the body to be sent as is")
+				}
+				return
+			}
+
+			reader, err := gzip.NewReader(bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("Unable to read gzip body due to: %q", err)
+			}
+			decoded, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("Unable to decode body due to: %q", err)
+			}
+			if !bytes.Equal(decoded, tt.body) {
+				t.Errorf("Decoded body does not match the original")
+			}
+		})
+	}
+}
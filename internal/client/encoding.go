@@ -0,0 +1,70 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// jsonContentType is the media type messages are sent as when the server does not take the binary encoding
+const jsonContentType = "application/json"
+
+// acceptDeliveries is sent when getting messages, preferring the binary encoding.
+// Servers that do not know it respond with JSON.
+const acceptDeliveries = msg.BinaryContentType + ", " + jsonContentType
+
+// *** Functions ***
+
+// encodeMessage encodes a message in the binary encoding when the server has said it takes it,
+// otherwise as JSON. Returns the data and its content type.
+func (c *Config) encodeMessage(pkgMsg *msg.PackagedMessage) ([]byte, string, error) {
+	if c.serverBinary.Load() {
+		data, err := pkgMsg.MarshalBinary()
+		return data, msg.BinaryContentType, err
+	}
+
+	data, err := json.Marshal(pkgMsg)
+	return data, jsonContentType, err
+}
+
+// encodeBatch encodes a batch of messages the same way as encodeMessage
+func (c *Config) encodeBatch(messages []msg.PackagedMessage) ([]byte, string, error) {
+	if c.serverBinary.Load() {
+		data, err := msg.MarshalMessagesBinary(messages)
+		return data, msg.BinaryContentType, err
+	}
+
+	data, err := json.Marshal(messages)
+	return data, jsonContentType, err
+}
+
+// decodeDeliveries decodes the deliveries in a response, in whichever encoding the server chose
+func decodeDeliveries(res *http.Response) ([]msg.Delivery, error) {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType != msg.BinaryContentType {
+		var deliveries []msg.Delivery
+		err := json.NewDecoder(res.Body).Decode(&deliveries)
+		return deliveries, err
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return msg.UnmarshalDeliveriesBinary(data)
+}
+
+// acceptsBinary reports whether an Accept-Post header sent by the server lists the binary encoding
+func acceptsBinary(acceptPost string) bool {
+	for _, part := range strings.Split(acceptPost, ",") {
+		mediaType, _, err := mime.ParseMediaType(part)
+		if err == nil && mediaType == msg.BinaryContentType {
+			return true
+		}
+	}
+	return false
+}
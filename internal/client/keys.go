@@ -0,0 +1,426 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// *** Internal Types ***
+
+// recipientKeysFile is a json file of recipient keys, such as:
+//
+//	{"keys": [
+//		{"recipient": {"name": "Bob", "vessel": "Snow"}, "encryptionKey": "<base64>"}
+//	]}
+type recipientKeysFile struct {
+	Keys []msg.RecipientKey `json:"keys"`
+}
+
+// senderKeysFile is a json file of the public keys senders sign with, such as:
+//
+//	{"keys": [
+//		{"sender": {"name": "Bob", "vessel": "Snow"}, "publicKey": "<base64>"}
+//	]}
+type senderKeysFile struct {
+	Keys []msg.SenderKey `json:"keys"`
+}
+
+// senderKeyring holds the public key of a single sender, to verify their messages with.
+// The client never knows the hmac secrets of other users.
+type senderKeyring struct {
+	sender    msg.UserVessel
+	publicKey ed25519.PublicKey
+}
+
+// *** Functions ***
+
+// loadRecipientKeys reads the public keys of recipients from a json file
+func loadRecipientKeys(path string) (map[msg.UserVessel]*ecdh.PublicKey, error) {
+	keysData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keysFile recipientKeysFile
+	err = json.Unmarshal(keysData, &keysFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse keys file: %w", err)
+	}
+
+	keys := make(map[msg.UserVessel]*ecdh.PublicKey, len(keysFile.Keys))
+	for i, entry := range keysFile.Keys {
+		key, err := msg.ParsePublicEncryptionKey(entry.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("key entry %d for %s: %w", i, entry.Recipient.String(), err)
+		}
+		keys[entry.Recipient] = key
+	}
+	return keys, nil
+}
+
+// saveRecipientKeys writes the public keys of recipients to a json file, replacing it whole
+func saveRecipientKeys(path string, keys map[msg.UserVessel]*ecdh.PublicKey) error {
+	var keysFile recipientKeysFile
+	for recipient, key := range keys {
+		keysFile.Keys = append(keysFile.Keys, msg.RecipientKey{
+			Recipient:     recipient,
+			EncryptionKey: msg.EncodeEncryptionKey(key),
+		})
+	}
+	sort.Slice(keysFile.Keys, func(i, j int) bool {
+		return keysFile.Keys[i].Recipient.String() < keysFile.Keys[j].Recipient.String()
+	})
+
+	return writeKeysFile(path, keysFile)
+}
+
+// loadSenderKeys reads the public keys of senders from a json file
+func loadSenderKeys(path string) (map[msg.UserVessel]ed25519.PublicKey, error) {
+	keysData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keysFile senderKeysFile
+	err = json.Unmarshal(keysData, &keysFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse keys file: %w", err)
+	}
+
+	keys := make(map[msg.UserVessel]ed25519.PublicKey, len(keysFile.Keys))
+	for i, entry := range keysFile.Keys {
+		key, err := msg.ParsePublicKey(entry.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("key entry %d for %s: %w", i, entry.Sender.String(), err)
+		}
+		keys[entry.Sender] = key
+	}
+	return keys, nil
+}
+
+// saveSenderKeys writes the public keys of senders to a json file, replacing it whole
+func saveSenderKeys(path string, keys map[msg.UserVessel]ed25519.PublicKey) error {
+	var keysFile senderKeysFile
+	for sender, key := range keys {
+		keysFile.Keys = append(keysFile.Keys, msg.SenderKey{
+			Sender:    sender,
+			PublicKey: msg.EncodePublicKey(key),
+		})
+	}
+	sort.Slice(keysFile.Keys, func(i, j int) bool {
+		return keysFile.Keys[i].Sender.String() < keysFile.Keys[j].Sender.String()
+	})
+
+	return writeKeysFile(path, keysFile)
+}
+
+// writeKeysFile writes a keys file as indented json, replacing it whole
+func writeKeysFile(path string, keysFile any) error {
+	keysData, err := json.MarshalIndent(keysFile, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, keysData, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// recipientKey returns the public key to encrypt messages to the recipient for.
+// Pinned keys are used as they are. Otherwise the server is asked once while running,
+// and a key that differs from the one it served before is refused until it is forgotten.
+// When the server cannot be asked the key it served before is used.
+func (c *Config) recipientKey(ctx context.Context, recipient msg.UserVessel) (*ecdh.PublicKey, error) {
+	c.recipientMux.Lock()
+	key, pinned := c.PinnedKeys[recipient]
+	if !pinned {
+		key, pinned = c.checkedKeys[recipient]
+	}
+	knownKey, known := c.knownKeys[recipient]
+	c.recipientMux.Unlock()
+	if pinned {
+		return key, nil
+	}
+
+	servedKey, err := c.fetchRecipientKey(ctx, recipient)
+	if err != nil && known {
+		return knownKey, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if known && !knownKey.Equal(servedKey) {
+		fmt.Printf("WARNING: the server served a different encryption key for %s than before. "+
+			"Messages will not be sealed for them until the new key is checked and pinned, or the old one is forgotten.\n", recipient.String())
+		return nil, fmt.Errorf("%w: %s", ErrEncryptionKeyChanged, recipient.String())
+	}
+
+	c.recipientMux.Lock()
+	defer c.recipientMux.Unlock()
+	if c.checkedKeys == nil {
+		c.checkedKeys = make(map[msg.UserVessel]*ecdh.PublicKey)
+	}
+	c.checkedKeys[recipient] = servedKey
+	if known {
+		return servedKey, nil
+	}
+
+	if c.knownKeys == nil {
+		c.knownKeys = make(map[msg.UserVessel]*ecdh.PublicKey)
+	}
+	c.knownKeys[recipient] = servedKey
+	if c.KnownKeysPath != "" {
+		err = saveRecipientKeys(c.KnownKeysPath, c.knownKeys)
+		if err != nil {
+			fmt.Printf("Unable to save known keys due to: %q\n", err)
+		}
+	}
+	return servedKey, nil
+}
+
+// ForgetRecipientKey forgets the key the server served for the recipient,
+// so that the next key it serves is trusted in its place
+func (c *Config) ForgetRecipientKey(recipient msg.UserVessel) error {
+	c.recipientMux.Lock()
+	defer c.recipientMux.Unlock()
+
+	delete(c.checkedKeys, recipient)
+	if _, ok := c.knownKeys[recipient]; !ok {
+		return nil
+	}
+	delete(c.knownKeys, recipient)
+	if c.KnownKeysPath == "" {
+		return nil
+	}
+	return saveRecipientKeys(c.KnownKeysPath, c.knownKeys)
+}
+
+// fetchRecipientKey asks the server for the public key of the recipient
+func (c *Config) fetchRecipientKey(ctx context.Context, recipient msg.UserVessel) (*ecdh.PublicKey, error) {
+	query := url.Values{}
+	query.Set("name", recipient.Name)
+	query.Set("vessel", recipient.Vessel)
+
+	req, cancel, err := c.newRequest(ctx, http.MethodGet, "/encryption-key?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// check return status
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrNoEncryptionKey, recipient.String())
+	}
+	statusErr := checkStatus(res, "get encryption key")
+	if statusErr != nil {
+		return nil, statusErr
+	}
+
+	var recipientKey msg.RecipientKey
+	err = json.NewDecoder(res.Body).Decode(&recipientKey)
+	if err != nil {
+		return nil, err
+	}
+	if recipientKey.Recipient != recipient {
+		return nil, fmt.Errorf("server returned the encryption key of %s, not %s", recipientKey.Recipient.String(), recipient.String())
+	}
+	return msg.ParsePublicEncryptionKey(recipientKey.EncryptionKey)
+}
+
+// senderKey returns the public key that messages from the sender are verified with.
+// Pinned keys are used as they are. Otherwise the server is asked once while running,
+// and a key that differs from the one it served before is refused until it is forgotten.
+// When the server cannot be asked the key it served before is used.
+func (c *Config) senderKey(ctx context.Context, sender msg.UserVessel) (ed25519.PublicKey, error) {
+	c.senderMux.Lock()
+	key, pinned := c.PinnedSenderKeys[sender]
+	if !pinned {
+		key, pinned = c.checkedSenderKeys[sender]
+	}
+	knownKey, known := c.knownSenderKeys[sender]
+	c.senderMux.Unlock()
+	if pinned {
+		return key, nil
+	}
+
+	servedKey, err := c.fetchSenderKey(ctx, sender)
+	if err != nil && known && !errors.Is(err, ErrNoPublicKey) {
+		return knownKey, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if known && !knownKey.Equal(servedKey) {
+		fmt.Printf("WARNING: the server served a different public key for %s than before. "+
+			"Messages from them will not be trusted until the new key is checked and pinned, or the old one is forgotten.\n", sender.String())
+		return nil, fmt.Errorf("%w: %s", ErrPublicKeyChanged, sender.String())
+	}
+
+	c.senderMux.Lock()
+	defer c.senderMux.Unlock()
+	if c.checkedSenderKeys == nil {
+		c.checkedSenderKeys = make(map[msg.UserVessel]ed25519.PublicKey)
+	}
+	c.checkedSenderKeys[sender] = servedKey
+	if known {
+		return servedKey, nil
+	}
+
+	if c.knownSenderKeys == nil {
+		c.knownSenderKeys = make(map[msg.UserVessel]ed25519.PublicKey)
+	}
+	c.knownSenderKeys[sender] = servedKey
+	if c.KnownSenderKeysPath != "" {
+		err = saveSenderKeys(c.KnownSenderKeysPath, c.knownSenderKeys)
+		if err != nil {
+			fmt.Printf("Unable to save known sender keys due to: %q\n", err)
+		}
+	}
+	return servedKey, nil
+}
+
+// localSenderKey returns the public key of the sender when it is pinned or was served before,
+// without asking the server
+func (c *Config) localSenderKey(sender msg.UserVessel) (ed25519.PublicKey, bool) {
+	c.senderMux.Lock()
+	defer c.senderMux.Unlock()
+
+	if key, ok := c.PinnedSenderKeys[sender]; ok {
+		return key, true
+	}
+	if key, ok := c.checkedSenderKeys[sender]; ok {
+		return key, true
+	}
+	key, ok := c.knownSenderKeys[sender]
+	return key, ok
+}
+
+// ForgetSenderKey forgets the public key the server served for the sender,
+// so that the next key it serves is trusted in its place
+func (c *Config) ForgetSenderKey(sender msg.UserVessel) error {
+	c.senderMux.Lock()
+	defer c.senderMux.Unlock()
+
+	delete(c.checkedSenderKeys, sender)
+	if _, ok := c.knownSenderKeys[sender]; !ok {
+		return nil
+	}
+	delete(c.knownSenderKeys, sender)
+	if c.KnownSenderKeysPath == "" {
+		return nil
+	}
+	return saveSenderKeys(c.KnownSenderKeysPath, c.knownSenderKeys)
+}
+
+// fetchSenderKey asks the server for the public key of the sender
+func (c *Config) fetchSenderKey(ctx context.Context, sender msg.UserVessel) (ed25519.PublicKey, error) {
+	query := url.Values{}
+	query.Set("name", sender.Name)
+	query.Set("vessel", sender.Vessel)
+
+	req, cancel, err := c.newRequest(ctx, http.MethodGet, "/public-key?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// check return status
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrNoPublicKey, sender.String())
+	}
+	statusErr := checkStatus(res, "get public key")
+	if statusErr != nil {
+		return nil, statusErr
+	}
+
+	var senderKey msg.SenderKey
+	err = json.NewDecoder(res.Body).Decode(&senderKey)
+	if err != nil {
+		return nil, err
+	}
+	if senderKey.Sender != sender {
+		return nil, fmt.Errorf("server returned the public key of %s, not %s", senderKey.Sender.String(), sender.String())
+	}
+	return msg.ParsePublicKey(senderKey.PublicKey)
+}
+
+// verifyDelivery checks that a delivered message was signed by its sender, returning the keyring it
+// was verified with. Messages signed with a public key are verified with the key of the sender. hmac
+// secrets are only held by the server, so messages signed with one are taken on its word, unless the
+// sender is known to have a public key or the message is encrypted.
+// Returns an error wrapping ErrForgedMessage when the message is not signed by its sender.
+func (c *Config) verifyDelivery(ctx context.Context, pkgMsg *msg.PackagedMessage) (msg.Keyring, error) {
+	keys := senderKeyring{sender: pkgMsg.From}
+	switch pkgMsg.Algorithm {
+	case "", msg.AlgorithmHMACSHA256:
+		// the server could have sealed it for us in place of the sender
+		if pkgMsg.IsEncrypted() {
+			return nil, fmt.Errorf("%w: message %s: %w", ErrForgedMessage, pkgMsg.ID, msg.ErrSealedWithSecret)
+		}
+		// asking the server would not help, as it could leave out the key of a sender it signs as
+		var known bool
+		keys.publicKey, known = c.localSenderKey(pkgMsg.From)
+		if !known {
+			return keys, nil
+		}
+
+	default:
+		var err error
+		keys.publicKey, err = c.senderKey(ctx, pkgMsg.From)
+		if errors.Is(err, ErrNoPublicKey) || errors.Is(err, ErrPublicKeyChanged) {
+			return nil, fmt.Errorf("%w: message %s: %w", ErrForgedMessage, pkgMsg.ID, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := pkgMsg.VerifyMessageWith(keys)
+	if err != nil {
+		return nil, fmt.Errorf("%w: message %s: %w", ErrForgedMessage, pkgMsg.ID, err)
+	}
+	return keys, nil
+}
+
+func (k senderKeyring) SigningKey(uv msg.UserVessel) ([]byte, error) {
+	return nil, fmt.Errorf("%w: %s", msg.ErrUnknownSigner, uv.String())
+}
+
+func (k senderKeyring) PublicKey(uv msg.UserVessel) (ed25519.PublicKey, error) {
+	if uv != k.sender || k.publicKey == nil {
+		return nil, fmt.Errorf("%w: %s", msg.ErrUnknownSigner, uv.String())
+	}
+	return k.publicKey, nil
+}
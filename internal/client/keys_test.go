@@ -0,0 +1,354 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// newKeyServer serves the key in served as the encryption key of every recipient, counting requests
+func newKeyServer(t *testing.T, served *atomic.Pointer[ecdh.PublicKey], requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		recipient := msg.UserVessel{Name: r.URL.Query().Get("name"), Vessel: r.URL.Query().Get("vessel")}
+		json.NewEncoder(w).Encode(msg.RecipientKey{
+			Recipient:     recipient,
+			EncryptionKey: msg.EncodeEncryptionKey(served.Load()),
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newPublicKey(t *testing.T) *ecdh.PublicKey {
+	t.Helper()
+
+	privateKey, err := msg.NewEncryptionKey()
+	if err != nil {
+		t.Fatalf("Unable to create encryption key due to: %q", err)
+	}
+	return privateKey.PublicKey()
+}
+
+func TestRecipientKeyChangeIsRefused(t *testing.T) {
+	bob := msg.UserVessel{Name: "Bob", Vessel: "Snow"}
+	firstKey := newPublicKey(t)
+	var served atomic.Pointer[ecdh.PublicKey]
+	served.Store(firstKey)
+	var requests atomic.Int32
+	server := newKeyServer(t, &served, &requests)
+
+	knownKeysPath := filepath.Join(t.TempDir(), "Kevin@Liberty.keys")
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	c.KnownKeysPath = knownKeysPath
+
+	// the first key served is trusted, and only asked for once while running
+	for range 2 {
+		key, err := c.recipientKey(context.Background(), bob)
+		if err != nil {
+			t.Fatalf("Unable to get recipient key due to: %q", err)
+		}
+		if !key.Equal(firstKey) {
+			t.Errorf("Expected the served key")
+		}
+	}
+	if requests.Load() != 1 {
+		t.Errorf("Expected the server to be asked once. got=%d", requests.Load())
+	}
+
+	// a later run is served a different key
+	served.Store(newPublicKey(t))
+	knownKeys, err := loadRecipientKeys(knownKeysPath)
+	if err != nil {
+		t.Fatalf("Unable to load known keys due to: %q", err)
+	}
+	c = newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	c.KnownKeysPath = knownKeysPath
+	c.knownKeys = knownKeys
+
+	_, err = c.recipientKey(context.Background(), bob)
+	if !errors.Is(err, ErrEncryptionKeyChanged) {
+		t.Errorf("Expected ErrEncryptionKeyChanged, but got %v", err)
+	}
+	err = c.WriteNewMessageIntoQueue(context.Background(), NewMessage{ToName: bob.Name, ToVessel: bob.Vessel, Subject: "Tuesday", Body: "proceeding", Seal: true})
+	if !errors.Is(err, ErrEncryptionKeyChanged) {
+		t.Errorf("Expected ErrEncryptionKeyChanged, but got %v", err)
+	}
+
+	// once forgotten the new key is trusted in its place
+	err = c.ForgetRecipientKey(bob)
+	if err != nil {
+		t.Fatalf("Unable to forget key due to: %q", err)
+	}
+	key, err := c.recipientKey(context.Background(), bob)
+	if err != nil {
+		t.Fatalf("Unable to get recipient key due to: %q", err)
+	}
+	if !key.Equal(served.Load()) {
+		t.Errorf("Expected the new key after forgetting the old one")
+	}
+}
+
+func TestPinnedRecipientKey(t *testing.T) {
+	bob := msg.UserVessel{Name: "Bob", Vessel: "Snow"}
+	pinnedKey := newPublicKey(t)
+	var served atomic.Pointer[ecdh.PublicKey]
+	served.Store(newPublicKey(t))
+	var requests atomic.Int32
+	server := newKeyServer(t, &served, &requests)
+
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	c.PinnedKeys = map[msg.UserVessel]*ecdh.PublicKey{bob: pinnedKey}
+
+	key, err := c.recipientKey(context.Background(), bob)
+	if err != nil {
+		t.Fatalf("Unable to get recipient key due to: %q", err)
+	}
+	if !key.Equal(pinnedKey) {
+		t.Errorf("Expected the pinned key rather than the served one")
+	}
+	if requests.Load() != 0 {
+		t.Errorf("Expected the server to not be asked for a pinned key. got=%d", requests.Load())
+	}
+}
+
+func TestKnownRecipientKeyUsedWhileOffline(t *testing.T) {
+	bob := msg.UserVessel{Name: "Bob", Vessel: "Snow"}
+	knownKey := newPublicKey(t)
+
+	// nothing is listening here
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	c.knownKeys = map[msg.UserVessel]*ecdh.PublicKey{bob: knownKey}
+
+	key, err := c.recipientKey(context.Background(), bob)
+	if err != nil {
+		t.Fatalf("Unable to get recipient key due to: %q", err)
+	}
+	if !key.Equal(knownKey) {
+		t.Errorf("Expected the known key while the server is offline")
+	}
+}
+
+// newSenderKeyServer serves the public keys of senders, and not found for anyone else
+func newSenderKeyServer(t *testing.T, keys map[msg.UserVessel]ed25519.PublicKey) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sender := msg.UserVessel{Name: r.URL.Query().Get("name"), Vessel: r.URL.Query().Get("vessel")}
+		key, ok := keys[sender]
+		if r.URL.Path != "/public-key" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(msg.SenderKey{
+			Sender:    sender,
+			PublicKey: msg.EncodePublicKey(key),
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newEd25519Signer(t *testing.T, seed string) msg.Signer {
+	t.Helper()
+
+	signer, err := msg.NewEd25519Signer(ed25519.NewKeyFromSeed([]byte(seed)))
+	if err != nil {
+		t.Fatalf("Unable to create signer due to: %q", err)
+	}
+	return signer
+}
+
+func TestDeliveriesAreVerified(t *testing.T) {
+	bob := msg.UserVessel{Name: "Bob", Vessel: "Snow"}
+	alice := msg.UserVessel{Name: "Alice", Vessel: "Snow"}
+	bobSigner := newEd25519Signer(t, "0123456789abcdef0123456789abcdef")
+	bobKey := ed25519.NewKeyFromSeed([]byte("0123456789abcdef0123456789abcdef")).Public().(ed25519.PublicKey)
+	otherSigner := newEd25519Signer(t, "fedcba9876543210fedcba9876543210")
+	// alice signs with an hmac secret, so the server has no public key for her
+	server := newSenderKeyServer(t, map[msg.UserVessel]ed25519.PublicKey{bob: bobKey})
+
+	tests := []struct {
+		name      string
+		from      msg.UserVessel
+		signer    msg.Signer
+		pinned    bool
+		wantInbox bool
+	}{
+		{"signed by the sender", bob, bobSigner, false, true},
+		{"signed by the pinned key", bob, bobSigner, true, true},
+		{"signed by someone else", bob, otherSigner, false, false},
+		{"hmac from a sender with a public key", bob, msg.NewHMACSigner([]byte("bob's key")), true, false},
+		{"hmac from a sender without a public key", alice, msg.NewHMACSigner([]byte("alice's key")), false, true},
+		{"signed without a public key", alice, otherSigner, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+			if tt.pinned {
+				c.PinnedSenderKeys = map[msg.UserVessel]ed25519.PublicKey{bob: bobKey}
+			}
+
+			rawMsg := msg.RawMessage{
+				ToName:     "Kevin",
+				ToVessel:   "Liberty",
+				FromName:   tt.from.Name,
+				FromVessel: tt.from.Vessel,
+				Subject:    "Tuesday",
+				Body:       "proceeding",
+			}
+			pkgMsg, err := rawMsg.ToPackagedMessageWith(tt.signer)
+			if err != nil {
+				t.Fatalf("Unable to package message due to: %q", err)
+			}
+
+			// either way the delivery is dealt with, so it is acknowledged
+			err = c.putInInbox(context.Background(), msg.Delivery{Lease: 1, Message: *pkgMsg})
+			if err != nil {
+				t.Fatalf("Unable to put delivery into inbox due to: %q", err)
+			}
+
+			_, deadLettered := c.DeadLetters.Get(pkgMsg.ID)
+			if tt.wantInbox && (c.Inbox.Size() != 1 || deadLettered) {
+				t.Errorf("Expected the message in the inbox. got=%d messages, dead lettered=%t", c.Inbox.Size(), deadLettered)
+			}
+			if !tt.wantInbox && (c.Inbox.Size() != 0 || !deadLettered) {
+				t.Errorf("Expected the message to be dead lettered. got=%d messages, dead lettered=%t", c.Inbox.Size(), deadLettered)
+			}
+		})
+	}
+}
+
+func TestSenderKeyChangeIsRefused(t *testing.T) {
+	bob := msg.UserVessel{Name: "Bob", Vessel: "Snow"}
+	bobSigner := newEd25519Signer(t, "0123456789abcdef0123456789abcdef")
+	bobKey := ed25519.NewKeyFromSeed([]byte("0123456789abcdef0123456789abcdef")).Public().(ed25519.PublicKey)
+	serverKey := ed25519.NewKeyFromSeed([]byte("fedcba9876543210fedcba9876543210")).Public().(ed25519.PublicKey)
+
+	// the server swaps in a key of its own for a sender who was seen before
+	server := newSenderKeyServer(t, map[msg.UserVessel]ed25519.PublicKey{bob: serverKey})
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	c.KnownSenderKeysPath = filepath.Join(t.TempDir(), "Kevin@Liberty.senders")
+	c.knownSenderKeys = map[msg.UserVessel]ed25519.PublicKey{bob: bobKey}
+
+	_, err := c.senderKey(context.Background(), bob)
+	if !errors.Is(err, ErrPublicKeyChanged) {
+		t.Errorf("Expected ErrPublicKeyChanged, but got %v", err)
+	}
+
+	rawMsg := msg.RawMessage{ToName: "Kevin", ToVessel: "Liberty", FromName: bob.Name, FromVessel: bob.Vessel, Subject: "Tuesday", Body: "proceeding"}
+	pkgMsg, err := rawMsg.ToPackagedMessageWith(bobSigner)
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+	_, err = c.verifyDelivery(context.Background(), pkgMsg)
+	if !errors.Is(err, ErrForgedMessage) {
+		t.Errorf("Expected ErrForgedMessage, but got %v", err)
+	}
+
+	// once forgotten the new key is trusted in its place, and kept
+	err = c.ForgetSenderKey(bob)
+	if err != nil {
+		t.Fatalf("Unable to forget key due to: %q", err)
+	}
+	key, err := c.senderKey(context.Background(), bob)
+	if err != nil {
+		t.Fatalf("Unable to get sender key due to: %q", err)
+	}
+	if !key.Equal(serverKey) {
+		t.Errorf("Expected the new key after forgetting the old one")
+	}
+	knownKeys, err := loadSenderKeys(c.KnownSenderKeysPath)
+	if err != nil {
+		t.Fatalf("Unable to load known keys due to: %q", err)
+	}
+	if !knownKeys[bob].Equal(serverKey) {
+		t.Errorf("Expected the new key to be saved")
+	}
+}
+
+func TestSealedDeliveriesAreVerifiedBeforeOpening(t *testing.T) {
+	bob := msg.UserVessel{Name: "Bob", Vessel: "Snow"}
+	bobSigner := newEd25519Signer(t, "0123456789abcdef0123456789abcdef")
+	bobKey := ed25519.NewKeyFromSeed([]byte("0123456789abcdef0123456789abcdef")).Public().(ed25519.PublicKey)
+	server := newSenderKeyServer(t, map[msg.UserVessel]ed25519.PublicKey{bob: bobKey})
+
+	kevinKey, err := msg.NewEncryptionKey()
+	if err != nil {
+		t.Fatalf("Unable to create encryption key due to: %q", err)
+	}
+	rawMsg := msg.RawMessage{ToName: "Kevin", ToVessel: "Liberty", FromName: bob.Name, FromVessel: bob.Vessel, Subject: "Tuesday", Body: "proceeding"}
+	sealedMsg, err := rawMsg.ToSealedMessage(bobSigner, kevinKey.PublicKey(), true)
+	if err != nil {
+		t.Fatalf("Unable to seal message due to: %q", err)
+	}
+
+	// the server seals a body of its own for kevin, keeping bob's signature
+	forgedRawMsg := rawMsg
+	forgedRawMsg.Body = "change of plans, proceed on wednesday"
+	forgedMsg, err := forgedRawMsg.ToSealedMessage(bobSigner, kevinKey.PublicKey(), true)
+	if err != nil {
+		t.Fatalf("Unable to seal message due to: %q", err)
+	}
+	resealed := *sealedMsg
+	resealed.EphemeralKey = forgedMsg.EphemeralKey
+	resealed.Body = forgedMsg.Body
+
+	tests := []struct {
+		name      string
+		message   msg.PackagedMessage
+		wantInbox bool
+	}{
+		{"sealed by the sender", *sealedMsg, true},
+		{"sealed again by the server", resealed, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+			c.EncryptionKey = kevinKey
+
+			err := c.putInInbox(context.Background(), msg.Delivery{Lease: 1, Message: tt.message})
+			if err != nil {
+				t.Fatalf("Unable to put delivery into inbox due to: %q", err)
+			}
+
+			opened, ok := c.Inbox.Dequeue()
+			if !tt.wantInbox {
+				if ok {
+					t.Errorf("Expected the message to not be opened into the inbox. got=%q", opened.Body)
+				}
+				if _, deadLettered := c.DeadLetters.Get(tt.message.ID); !deadLettered {
+					t.Errorf("Expected the message to be dead lettered")
+				}
+				return
+			}
+			if !ok || opened.IsEncrypted() || opened.Body != rawMsg.Body || opened.Subject != rawMsg.Subject {
+				t.Errorf("Expected the opened message in the inbox. got=%+v", opened)
+			}
+		})
+	}
+
+	// a client signing with an hmac secret cannot seal messages
+	c := newTestClient(t, "", "Kevin", "Liberty", []byte("kevin's key"))
+	c.PinnedKeys = map[msg.UserVessel]*ecdh.PublicKey{bob: newPublicKey(t)}
+	err = c.WriteNewMessageIntoQueue(context.Background(), NewMessage{ToName: bob.Name, ToVessel: bob.Vessel, Subject: "Tuesday", Body: "proceeding", Seal: true})
+	if !errors.Is(err, msg.ErrSealedWithSecret) {
+		t.Errorf("Expected ErrSealedWithSecret, but got %v", err)
+	}
+}
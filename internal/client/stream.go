@@ -0,0 +1,172 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// streamIdleTimeout is how long a stream can go without even a keep-alive from the
+// server before the link is taken to have dropped, the server sends one every 15 seconds
+const streamIdleTimeout = 45 * time.Second
+
+// streamRetryInterval spaces out reconnecting when the server keeps closing the stream
+const streamRetryInterval = time.Second
+
+// *** Errors ***
+
+// errStreamIdle is returned when nothing arrives over a stream for streamIdleTimeout
+var errStreamIdle = errors.New("stream went quiet, the link may have dropped")
+
+// *** Internal Types ***
+
+// streamEvent is a server-sent event. Events made only of comments, such as keep-alives, have no fields set.
+type streamEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// *** Functions ***
+
+// StreamMessages puts messages into the inbox the moment the server has them, acknowledging each one,
+// until ctx is done or the stream ends. Streaming again resumes after the last message that was
+// put into the inbox, so none are missed when the link drops. Returns nil when the server ends the stream.
+func (c *Config) StreamMessages(ctx context.Context) error {
+	return c.streamMessages(ctx, ctx)
+}
+
+// streamMessages streams until ctx is done, acknowledging messages under requestCtx
+func (c *Config) streamMessages(ctx, requestCtx context.Context) error {
+	owner := msg.UserVessel{Name: c.Name, Vessel: c.Vessel}
+
+	// the stream is ended once the link goes quiet
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(streamIdleTimeout, cancel)
+	defer idle.Stop()
+
+	req, err := http.NewRequestWithContext(streamCtx, http.MethodGet, c.Server+"/stream-messages", nil)
+	if err != nil {
+		return err
+	}
+	err = c.authorizeMailbox(req, owner, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	lastEventID := c.lastStreamed()
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	res, err := c.doStream(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// check return status
+	statusErr := checkStatus(res, "stream messages")
+	if statusErr != nil {
+		if statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusMethodNotAllowed {
+			c.noStream.Store(true)
+		}
+		return statusErr
+	}
+
+	reader := bufio.NewReader(res.Body)
+	ack := msg.Acknowledgement{}
+	for {
+		event, err := readEvent(reader)
+		if err != nil {
+			ackErr := c.acknowledgeMessages(requestCtx, owner, ack)
+			if errors.Is(err, io.EOF) {
+				return ackErr
+			}
+			if streamCtx.Err() != nil && ctx.Err() == nil {
+				c.Online.setValue(false)
+				err = errStreamIdle
+			}
+			return errors.Join(err, ackErr)
+		}
+		idle.Reset(streamIdleTimeout)
+
+		if event.event == "message" {
+			var delivery msg.Delivery
+			err = json.Unmarshal([]byte(event.data), &delivery)
+			if err == nil {
+				err = c.putInInbox(requestCtx, delivery)
+			}
+			if err != nil {
+				// the server sends it again once the stream is resumed
+				return errors.Join(err, c.acknowledgeMessages(requestCtx, owner, ack))
+			}
+			c.setLastStreamed(event.id)
+			ack.Leases = append(ack.Leases, delivery.Lease)
+		}
+
+		// acknowledge once caught up, rather than for every message of a burst
+		if reader.Buffered() == 0 && len(ack.Leases) > 0 {
+			err = c.acknowledgeMessages(requestCtx, owner, ack)
+			if err != nil {
+				return err
+			}
+			ack.Leases = nil
+		}
+	}
+}
+
+// lastStreamed returns the id of the last streamed message that was put into the inbox
+func (c *Config) lastStreamed() string {
+	c.streamMux.Lock()
+	defer c.streamMux.Unlock()
+
+	return c.lastEventID
+}
+
+func (c *Config) setLastStreamed(id string) {
+	c.streamMux.Lock()
+	c.lastEventID = id
+	c.streamMux.Unlock()
+}
+
+// readEvent reads the lines of an event up to the blank line that ends it.
+// An event cut off by the end of the stream is dropped, as the spec says.
+func readEvent(reader *bufio.Reader) (streamEvent, error) {
+	var event streamEvent
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return streamEvent{}, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line == "" {
+			event.data = strings.Join(data, "\n")
+			return event, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			event.id = value
+		case "event":
+			event.event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+func TestStreamResumesAfterLastEventID(t *testing.T) {
+	rawMsg := msg.RawMessage{
+		ToName:     "Kevin",
+		ToVessel:   "Liberty",
+		FromName:   "Bob",
+		FromVessel: "Snow",
+		Subject:    "Tuesday",
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+	}
+	pkgMsg, err := rawMsg.ToPackagedMessage([]byte("bob's key"))
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+
+	// the first stream sends one message then drops, the second records where it resumed from
+	var lastEventIDs []string
+	var acked []uint64
+	var mux sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+
+		switch r.URL.Path {
+		case "/stream-messages":
+			lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+			w.Header().Set("Content-Type", "text/event-stream")
+			if len(lastEventIDs) > 1 {
+				return
+			}
+			data, _ := json.Marshal(msg.Delivery{Lease: 7, Message: *pkgMsg})
+			fmt.Fprintf(w, ": keep-alive\n\nid:%s\nevent:message\ndata:%s\n\n", pkgMsg.ID, data)
+
+		case "/ack-messages":
+			var ack msg.Acknowledgement
+			json.NewDecoder(r.Body).Decode(&ack)
+			acked = append(acked, ack.Leases...)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, "Kevin", "Liberty", []byte("kevin's key"))
+	for range 2 {
+		err = c.StreamMessages(context.Background())
+		if err != nil {
+			t.Fatalf("Unable to stream messages due to: %q", err)
+		}
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if len(lastEventIDs) != 2 || lastEventIDs[0] != "" || lastEventIDs[1] != pkgMsg.ID {
+		t.Errorf("Expected the second stream to resume after %s. got=%q", pkgMsg.ID, lastEventIDs)
+	}
+	if len(acked) != 1 || acked[0] != 7 {
+		t.Errorf("Expected the streamed delivery to be acknowledged. got=%v", acked)
+	}
+	if size := c.Inbox.Size(); size != 1 {
+		t.Errorf("Expected the message in the inbox. size=%d", size)
+	}
+}
@@ -0,0 +1,396 @@
+package msg
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"iter"
+	"time"
+)
+
+// BinaryContentType is the media type of the compact binary encoding, which can be sent in place of JSON.
+// A payload starts with the format version, followed by one message, or by a uvarint count of
+// length-prefixed messages or deliveries. Each of those is a list of fields written as a tag,
+// a uvarint length and the value: strings as they are, the signature as raw bytes, times as
+// varint nanoseconds since the unix epoch and numbers as varints. Fields with a zero value are left out.
+const BinaryContentType = "application/x-async-messages"
+
+// binaryFormatVersion starts every binary payload, so that the format can change later
+const binaryFormatVersion = 1
+
+// tags of the fields of a message within the binary encoding.
+// New fields are given new tags, decoders skip the tags they do not know.
+const (
+	binID byte = iota + 1
+	binToName
+	binToVessel
+	binFromName
+	binFromVessel
+	binSubject
+	binBody
+	binSignature
+	binSignatureVersion
+	binAlgorithm
+	binEncryption
+	binEphemeralKey
+	binEncryptedSubject
+	binExpires
+	binPriority
+	binPackaged
+	binRecieved
+)
+
+// tags of the fields of a delivery within the binary encoding
+const (
+	binLease byte = iota + 1
+	binMessage
+)
+
+// *** Errors ***
+
+// ErrInvalidBinary is returned when binary data is not a valid encoding
+var ErrInvalidBinary = errors.New("invalid binary encoding")
+
+// *** Internal Types ***
+
+// binaryEncoder appends the fields of the binary encoding
+type binaryEncoder struct {
+	buf []byte
+}
+
+// binaryDecoder reads the binary encoding, keeping the first error it finds
+type binaryDecoder struct {
+	data []byte
+	err  error
+}
+
+// *** Functions ***
+
+// MarshalBinary encodes the message in the compact binary encoding
+func (m *PackagedMessage) MarshalBinary() ([]byte, error) {
+	e := &binaryEncoder{buf: []byte{binaryFormatVersion}}
+	err := e.writeMessage(m)
+	if err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes a message from the compact binary encoding
+func (m *PackagedMessage) UnmarshalBinary(data []byte) error {
+	d := &binaryDecoder{data: data}
+	d.readVersion()
+	if d.err != nil {
+		return d.err
+	}
+
+	message := d.readMessage(d.data)
+	if d.err != nil {
+		return d.err
+	}
+	*m = message
+	return nil
+}
+
+// MarshalMessagesBinary encodes a batch of messages in the compact binary encoding
+func MarshalMessagesBinary(messages []PackagedMessage) ([]byte, error) {
+	e := &binaryEncoder{buf: []byte{binaryFormatVersion}}
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(messages)))
+	for i := range messages {
+		item := &binaryEncoder{}
+		err := item.writeMessage(&messages[i])
+		if err != nil {
+			return nil, err
+		}
+		e.writeRaw(item.buf)
+	}
+	return e.buf, nil
+}
+
+// UnmarshalMessagesBinary decodes a batch of messages from the compact binary encoding
+func UnmarshalMessagesBinary(data []byte) ([]PackagedMessage, error) {
+	d := &binaryDecoder{data: data}
+	d.readVersion()
+	count := d.readCount()
+
+	messages := make([]PackagedMessage, 0, count)
+	for range count {
+		messages = append(messages, d.readMessage(d.readRaw()))
+	}
+	d.readEnd()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return messages, nil
+}
+
+// MarshalDeliveriesBinary encodes deliveries in the compact binary encoding
+func MarshalDeliveriesBinary(deliveries []Delivery) ([]byte, error) {
+	e := &binaryEncoder{buf: []byte{binaryFormatVersion}}
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(deliveries)))
+	for i := range deliveries {
+		message := &binaryEncoder{}
+		err := message.writeMessage(&deliveries[i].Message)
+		if err != nil {
+			return nil, err
+		}
+
+		item := &binaryEncoder{}
+		item.writeUint(binLease, deliveries[i].Lease)
+		item.writeField(binMessage, message.buf)
+		e.writeRaw(item.buf)
+	}
+	return e.buf, nil
+}
+
+// UnmarshalDeliveriesBinary decodes deliveries from the compact binary encoding
+func UnmarshalDeliveriesBinary(data []byte) ([]Delivery, error) {
+	d := &binaryDecoder{data: data}
+	d.readVersion()
+	count := d.readCount()
+
+	deliveries := make([]Delivery, 0, count)
+	for range count {
+		item := &binaryDecoder{data: d.readRaw()}
+		var delivery Delivery
+		for tag, value := range item.fields() {
+			switch tag {
+			case binLease:
+				delivery.Lease = item.uintValue(value)
+			case binMessage:
+				delivery.Message = item.readMessage(value)
+			}
+		}
+		d.keep(item.err)
+		deliveries = append(deliveries, delivery)
+	}
+	d.readEnd()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return deliveries, nil
+}
+
+// writeMessage appends the fields of a message
+func (e *binaryEncoder) writeMessage(m *PackagedMessage) error {
+	signature, err := hex.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("unable to encode signature of message %s: %w", m.ID, err)
+	}
+
+	e.writeString(binID, m.ID)
+	e.writeString(binToName, m.To.Name)
+	e.writeString(binToVessel, m.To.Vessel)
+	e.writeString(binFromName, m.From.Name)
+	e.writeString(binFromVessel, m.From.Vessel)
+	e.writeString(binSubject, m.Subject)
+	e.writeString(binBody, m.Body)
+	if len(signature) > 0 {
+		e.writeField(binSignature, signature)
+	}
+	e.writeInt(binSignatureVersion, int64(m.SignatureVersion))
+	e.writeString(binAlgorithm, m.Algorithm)
+	e.writeString(binEncryption, m.Encryption)
+	e.writeString(binEphemeralKey, m.EphemeralKey)
+	if m.EncryptedSubject {
+		e.writeField(binEncryptedSubject, []byte{1})
+	}
+	e.writeTime(binExpires, m.Expires)
+	e.writeInt(binPriority, int64(m.Priority))
+	e.writeTime(binPackaged, m.Packaged)
+	e.writeTime(binRecieved, m.Recieved)
+	return nil
+}
+
+// writeString writes a string field unless it is empty
+func (e *binaryEncoder) writeString(tag byte, value string) {
+	if value != "" {
+		e.writeField(tag, []byte(value))
+	}
+}
+
+// writeInt writes a signed number field unless it is zero
+func (e *binaryEncoder) writeInt(tag byte, value int64) {
+	if value != 0 {
+		e.writeField(tag, binary.AppendVarint(nil, value))
+	}
+}
+
+// writeUint writes an unsigned number field unless it is zero
+func (e *binaryEncoder) writeUint(tag byte, value uint64) {
+	if value != 0 {
+		e.writeField(tag, binary.AppendUvarint(nil, value))
+	}
+}
+
+// writeTime writes a time field as nanoseconds since the unix epoch, unless it is the zero time.
+// It is the same instant signatures cover, though not the time zone.
+func (e *binaryEncoder) writeTime(tag byte, value time.Time) {
+	if !value.IsZero() {
+		e.writeField(tag, binary.AppendVarint(nil, value.UnixNano()))
+	}
+}
+
+// writeField writes a tag followed by the length-prefixed value
+func (e *binaryEncoder) writeField(tag byte, value []byte) {
+	e.buf = append(e.buf, tag)
+	e.writeRaw(value)
+}
+
+// writeRaw writes a uvarint length followed by the value
+func (e *binaryEncoder) writeRaw(value []byte) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(value)))
+	e.buf = append(e.buf, value...)
+}
+
+// readMessage decodes the fields of a message
+func (d *binaryDecoder) readMessage(data []byte) PackagedMessage {
+	fields := &binaryDecoder{data: data}
+
+	var m PackagedMessage
+	for tag, value := range fields.fields() {
+		switch tag {
+		case binID:
+			m.ID = string(value)
+		case binToName:
+			m.To.Name = string(value)
+		case binToVessel:
+			m.To.Vessel = string(value)
+		case binFromName:
+			m.From.Name = string(value)
+		case binFromVessel:
+			m.From.Vessel = string(value)
+		case binSubject:
+			m.Subject = string(value)
+		case binBody:
+			m.Body = string(value)
+		case binSignature:
+			m.Signature = hex.EncodeToString(value)
+		case binSignatureVersion:
+			m.SignatureVersion = int(fields.intValue(value))
+		case binAlgorithm:
+			m.Algorithm = string(value)
+		case binEncryption:
+			m.Encryption = string(value)
+		case binEphemeralKey:
+			m.EphemeralKey = string(value)
+		case binEncryptedSubject:
+			m.EncryptedSubject = len(value) == 1 && value[0] == 1
+		case binExpires:
+			m.Expires = fields.timeValue(value)
+		case binPriority:
+			m.Priority = Priority(fields.intValue(value))
+		case binPackaged:
+			m.Packaged = fields.timeValue(value)
+		case binRecieved:
+			m.Recieved = fields.timeValue(value)
+		}
+	}
+
+	d.keep(fields.err)
+	return m
+}
+
+// fields iterates over the tag and value of each field until the data runs out
+func (d *binaryDecoder) fields() iter.Seq2[byte, []byte] {
+	return func(yield func(byte, []byte) bool) {
+		for d.err == nil && len(d.data) > 0 {
+			tag := d.data[0]
+			d.data = d.data[1:]
+
+			value := d.readRaw()
+			if d.err != nil || !yield(tag, value) {
+				return
+			}
+		}
+	}
+}
+
+// readVersion reads the format version that starts a payload
+func (d *binaryDecoder) readVersion() {
+	if len(d.data) == 0 {
+		d.fail("empty payload")
+		return
+	}
+	if d.data[0] != binaryFormatVersion {
+		d.fail(fmt.Sprintf("unknown format version %d", d.data[0]))
+		return
+	}
+	d.data = d.data[1:]
+}
+
+// readCount reads how many items follow, each item takes at least its length byte
+func (d *binaryDecoder) readCount() int {
+	if d.err != nil {
+		return 0
+	}
+
+	count, n := binary.Uvarint(d.data)
+	if n <= 0 || count > uint64(len(d.data)-n) {
+		d.fail("invalid item count")
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(count)
+}
+
+// readRaw reads a uvarint length followed by that many bytes
+func (d *binaryDecoder) readRaw() []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	length, n := binary.Uvarint(d.data)
+	if n <= 0 || length > uint64(len(d.data)-n) {
+		d.fail("truncated field")
+		return nil
+	}
+	value := d.data[n : n+int(length)]
+	d.data = d.data[n+int(length):]
+	return value
+}
+
+// readEnd checks that nothing follows the last item
+func (d *binaryDecoder) readEnd() {
+	if d.err == nil && len(d.data) > 0 {
+		d.fail(fmt.Sprintf("%d bytes after the last item", len(d.data)))
+	}
+}
+
+// intValue decodes a value that holds a varint
+func (d *binaryDecoder) intValue(value []byte) int64 {
+	number, n := binary.Varint(value)
+	if n <= 0 || n != len(value) {
+		d.fail("invalid number")
+		return 0
+	}
+	return number
+}
+
+// uintValue decodes a value that holds a uvarint
+func (d *binaryDecoder) uintValue(value []byte) uint64 {
+	number, n := binary.Uvarint(value)
+	if n <= 0 || n != len(value) {
+		d.fail("invalid number")
+		return 0
+	}
+	return number
+}
+
+// timeValue decodes a value that holds nanoseconds since the unix epoch
+func (d *binaryDecoder) timeValue(value []byte) time.Time {
+	return time.Unix(0, d.intValue(value)).UTC()
+}
+
+// keep records an error from decoding part of the data, unless there already is one
+func (d *binaryDecoder) keep(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// fail records why the data is invalid, unless there already is an error
+func (d *binaryDecoder) fail(reason string) {
+	d.keep(fmt.Errorf("%w: %s", ErrInvalidBinary, reason))
+}
@@ -0,0 +1,255 @@
+package msg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// binaryTestMessages returns signed messages that use every field of the binary encoding
+func binaryTestMessages(t *testing.T) ([]PackagedMessage, Keyring) {
+	kevin := UserVessel{Name: "Kevin", Vessel: "Liberty"}
+	// each user signs with only one algorithm
+	anna := UserVessel{Name: "Anna", Vessel: "Liberty"}
+	privateKey := ed25519.NewKeyFromSeed(signerSeed)
+	keys := &testKeyring{
+		secretKeys: map[UserVessel][]byte{kevin: []byte("kevin's hmac key")},
+		publicKeys: map[UserVessel]ed25519.PublicKey{anna: privateKey.Public().(ed25519.PublicKey)},
+	}
+
+	hmacSigner := NewHMACSigner([]byte("kevin's hmac key"))
+	ed25519Signer, err := NewEd25519Signer(privateKey)
+	if err != nil {
+		t.Fatalf("Unable to create signer due to: %q", err)
+	}
+	bobKey, err := NewEncryptionKey()
+	if err != nil {
+		t.Fatalf("Unable to create encryption key due to: %q", err)
+	}
+
+	rawMsg := RawMessage{
+		ToName:     "Bob",
+		ToVessel:   "Snow",
+		FromName:   "Kevin",
+		FromVessel: "Liberty",
+		Subject:    "Tuesday | 1@2",
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+	}
+	urgentMsg := rawMsg
+	urgentMsg.FromName = anna.Name
+	urgentMsg.Priority = PriorityUrgent
+	urgentMsg.TTL = time.Hour
+
+	hmacMsg, err := rawMsg.ToPackagedMessageWith(hmacSigner)
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+	ed25519Msg, err := urgentMsg.ToPackagedMessageWith(ed25519Signer)
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+	sealedRawMsg := rawMsg
+	sealedRawMsg.FromName = anna.Name
+	sealedMsg, err := sealedRawMsg.ToSealedMessage(ed25519Signer, bobKey.PublicKey(), true)
+	if err != nil {
+		t.Fatalf("Unable to seal message due to: %q", err)
+	}
+	// recieved by the server after it was signed
+	ed25519Msg.Recieved = time.Now().UTC()
+
+	return []PackagedMessage{*hmacMsg, *ed25519Msg, *sealedMsg}, keys
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	messages, keys := binaryTestMessages(t)
+
+	for _, pkgMsg := range messages {
+		// messages arrive as json, and are transcoded from there
+		jsonData, err := json.Marshal(pkgMsg)
+		if err != nil {
+			t.Fatalf("Unable to marshal message due to: %q", err)
+		}
+		var fromJSON PackagedMessage
+		err = json.Unmarshal(jsonData, &fromJSON)
+		if err != nil {
+			t.Fatalf("Unable to unmarshal message due to: %q", err)
+		}
+
+		binaryData, err := fromJSON.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Unable to marshal binary due to: %q", err)
+		}
+		if len(binaryData) >= len(jsonData) {
+			t.Errorf("Binary is not smaller than json. binary=%d json=%d", len(binaryData), len(jsonData))
+		}
+
+		var decoded PackagedMessage
+		err = decoded.UnmarshalBinary(binaryData)
+		if err != nil {
+			t.Fatalf("Unable to unmarshal binary due to: %q", err)
+		}
+		if !reflect.DeepEqual(decoded, fromJSON) {
+			t.Errorf("Message mismatch.\ngot=%+v\nwant=%+v", decoded, fromJSON)
+		}
+
+		err = decoded.VerifyMessageWith(keys)
+		if err != nil {
+			t.Errorf("Did not expect error verifying %s: got=%q", pkgMsg.Algorithm, err)
+		}
+	}
+}
+
+func TestBinaryBatchRoundTrip(t *testing.T) {
+	messages, keys := binaryTestMessages(t)
+
+	data, err := MarshalMessagesBinary(messages)
+	if err != nil {
+		t.Fatalf("Unable to marshal batch due to: %q", err)
+	}
+	decoded, err := UnmarshalMessagesBinary(data)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal batch due to: %q", err)
+	}
+	if len(decoded) != len(messages) {
+		t.Fatalf("Batch length mismatch. got=%d want=%d", len(decoded), len(messages))
+	}
+	for i := range decoded {
+		if !decoded[i].Packaged.Equal(messages[i].Packaged) || decoded[i].ID != messages[i].ID {
+			t.Errorf("Message %d mismatch. got=%s want=%s", i, decoded[i].ID, messages[i].ID)
+		}
+		err = decoded[i].VerifyMessageWith(keys)
+		if err != nil {
+			t.Errorf("Did not expect error verifying message %d: got=%q", i, err)
+		}
+	}
+
+	// an empty batch is still a batch
+	data, err = MarshalMessagesBinary(nil)
+	if err != nil {
+		t.Fatalf("Unable to marshal batch due to: %q", err)
+	}
+	decoded, err = UnmarshalMessagesBinary(data)
+	if err != nil || len(decoded) != 0 {
+		t.Errorf("Expected empty batch. got=%d err=%v", len(decoded), err)
+	}
+}
+
+func TestBinaryDeliveriesRoundTrip(t *testing.T) {
+	messages, keys := binaryTestMessages(t)
+
+	deliveries := make([]Delivery, 0, len(messages))
+	for i, pkgMsg := range messages {
+		deliveries = append(deliveries, Delivery{Lease: uint64(i + 1), Message: pkgMsg})
+	}
+
+	data, err := MarshalDeliveriesBinary(deliveries)
+	if err != nil {
+		t.Fatalf("Unable to marshal deliveries due to: %q", err)
+	}
+	decoded, err := UnmarshalDeliveriesBinary(data)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal deliveries due to: %q", err)
+	}
+	if len(decoded) != len(deliveries) {
+		t.Fatalf("Deliveries length mismatch. got=%d want=%d", len(decoded), len(deliveries))
+	}
+	for i := range decoded {
+		if decoded[i].Lease != deliveries[i].Lease {
+			t.Errorf("Lease mismatch. got=%d want=%d", decoded[i].Lease, deliveries[i].Lease)
+		}
+		err = decoded[i].Message.VerifyMessageWith(keys)
+		if err != nil {
+			t.Errorf("Did not expect error verifying delivery %d: got=%q", i, err)
+		}
+	}
+}
+
+func TestBinaryTamperedFails(t *testing.T) {
+	messages, keys := binaryTestMessages(t)
+
+	data, err := messages[0].MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unable to marshal binary due to: %q", err)
+	}
+	// change a word of the body
+	weather := bytes.Index(data, []byte("weather"))
+	if weather < 0 {
+		t.Fatalf("Body is not in the binary encoding")
+	}
+	data[weather] = 'W'
+
+	var decoded PackagedMessage
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal binary due to: %q", err)
+	}
+	err = decoded.VerifyMessageWith(keys)
+	if err == nil {
+		t.Errorf("Expected a tampered message to fail verification")
+	}
+}
+
+func TestUnmarshalBinaryInvalid(t *testing.T) {
+	messages, _ := binaryTestMessages(t)
+	valid, err := messages[0].MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unable to marshal binary due to: %q", err)
+	}
+
+	tt := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "unknown version", data: append([]byte{9}, valid[1:]...)},
+		{name: "truncated", data: valid[:len(valid)-3]},
+		{name: "field longer than data", data: []byte{binaryFormatVersion, binID, 200}},
+		{name: "bad number", data: []byte{binaryFormatVersion, binPriority, 1, 0x80}},
+	}
+
+	for _, tc := range tt {
+		var decoded PackagedMessage
+		err := decoded.UnmarshalBinary(tc.data)
+		if !errors.Is(err, ErrInvalidBinary) {
+			t.Errorf("%s: expected ErrInvalidBinary. got=%v", tc.name, err)
+		}
+	}
+
+	// batches must hold exactly as many messages as they say
+	batch, err := MarshalMessagesBinary(messages)
+	if err != nil {
+		t.Fatalf("Unable to marshal batch due to: %q", err)
+	}
+	_, err = UnmarshalMessagesBinary(append(batch, 0))
+	if !errors.Is(err, ErrInvalidBinary) {
+		t.Errorf("Expected trailing data to be invalid. got=%v", err)
+	}
+	_, err = UnmarshalMessagesBinary(batch[:len(batch)-1])
+	if !errors.Is(err, ErrInvalidBinary) {
+		t.Errorf("Expected a short batch to be invalid. got=%v", err)
+	}
+}
+
+func TestUnmarshalBinarySkipsUnknownFields(t *testing.T) {
+	messages, keys := binaryTestMessages(t)
+	data, err := messages[0].MarshalBinary()
+	if err != nil {
+		t.Fatalf("Unable to marshal binary due to: %q", err)
+	}
+	// a field from a newer encoder
+	data = append(data, 200, 3, 'n', 'e', 'w')
+
+	var decoded PackagedMessage
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("Did not expect error: got=%q", err)
+	}
+	err = decoded.VerifyMessageWith(keys)
+	if err != nil {
+		t.Errorf("Did not expect error: got=%q", err)
+	}
+}
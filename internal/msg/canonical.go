@@ -0,0 +1,73 @@
+package msg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// canonicalEncoder builds unambiguous data for signing.
+// The data starts with a domain string naming what is signed and its version,
+// followed by fields written as a tag, a uvarint length and the raw value.
+// Tags must be written in increasing order so that the encoding is canonical.
+type canonicalEncoder struct {
+	buf bytes.Buffer
+}
+
+// newCanonicalEncoder starts the signing data for a domain such as "async-messages/message/v2"
+func newCanonicalEncoder(domain string) *canonicalEncoder {
+	e := &canonicalEncoder{}
+	e.writeRaw([]byte(domain))
+	return e
+}
+
+// writeString writes a string field, even if empty
+func (e *canonicalEncoder) writeString(tag byte, value string) {
+	e.buf.WriteByte(tag)
+	e.writeRaw([]byte(value))
+}
+
+// writeOptionalString writes a string field only when it is not empty
+func (e *canonicalEncoder) writeOptionalString(tag byte, value string) {
+	if value != "" {
+		e.writeString(tag, value)
+	}
+}
+
+// writeTime writes a time field as nanoseconds since the unix epoch
+func (e *canonicalEncoder) writeTime(tag byte, value time.Time) {
+	var timeData [8]byte
+	binary.BigEndian.PutUint64(timeData[:], uint64(value.UnixNano()))
+
+	e.buf.WriteByte(tag)
+	e.writeRaw(timeData[:])
+}
+
+// writeOptionalTime writes a time field only when it is not the zero time
+func (e *canonicalEncoder) writeOptionalTime(tag byte, value time.Time) {
+	if !value.IsZero() {
+		e.writeTime(tag, value)
+	}
+}
+
+// writeOptionalBool writes a single byte of 1 only when the value is true
+func (e *canonicalEncoder) writeOptionalBool(tag byte, value bool) {
+	if value {
+		e.buf.WriteByte(tag)
+		e.writeRaw([]byte{1})
+	}
+}
+
+// writeRaw writes a uvarint length followed by the value
+func (e *canonicalEncoder) writeRaw(value []byte) {
+	var lenData [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenData[:], uint64(len(value)))
+
+	e.buf.Write(lenData[:n])
+	e.buf.Write(value)
+}
+
+// bytes returns the encoded data
+func (e *canonicalEncoder) bytes() []byte {
+	return e.buf.Bytes()
+}
@@ -0,0 +1,160 @@
+package msg
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// *** Types ***
+
+// DeadLetter is a message that could not be delivered, and why
+type DeadLetter struct {
+	Message PackagedMessage `json:"message"`
+	Reason  string          `json:"reason"`
+	// Attempts is how many times delivering the message has failed for good
+	Attempts int       `json:"attempts"`
+	Failed   time.Time `json:"failedAt"`
+}
+
+// DeadLetterQueue holds undeliverable messages, oldest first, by message id.
+// A limit above 0 drops the oldest dead letters once it is reached.
+type DeadLetterQueue struct {
+	letters []DeadLetter
+	limit   int
+	mux     *sync.Mutex
+}
+
+// *** Errors ***
+
+// ErrDeadLetterConflict is returned when adding a message whose id is already held by a different message
+var ErrDeadLetterConflict = errors.New("a different message is already a dead letter with that id")
+
+// *** New Dead Letter Queue ***
+
+func NewDeadLetterQueue(limit int) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		letters: make([]DeadLetter, 0),
+		limit:   limit,
+		mux:     &sync.Mutex{},
+	}
+}
+
+// *** Functions ***
+
+// Add records that the message failed for the reason. A message that is already in
+// the queue has its reason updated and attempts counted up, and keeps its place.
+// Returns the dead letter, and any older dead letters dropped to stay within the limit.
+// A different message with the same id is refused, and the dead letter already held is returned.
+func (q *DeadLetterQueue) Add(pkgMsg PackagedMessage, reason string, failed time.Time) (DeadLetter, []DeadLetter, error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	i := q.index(pkgMsg.ID)
+	if i >= 0 {
+		existing := q.letters[i].Message
+		if existing.From != pkgMsg.From || existing.Signature != pkgMsg.Signature {
+			return q.letters[i], nil, ErrDeadLetterConflict
+		}
+		q.letters[i].Reason = reason
+		q.letters[i].Attempts++
+		q.letters[i].Failed = failed
+		return q.letters[i], nil, nil
+	}
+
+	deadLetter := DeadLetter{
+		Message:  pkgMsg,
+		Reason:   reason,
+		Attempts: 1,
+		Failed:   failed,
+	}
+	q.letters = append(q.letters, deadLetter)
+	return deadLetter, q.trim(), nil
+}
+
+// Restore puts back a dead letter as it was, such as one read from a journal
+func (q *DeadLetterQueue) Restore(deadLetter DeadLetter) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	i := q.index(deadLetter.Message.ID)
+	if i >= 0 {
+		q.letters[i] = deadLetter
+		return
+	}
+	q.letters = append(q.letters, deadLetter)
+	q.trim()
+}
+
+// Get returns the dead letter for the message id
+func (q *DeadLetterQueue) Get(id string) (DeadLetter, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	i := q.index(id)
+	if i < 0 {
+		return DeadLetter{}, false
+	}
+	return q.letters[i], true
+}
+
+// Remove takes the dead letter for the message id out of the queue
+func (q *DeadLetterQueue) Remove(id string) (DeadLetter, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	i := q.index(id)
+	if i < 0 {
+		return DeadLetter{}, false
+	}
+	deadLetter := q.letters[i]
+	q.letters = append(q.letters[:i], q.letters[i+1:]...)
+	return deadLetter, true
+}
+
+// Purge empties the queue, returning what was in it
+func (q *DeadLetterQueue) Purge() []DeadLetter {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	purged := q.letters
+	q.letters = make([]DeadLetter, 0)
+	return purged
+}
+
+// List returns a copy of every dead letter, oldest first
+func (q *DeadLetterQueue) List() []DeadLetter {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return append([]DeadLetter(nil), q.letters...)
+}
+
+// Size returns the number of dead letters
+func (q *DeadLetterQueue) Size() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return len(q.letters)
+}
+
+// index returns where the message id is in the queue, or -1
+func (q *DeadLetterQueue) index(id string) int {
+	for i := range q.letters {
+		if q.letters[i].Message.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// trim drops the oldest dead letters beyond the limit, returning them
+func (q *DeadLetterQueue) trim() []DeadLetter {
+	if q.limit <= 0 || len(q.letters) <= q.limit {
+		return nil
+	}
+
+	dropped := append([]DeadLetter(nil), q.letters[:len(q.letters)-q.limit]...)
+	q.letters = append(q.letters[:0], q.letters[len(q.letters)-q.limit:]...)
+	return dropped
+}
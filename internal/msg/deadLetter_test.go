@@ -0,0 +1,125 @@
+package msg
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterQueue(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Re: Tuesday", "Re: Re: Tuesday")
+	failed := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	queue := NewDeadLetterQueue(0)
+	for _, msg := range msgs {
+		deadLetter, dropped, err := queue.Add(msg, "message was packaged too long ago", failed)
+		if err != nil {
+			t.Fatalf("Unable to add dead letter due to: %q", err)
+		}
+		if deadLetter.Attempts != 1 {
+			t.Errorf("attempts mismatch. got=%d want=%d", deadLetter.Attempts, 1)
+		}
+		if len(dropped) != 0 {
+			t.Errorf("nothing should be dropped without a limit, dropped %d", len(dropped))
+		}
+	}
+	if queue.Size() != 3 {
+		t.Fatalf("size mismatch. got=%d want=%d", queue.Size(), 3)
+	}
+
+	// failing again keeps the place in the queue
+	deadLetter, _, err := queue.Add(msgs[0], "message expired", failed.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Unable to add dead letter due to: %q", err)
+	}
+	if deadLetter.Attempts != 2 {
+		t.Errorf("attempts mismatch. got=%d want=%d", deadLetter.Attempts, 2)
+	}
+	list := queue.List()
+	if list[0].Message.ID != msgs[0].ID || list[0].Reason != "message expired" {
+		t.Errorf("first dead letter mismatch. got=%q/%q", list[0].Message.Subject, list[0].Reason)
+	}
+	if !list[0].Failed.Equal(failed.Add(time.Hour)) {
+		t.Errorf("failed time mismatch. got=%v", list[0].Failed)
+	}
+
+	got, ok := queue.Get(msgs[1].ID)
+	if !ok || got.Message.Subject != "Re: Tuesday" {
+		t.Errorf("unable to get dead letter %s", msgs[1].ID)
+	}
+
+	removed, ok := queue.Remove(msgs[1].ID)
+	if !ok || removed.Message.ID != msgs[1].ID {
+		t.Errorf("unable to remove dead letter %s", msgs[1].ID)
+	}
+	_, ok = queue.Remove(msgs[1].ID)
+	if ok {
+		t.Error("dead letter should only be removed once")
+	}
+	if queue.Size() != 2 {
+		t.Errorf("size mismatch. got=%d want=%d", queue.Size(), 2)
+	}
+
+	purged := queue.Purge()
+	if len(purged) != 2 || queue.Size() != 0 {
+		t.Errorf("purge mismatch. purged=%d left=%d", len(purged), queue.Size())
+	}
+}
+
+func TestDeadLetterQueueLimit(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Re: Tuesday", "Re: Re: Tuesday")
+	failed := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	queue := NewDeadLetterQueue(2)
+	queue.Add(msgs[0], "invalid", failed)
+	queue.Add(msgs[1], "invalid", failed)
+	_, dropped, _ := queue.Add(msgs[2], "invalid", failed)
+
+	if len(dropped) != 1 || dropped[0].Message.ID != msgs[0].ID {
+		t.Fatalf("oldest dead letter should be dropped, dropped %d", len(dropped))
+	}
+
+	wantSubjects := []string{"Re: Tuesday", "Re: Re: Tuesday"}
+	for i, deadLetter := range queue.List() {
+		if deadLetter.Message.Subject != wantSubjects[i] {
+			t.Errorf("subject mismatch at %d. got=%q want=%q", i, deadLetter.Message.Subject, wantSubjects[i])
+		}
+	}
+
+	// restoring stays within the limit as well
+	queue.Restore(DeadLetter{Message: msgs[0], Reason: "invalid", Attempts: 3, Failed: failed})
+	if queue.Size() != 2 {
+		t.Errorf("size mismatch. got=%d want=%d", queue.Size(), 2)
+	}
+	got, ok := queue.Get(msgs[0].ID)
+	if !ok || got.Attempts != 3 {
+		t.Errorf("restored dead letter mismatch. got=%+v", got)
+	}
+}
+
+func TestDeadLetterQueueKeepsConflictingID(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Wednesday")
+	failed := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	queue := NewDeadLetterQueue(0)
+	_, _, err := queue.Add(msgs[0], "message expired", failed)
+	if err != nil {
+		t.Fatalf("Unable to add dead letter due to: %q", err)
+	}
+
+	// another message claiming the same id does not replace the first
+	impostor := msgs[1]
+	impostor.ID = msgs[0].ID
+	deadLetter, _, err := queue.Add(impostor, "message expired", failed.Add(time.Hour))
+	if !errors.Is(err, ErrDeadLetterConflict) {
+		t.Errorf("Expected ErrDeadLetterConflict, but got %v", err)
+	}
+	if deadLetter.Message.Subject != "Tuesday" || deadLetter.Attempts != 1 {
+		t.Errorf("dead letter should be left as it was. got=%q attempts=%d", deadLetter.Message.Subject, deadLetter.Attempts)
+	}
+
+	got, ok := queue.Get(msgs[0].ID)
+	if !ok || got.Message.Subject != "Tuesday" {
+		t.Errorf("dead letter should be left as it was. got=%+v", got)
+	}
+}
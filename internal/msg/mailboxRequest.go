@@ -0,0 +1,194 @@
+package msg
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// *** Types ***
+
+// MailboxRequest is a signed request from a user to retrieve or acknowledge
+// the messages that are waiting for them on the server. The signature covers
+// the method, target and body of the http request it is sent with, so it
+// cannot be used for any other request.
+type MailboxRequest struct {
+	Owner UserVessel
+	// Method and Target are those of the http request, the target being its path and query
+	Method string
+	Target string
+	// BodyDigest is the hex encoded sha256 of the http request body
+	BodyDigest string
+	// Nonce is random, so that the server can tell when a request is sent again
+	Nonce     string
+	Requested time.Time
+	Algorithm string
+	Signature string
+}
+
+// MailboxAuthScheme is the scheme of the Authorization header mailbox requests are sent in
+const MailboxAuthScheme = "Mailbox"
+
+// canonicalMailboxDomain starts the signing data of mailbox requests
+const canonicalMailboxDomain = "async-messages/mailbox/v2"
+
+// mailboxNonceBytes is how many random bytes are in a nonce
+const mailboxNonceBytes = 16
+
+// *** Errors ***
+
+// ErrStaleMailboxRequest is returned when a mailbox request is too old, or is from the future
+var ErrStaleMailboxRequest = errors.New("mailbox request is outside of the allowed time window")
+
+// *** Functions ***
+
+// NewMailboxRequest creates and signs a mailbox request for the owner,
+// to be sent as an http request with the method, target and body
+func NewMailboxRequest(owner UserVessel, signer Signer, method, target string, body []byte) (*MailboxRequest, error) {
+	if owner.Name == "" {
+		return nil, &MissingFieldError{Field: "Name"}
+	}
+	if owner.Vessel == "" {
+		return nil, &MissingFieldError{Field: "Vessel"}
+	}
+
+	var nonce [mailboxNonceBytes]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return nil, fmt.Errorf("unable to create nonce: %w", err)
+	}
+
+	req := MailboxRequest{
+		Owner:      owner,
+		Method:     method,
+		Target:     target,
+		BodyDigest: BodyDigest(body),
+		Nonce:      hex.EncodeToString(nonce[:]),
+		Requested:  time.Now().UTC(),
+		Algorithm:  signer.Algorithm(),
+	}
+
+	signatureData, err := signer.Sign(req.requestDataForSigning())
+	if err != nil {
+		return nil, err
+	}
+	req.Signature = hex.EncodeToString(signatureData)
+
+	return &req, nil
+}
+
+// ParseMailboxRequest reads a mailbox request out of the Authorization header
+// of the http request with the method, target and body
+func ParseMailboxRequest(authorization, method, target string, body []byte) (*MailboxRequest, error) {
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+	if !strings.EqualFold(scheme, MailboxAuthScheme) {
+		return nil, &MissingFieldError{Field: "Authorization"}
+	}
+	values, err := url.ParseQuery(strings.TrimSpace(credentials))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse 'Authorization': %w", err)
+	}
+
+	for _, field := range []string{"name", "vessel", "requestedAt", "nonce", "signature"} {
+		if values.Get(field) == "" {
+			return nil, &MissingFieldError{Field: field}
+		}
+	}
+
+	requested, err := time.Parse(time.RFC3339Nano, values.Get("requestedAt"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse 'requestedAt': %w", err)
+	}
+
+	return &MailboxRequest{
+		Owner: UserVessel{
+			Name:   values.Get("name"),
+			Vessel: values.Get("vessel"),
+		},
+		Method:     method,
+		Target:     target,
+		BodyDigest: BodyDigest(body),
+		Nonce:      values.Get("nonce"),
+		Requested:  requested.UTC(),
+		Algorithm:  values.Get("algorithm"),
+		Signature:  values.Get("signature"),
+	}, nil
+}
+
+// Authorization returns the value of the Authorization header to send the request in,
+// the inverse of ParseMailboxRequest. Keeping it out of the url keeps it out of logs.
+func (r *MailboxRequest) Authorization() string {
+	values := url.Values{}
+	values.Set("name", r.Owner.Name)
+	values.Set("vessel", r.Owner.Vessel)
+	values.Set("requestedAt", r.Requested.Format(time.RFC3339Nano))
+	values.Set("nonce", r.Nonce)
+	if r.Algorithm != "" {
+		values.Set("algorithm", r.Algorithm)
+	}
+	values.Set("signature", r.Signature)
+	return MailboxAuthScheme + " " + values.Encode()
+}
+
+// VerifyRequest checks the signature of the request using the owners key,
+// and that it was created no more than maxAge before now and not after it.
+// The caller must also check that the nonce has not been seen within maxAge.
+func (r *MailboxRequest) VerifyRequest(keys Keyring, now time.Time, maxAge time.Duration) error {
+	age := now.Sub(r.Requested)
+	if age > maxAge || age < 0 {
+		return ErrStaleMailboxRequest
+	}
+
+	v, err := verifierFor(keys, r.Owner, r.Algorithm)
+	if err != nil {
+		return err
+	}
+
+	receivedSignatureData, err := hex.DecodeString(r.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode the requests signature: %w", err)
+	}
+
+	err = v.Verify(r.requestDataForSigning(), receivedSignatureData)
+	if err != nil {
+		return fmt.Errorf("signature of mailbox request is invalid: %w", err)
+	}
+	return nil
+}
+
+// BodyDigest returns the hex encoded sha256 of a request body, as signed by mailbox requests
+func BodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// requestDataForSigning is an internal function to prepare data for creating a signature
+func (r *MailboxRequest) requestDataForSigning() []byte {
+	e := newCanonicalEncoder(canonicalMailboxDomain)
+	e.writeString(1, r.Owner.Name)
+	e.writeString(2, r.Owner.Vessel)
+	e.writeTime(3, r.Requested)
+	e.writeOptionalString(4, r.Algorithm)
+	e.writeString(5, r.Method)
+	e.writeString(6, r.Target)
+	e.writeString(7, r.BodyDigest)
+	e.writeString(8, r.Nonce)
+	return e.bytes()
+}
+
+// hmacSum returns the hmac-sha256 of data using the secret key
+func hmacSum(data, secretKey []byte) ([]byte, error) {
+	h := hmac.New(sha256.New, secretKey)
+	_, err := h.Write(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write data to hmac: %w", err)
+	}
+
+	return h.Sum(nil), nil
+}
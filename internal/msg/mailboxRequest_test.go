@@ -0,0 +1,167 @@
+package msg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var mailboxSecretKey = []byte("GgfY0UssupyYBlFy92/ENsq5/Qy8dq3bh3Mp8hZcPMDEdSnxMgi5E1TPzJuHVHzRs60aq6r7gKyLGwbauaUn1Q==")
+
+var mailboxKeys = &testKeyring{
+	secretKeys: map[UserVessel][]byte{
+		{Name: "Bob", Vessel: "Snow"}: mailboxSecretKey,
+	},
+}
+
+var mailboxAckBody = []byte(`{"leases":[1,2]}`)
+
+func TestMailboxRequestRoundTrip(t *testing.T) {
+	owner := UserVessel{Name: "Bob", Vessel: "Snow"}
+
+	req, err := NewMailboxRequest(owner, NewHMACSigner(mailboxSecretKey), "POST", "/ack-messages", mailboxAckBody)
+	if err != nil {
+		t.Fatalf("Unable to create mailbox request due to: %q", err)
+	}
+
+	// sending through the authorization header
+	parsedReq, err := ParseMailboxRequest(req.Authorization(), "POST", "/ack-messages", mailboxAckBody)
+	if err != nil {
+		t.Fatalf("Unable to parse mailbox request due to: %q", err)
+	}
+	if parsedReq.Owner != owner {
+		t.Errorf("owner mismatch. got=%q want=%q", parsedReq.Owner.String(), owner.String())
+	}
+	if parsedReq.Nonce != req.Nonce {
+		t.Errorf("nonce mismatch. got=%q want=%q", parsedReq.Nonce, req.Nonce)
+	}
+
+	err = parsedReq.VerifyRequest(mailboxKeys, time.Now(), time.Minute)
+	if err != nil {
+		t.Errorf("Did not expect error: got=%q", err)
+	}
+}
+
+func TestMailboxRequestNonceIsUnique(t *testing.T) {
+	owner := UserVessel{Name: "Bob", Vessel: "Snow"}
+	signer := NewHMACSigner(mailboxSecretKey)
+
+	first, err := NewMailboxRequest(owner, signer, "GET", "/get-messages", nil)
+	if err != nil {
+		t.Fatalf("Unable to create mailbox request due to: %q", err)
+	}
+	second, err := NewMailboxRequest(owner, signer, "GET", "/get-messages", nil)
+	if err != nil {
+		t.Fatalf("Unable to create mailbox request due to: %q", err)
+	}
+	if first.Nonce == second.Nonce {
+		t.Errorf("Expected every request to have its own nonce. got=%q", first.Nonce)
+	}
+}
+
+func TestMailboxRequestVerify(t *testing.T) {
+	owner := UserVessel{Name: "Bob", Vessel: "Snow"}
+
+	tt := []struct {
+		name  string
+		alter func(req *MailboxRequest)
+		// how long after the request it is verified
+		after   time.Duration
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			alter:   func(req *MailboxRequest) {},
+			wantErr: false,
+		},
+		{
+			name:    "different owner",
+			alter:   func(req *MailboxRequest) { req.Owner.Name = "Kevin" },
+			wantErr: true,
+		},
+		{
+			name:    "stale",
+			alter:   func(req *MailboxRequest) {},
+			after:   time.Hour,
+			wantErr: true,
+		},
+		{
+			name:    "from the future",
+			alter:   func(req *MailboxRequest) {},
+			after:   -time.Second,
+			wantErr: true,
+		},
+		{
+			name:    "bad signature",
+			alter:   func(req *MailboxRequest) { req.Signature = "zz" },
+			wantErr: true,
+		},
+		{
+			name:    "different method",
+			alter:   func(req *MailboxRequest) { req.Method = "GET" },
+			wantErr: true,
+		},
+		{
+			name:    "different target",
+			alter:   func(req *MailboxRequest) { req.Target = "/get-messages" },
+			wantErr: true,
+		},
+		{
+			name:    "different body",
+			alter:   func(req *MailboxRequest) { req.BodyDigest = BodyDigest([]byte(`{"leases":[3]}`)) },
+			wantErr: true,
+		},
+		{
+			name:    "different nonce",
+			alter:   func(req *MailboxRequest) { req.Nonce = strings.Repeat("0", 32) },
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tt {
+		req, err := NewMailboxRequest(owner, NewHMACSigner(mailboxSecretKey), "POST", "/ack-messages", mailboxAckBody)
+		if err != nil {
+			t.Fatalf("Unable to create mailbox request due to: %q", err)
+		}
+
+		tc.alter(req)
+		gotErr := req.VerifyRequest(mailboxKeys, time.Now().Add(tc.after), time.Minute)
+		if tc.wantErr && gotErr == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+		if !tc.wantErr && gotErr != nil {
+			t.Errorf("%s: did not expect error: got=%q", tc.name, gotErr)
+		}
+	}
+}
+
+func TestParseMailboxRequestMissingField(t *testing.T) {
+	req, err := NewMailboxRequest(UserVessel{Name: "Bob", Vessel: "Snow"}, NewHMACSigner(mailboxSecretKey), "GET", "/get-messages", nil)
+	if err != nil {
+		t.Fatalf("Unable to create mailbox request due to: %q", err)
+	}
+
+	tt := []struct {
+		name          string
+		authorization string
+		wantField     string
+	}{
+		{name: "no header", authorization: "", wantField: "Authorization"},
+		{name: "other scheme", authorization: "Bearer token", wantField: "Authorization"},
+		{name: "no signature", authorization: strings.Replace(req.Authorization(), "signature=", "sig=", 1), wantField: "signature"},
+		{name: "no nonce", authorization: strings.Replace(req.Authorization(), "nonce=", "n=", 1), wantField: "nonce"},
+	}
+
+	for _, tc := range tt {
+		_, gotErr := ParseMailboxRequest(tc.authorization, "GET", "/get-messages", nil)
+		var gotAsError *MissingFieldError
+		if !errors.As(gotErr, &gotAsError) {
+			t.Errorf("%s: expected a MissingFieldError, but got %v (type %T)", tc.name, gotErr, gotErr)
+			continue
+		}
+		if gotAsError.Field != tc.wantField {
+			t.Errorf("%s: MissingFieldError field mismatch: got=%q, want=%q", tc.name, gotAsError.Field, tc.wantField)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package msg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// message ids are ULIDs, a 48 bit millisecond timestamp followed by 80 random bits,
+// written as 26 characters of Crockford's base32 so that they sort by time
+const (
+	messageIDLength   = 26
+	messageIDAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// idGenerator keeps ids created within the same millisecond in order
+// by incrementing the random part instead of drawing a new one
+type idGenerator struct {
+	lastMs   uint64
+	lastRand [10]byte
+	mux      sync.Mutex
+}
+
+var messageIDs = &idGenerator{}
+
+// *** Functions ***
+
+// NewMessageID returns a new globally unique message id that sorts by creation time
+func NewMessageID() (string, error) {
+	return messageIDs.next(time.Now())
+}
+
+// LegacyMessageID returns an id for a message packaged before ids were added. It is made from
+// the time the message was packaged and its signature, so a message sent again gets the same id.
+func LegacyMessageID(m *PackagedMessage) string {
+	ms := uint64(max(m.Packaged.UnixMilli(), 0))
+	sum := sha256.Sum256([]byte(m.Signature))
+
+	var idData [16]byte
+	binary.BigEndian.PutUint16(idData[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(idData[2:6], uint32(ms))
+	copy(idData[6:], sum[:10])
+
+	return encodeMessageID(idData)
+}
+
+// IsValidMessageID reports whether id is a well formed message id
+func IsValidMessageID(id string) bool {
+	if len(id) != messageIDLength {
+		return false
+	}
+	// the first character only holds 3 bits
+	if id[0] > '7' {
+		return false
+	}
+	for i := range len(id) {
+		if strings.IndexByte(messageIDAlphabet, id[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// next creates the id for the time given
+func (gen *idGenerator) next(now time.Time) (string, error) {
+	ms := uint64(now.UnixMilli())
+
+	gen.mux.Lock()
+	defer gen.mux.Unlock()
+
+	if ms <= gen.lastMs {
+		// same millisecond, or the clock went backwards
+		ms = gen.lastMs
+		if !incrementBytes(gen.lastRand[:]) {
+			return "", fmt.Errorf("too many message ids created within one millisecond")
+		}
+	} else {
+		_, err := rand.Read(gen.lastRand[:])
+		if err != nil {
+			return "", fmt.Errorf("unable to read random data for message id: %w", err)
+		}
+		gen.lastMs = ms
+	}
+
+	var idData [16]byte
+	binary.BigEndian.PutUint16(idData[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(idData[2:6], uint32(ms))
+	copy(idData[6:], gen.lastRand[:])
+
+	return encodeMessageID(idData), nil
+}
+
+// incrementBytes adds one to a big endian number, returning false on overflow
+func incrementBytes(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeMessageID writes 128 bits as 26 base32 characters
+func encodeMessageID(idData [16]byte) string {
+	hi := binary.BigEndian.Uint64(idData[0:8])
+	lo := binary.BigEndian.Uint64(idData[8:16])
+
+	var id [messageIDLength]byte
+	for i := messageIDLength - 1; i >= 0; i-- {
+		id[i] = messageIDAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id[:])
+}
@@ -0,0 +1,100 @@
+package msg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewMessageID(t *testing.T) {
+	seen := make(map[string]bool)
+	lastID := ""
+
+	for range 1000 {
+		id, err := NewMessageID()
+		if err != nil {
+			t.Fatalf("Unable to create message id due to: %q", err)
+		}
+
+		if !IsValidMessageID(id) {
+			t.Errorf("Created an invalid message id: %q", id)
+		}
+		if seen[id] {
+			t.Errorf("Created a duplicate message id: %q", id)
+		}
+		if id <= lastID {
+			t.Errorf("Message ids should sort by creation. got=%q after=%q", id, lastID)
+		}
+
+		seen[id] = true
+		lastID = id
+	}
+}
+
+func TestMessageIDSortsByTime(t *testing.T) {
+	gen := &idGenerator{}
+	earlier := time.Date(2025, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	firstID, err := gen.next(earlier)
+	if err != nil {
+		t.Fatalf("Unable to create message id due to: %q", err)
+	}
+	secondID, err := gen.next(earlier.Add(time.Millisecond))
+	if err != nil {
+		t.Fatalf("Unable to create message id due to: %q", err)
+	}
+	// clock going backwards should still sort after
+	thirdID, err := gen.next(earlier)
+	if err != nil {
+		t.Fatalf("Unable to create message id due to: %q", err)
+	}
+
+	if !(firstID < secondID && secondID < thirdID) {
+		t.Errorf("Message ids out of order. got=%q, %q, %q", firstID, secondID, thirdID)
+	}
+
+	// the first 10 characters hold the timestamp
+	if firstID[:10] != "01JWNNSVG0" {
+		t.Errorf("Message id timestamp mismatch. got=%q want=%q", firstID[:10], "01JWNNSVG0")
+	}
+}
+
+func TestIsValidMessageID(t *testing.T) {
+	tt := []struct {
+		id   string
+		want bool
+	}{
+		{id: "01J9ZQ4V2V8D0RZ3X6N5K4M2QA", want: true},
+		{id: "01J9ZQ4V2V8D0RZ3X6N5K4M2Q", want: false},  // too short
+		{id: "01J9ZQ4V2V8D0RZ3X6N5K4M2QU", want: false}, // U is not in the alphabet
+		{id: "81J9ZQ4V2V8D0RZ3X6N5K4M2QA", want: false}, // overflows 128 bits
+		{id: "", want: false},
+	}
+
+	for _, tc := range tt {
+		if got := IsValidMessageID(tc.id); got != tc.want {
+			t.Errorf("IsValidMessageID(%q) mismatch. got=%t want=%t", tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestLegacyMessageID(t *testing.T) {
+	pkgMsg := PackagedMessage{
+		Signature: "7401dff71678d5d8aa8eb46724b39b0d83a65c61e1b679e51e6b7b2d76e37c63",
+		Packaged:  time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	id := LegacyMessageID(&pkgMsg)
+	if !IsValidMessageID(id) {
+		t.Errorf("Created an invalid message id: %q", id)
+	}
+	// sending the same message again must not deliver it twice
+	if again := LegacyMessageID(&pkgMsg); again != id {
+		t.Errorf("Expected the same id for the same message. got=%q want=%q", again, id)
+	}
+
+	other := pkgMsg
+	other.Signature = "1a936de118b68b1cea9469ec5cd22b7bd65bef71027eb35b88c931ad66eaa870"
+	if LegacyMessageID(&other) == id {
+		t.Errorf("Expected different messages to have different ids. got=%q", id)
+	}
+}
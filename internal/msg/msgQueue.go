@@ -1,26 +1,92 @@
 package msg
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
+// PackagedQueue delivers messages with a higher priority first,
+// and in the order they were enqueued within a priority.
+// A bounded queue holds at most its capacity of messages, counting leased
+// messages as well so that requeueing them never overflows.
 type PackagedQueue struct {
-	msgs []PackagedMessage
-	mux  *sync.Mutex
+	// a queue for each priority, indexed by priority.
+	// Only their unlocked functions are used, as they are guarded by mux
+	levels [priorityLevels]Queue[PackagedMessage]
+	leases map[uint64]Lease
+	// counts up with every lease, to keep leases in the order they were reserved
+	reserved uint64
+	// unbounded when capacity is 0
+	capacity int
+	overflow OverflowPolicy
+	// closed whenever the queue changes to wake anyone waiting on it,
+	// and only made while someone is waiting
+	changed chan struct{}
+	mux     *sync.Mutex
+}
+
+// OverflowPolicy is what a bounded queue does with a message that does not fit
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for room in the queue
+	OverflowBlock OverflowPolicy = iota
+	// OverflowReject turns the message away with ErrQueueFull
+	OverflowReject
+	// OverflowDropOldest drops the oldest message of the lowest priority to make room.
+	// A message is never dropped for a less urgent one, which is rejected instead.
+	OverflowDropOldest
+)
+
+// ErrQueueFull is returned when a message does not fit into a bounded queue
+var ErrQueueFull = errors.New("queue is full")
+
+// Lease is a message that has been reserved from the queue.
+// It is out of the queue until it is either committed or requeued.
+// Lease ids are random, so that only whoever was given a lease can commit it.
+type Lease struct {
+	ID       uint64
+	Message  PackagedMessage
+	Reserved time.Time
+	// the order the lease was reserved in
+	seq uint64
 }
 
 func NewQueue() *PackagedQueue {
-	pkgQueue := make([]PackagedMessage, 0)
+	leases := make(map[uint64]Lease)
 	mux := &sync.Mutex{}
 
-	return &PackagedQueue{msgs: pkgQueue, mux: mux}
+	return &PackagedQueue{leases: leases, mux: mux}
+}
+
+// NewBoundedQueue creates a queue that holds at most capacity messages,
+// handling any more with the overflow policy
+func NewBoundedQueue(capacity int, overflow OverflowPolicy) *PackagedQueue {
+	q := NewQueue()
+	q.SetCapacity(capacity, overflow)
+	return q
+}
+
+// SetCapacity bounds the queue to capacity messages, or unbounds it when capacity is 0.
+// Messages already held beyond the capacity are kept, and new messages overflow until there is room.
+func (q *PackagedQueue) SetCapacity(capacity int, overflow OverflowPolicy) {
+	q.mux.Lock()
+	q.capacity = max(capacity, 0)
+	q.overflow = overflow
+	q.notify()
+	q.mux.Unlock()
 }
 
 func (q *PackagedQueue) Size() int {
 	q.mux.Lock()
-	qLen := len(q.msgs)
+	qLen := q.size()
 	q.mux.Unlock()
 
 	return qLen
@@ -28,48 +94,398 @@ func (q *PackagedQueue) Size() int {
 
 func (q *PackagedQueue) IsEmpty() bool {
 	q.mux.Lock()
-	isEmpty := len(q.msgs) == 0
+	isEmpty := q.size() == 0
 	q.mux.Unlock()
 
 	return isEmpty
 }
 
-func (q *PackagedQueue) Enqueue(newMsg PackagedMessage) {
-	// naive implementation, reallocs a slice every call
+// Enqueue adds a message to the back of its priority. A bounded queue that is full
+// blocks, rejects it with ErrQueueFull, or drops an older message which is not returned.
+// Use EnqueueWait to bound how long it blocks, or to find out what was dropped.
+func (q *PackagedQueue) Enqueue(newMsg PackagedMessage) error {
+	_, err := q.EnqueueWait(context.Background(), newMsg)
+	return err
+}
+
+// EnqueueWait adds a message to the back of its priority. When a bounded queue is full
+// it handles the message with the overflow policy, blocking until there is room or ctx is done.
+// Returns any message dropped to make room.
+func (q *PackagedQueue) EnqueueWait(ctx context.Context, newMsg PackagedMessage) ([]PackagedMessage, error) {
+	for {
+		q.mux.Lock()
+		if q.hasRoom() {
+			q.push(newMsg)
+			q.mux.Unlock()
+			return nil, nil
+		}
+
+		switch q.overflow {
+		case OverflowReject:
+			q.mux.Unlock()
+			return nil, ErrQueueFull
+
+		case OverflowDropOldest:
+			dropped, ok := q.dropOldest(newMsg.Priority)
+			if !ok {
+				q.mux.Unlock()
+				return nil, ErrQueueFull
+			}
+			q.push(newMsg)
+			q.mux.Unlock()
+			return []PackagedMessage{dropped}, nil
+		}
+
+		// block until something changes, then try again
+		changed := q.waitForChange()
+		q.mux.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (q *PackagedQueue) Dequeue() (PackagedMessage, bool) {
+	// checked and taken under one lock, so two consumers cannot race for the last message
 	q.mux.Lock()
-	q.msgs = append(q.msgs, newMsg)
+	nextMsg, ok := q.popFront()
 	q.mux.Unlock()
+
+	return nextMsg, ok
 }
 
-func (q *PackagedQueue) Dequeue() (PackagedMessage, bool) {
-	// in order to increase efficiency look into:
-	// - ring buffers or linked lists
-	if q.IsEmpty() {
+// DequeueWait removes the next message, waiting for one to arrive if the queue is empty.
+// Returns ctx's error if it is done first.
+func (q *PackagedQueue) DequeueWait(ctx context.Context) (PackagedMessage, error) {
+	for {
+		q.mux.Lock()
+		nextMsg, ok := q.popFront()
+		changed := q.waitForChange()
+		q.mux.Unlock()
+		if ok {
+			return nextMsg, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return PackagedMessage{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Reserve takes the next message out of the queue under a lease.
+// The message must later be passed to Commit or Requeue.
+func (q *PackagedQueue) Reserve() (Lease, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return q.reserve()
+}
+
+// ReserveWait takes the next message out of the queue under a lease, waiting for one
+// to arrive if the queue is empty. Returns ctx's error if it is done first.
+func (q *PackagedQueue) ReserveWait(ctx context.Context) (Lease, error) {
+	for {
+		q.mux.Lock()
+		lease, ok := q.reserve()
+		changed := q.waitForChange()
+		q.mux.Unlock()
+		if ok {
+			return lease, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return Lease{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Wait waits until the queue has a message to take, without taking it.
+// Another consumer may take the message first. Returns ctx's error if it is done first.
+func (q *PackagedQueue) Wait(ctx context.Context) error {
+	for {
+		q.mux.Lock()
+		ready := q.size() > 0
+		var changed <-chan struct{}
+		if !ready {
+			changed = q.waitForChange()
+		}
+		q.mux.Unlock()
+		if ready {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// reserve leases the next message, q.mux must be held
+func (q *PackagedQueue) reserve() (Lease, bool) {
+	nextMsg, ok := q.popFront()
+	if !ok {
+		return Lease{}, false
+	}
+
+	q.reserved++
+	lease := Lease{
+		ID:       q.newLeaseID(),
+		Message:  nextMsg,
+		Reserved: time.Now().UTC(),
+		seq:      q.reserved,
+	}
+	q.leases[lease.ID] = lease
+
+	return lease, true
+}
+
+// newLeaseID returns a random lease id that is not already held, q.mux must be held
+func (q *PackagedQueue) newLeaseID() uint64 {
+	for {
+		var idData [8]byte
+		// never fails, and crashes the program rather than returning predictable data
+		rand.Read(idData[:])
+
+		id := binary.BigEndian.Uint64(idData[:])
+		if _, held := q.leases[id]; id != 0 && !held {
+			return id
+		}
+	}
+}
+
+// Commit removes a leased message for good, returning the message.
+// Returns false if there is no such lease.
+func (q *PackagedQueue) Commit(leaseID uint64) (PackagedMessage, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	lease, ok := q.leases[leaseID]
+	if !ok {
 		return PackagedMessage{}, false
 	}
+	delete(q.leases, leaseID)
+	q.notify()
 
+	return lease.Message, true
+}
+
+// Requeue places a leased message back at the front of its priority in the queue.
+// Returns false if there is no such lease.
+func (q *PackagedQueue) Requeue(leaseID uint64) bool {
 	q.mux.Lock()
-	nextMsg := q.msgs[0]
+	defer q.mux.Unlock()
+
+	lease, ok := q.leases[leaseID]
+	if !ok {
+		return false
+	}
+	delete(q.leases, leaseID)
+
+	q.levels[q.level(lease.Message.Priority)].enqueueFront(lease.Message)
+	q.notify()
+	return true
+}
+
+// RequeueExpired requeues every lease reserved more than timeout ago,
+// keeping them in the order they were reserved. Returns how many were requeued.
+func (q *PackagedQueue) RequeueExpired(timeout time.Duration) int {
+	cutoff := time.Now().UTC().Add(-timeout)
 
-	// reslicing the queue, not efficient but functional
-	q.msgs = q.msgs[1:]
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	var expired []Lease
+	for _, lease := range q.leases {
+		if !lease.Reserved.After(cutoff) {
+			expired = append(expired, lease)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].seq < expired[j].seq })
+
+	// requeue newest first so that the oldest ends up at the front
+	for i := len(expired) - 1; i >= 0; i-- {
+		delete(q.leases, expired[i].ID)
+		q.levels[q.level(expired[i].Message.Priority)].enqueueFront(expired[i].Message)
+	}
+	if len(expired) > 0 {
+		q.notify()
+	}
+	return len(expired)
+}
+
+// RemoveExpired takes every message that has expired by now out of the queue,
+// returning them in the order they would have been delivered.
+// Leased messages are left to whoever holds the lease.
+func (q *PackagedQueue) RemoveExpired(now time.Time) []PackagedMessage {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	var expired []PackagedMessage
+	for level := len(q.levels) - 1; level >= 0; level-- {
+		expired = append(expired, q.levels[level].removeFunc(func(msg PackagedMessage) bool {
+			return msg.IsExpired(now)
+		})...)
+	}
+	if len(expired) > 0 {
+		q.notify()
+	}
+
+	return expired
+}
+
+// Contains reports whether a message with the id from the sender is waiting in the queue, or reserved from it
+func (q *PackagedQueue) Contains(from UserVessel, id string) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	for _, lease := range q.leases {
+		if lease.Message.ID == id && lease.Message.From == from {
+			return true
+		}
+	}
+	for level := range q.levels {
+		for i := range q.levels[level].len() {
+			if pkgMsg := q.levels[level].at(i); pkgMsg.ID == id && pkgMsg.From == from {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// InFlight returns the number of messages that are reserved but not committed
+func (q *PackagedQueue) InFlight() int {
+	q.mux.Lock()
+	inFlight := len(q.leases)
+	q.mux.Unlock()
+
+	return inFlight
+}
+
+// Leases returns the outstanding leases in the order they were reserved
+func (q *PackagedQueue) Leases() []Lease {
+	q.mux.Lock()
+	leases := make([]Lease, 0, len(q.leases))
+	for _, lease := range q.leases {
+		leases = append(leases, lease)
+	}
+	q.mux.Unlock()
+
+	sort.Slice(leases, func(i, j int) bool { return leases[i].seq < leases[j].seq })
+	return leases
+}
+
+// Messages returns a copy of the messages in the queue, in the order
+// they would be delivered, without removing them
+func (q *PackagedQueue) Messages() []PackagedMessage {
+	q.mux.Lock()
+	msgs := make([]PackagedMessage, 0, q.size())
+	for level := len(q.levels) - 1; level >= 0; level-- {
+		msgs = q.levels[level].appendTo(msgs)
+	}
 	q.mux.Unlock()
 
-	return nextMsg, true
+	return msgs
 }
 
 func (q *PackagedQueue) QueueSummary() string {
-	if q.IsEmpty() {
+	msgs := q.Messages()
+	if len(msgs) == 0 {
 		return "Queue is empty.\n"
 	}
 
-	q.mux.Lock()
 	var subjects []string
-	for _, msg := range q.msgs {
-		subjects = append(subjects, msg.Subject)
+	for _, msg := range msgs {
+		// encrypted subjects are not worth printing
+		subject := msg.Subject
+		if msg.EncryptedSubject {
+			subject = "(encrypted)"
+		}
+		// routine messages are the norm, so only other priorities are shown
+		if msg.Priority != PriorityRoutine {
+			subject = fmt.Sprintf("[%s] %s", strings.ToUpper(msg.Priority.String()), subject)
+		}
+		subjects = append(subjects, subject)
 	}
-	q.mux.Unlock()
 
 	subjectSummary := strings.Join(subjects, " || ")
-	return fmt.Sprintf("%d messages in queue\nMessage subjects: %s\n", len(q.msgs), subjectSummary)
+	return fmt.Sprintf("%d messages in queue\nMessage subjects: %s\n", len(msgs), subjectSummary)
+}
+
+// size returns the number of messages waiting in every priority, q.mux must be held
+func (q *PackagedQueue) size() int {
+	size := 0
+	for i := range q.levels {
+		size += q.levels[i].len()
+	}
+	return size
+}
+
+// popFront removes the first message of the highest priority that has one, q.mux must be held
+func (q *PackagedQueue) popFront() (PackagedMessage, bool) {
+	for level := len(q.levels) - 1; level >= 0; level-- {
+		nextMsg, ok := q.levels[level].dequeue()
+		if ok {
+			q.notify()
+			return nextMsg, true
+		}
+	}
+	return PackagedMessage{}, false
+}
+
+// push adds a message to the back of its priority, q.mux must be held
+func (q *PackagedQueue) push(newMsg PackagedMessage) {
+	q.levels[q.level(newMsg.Priority)].enqueue(newMsg)
+	q.notify()
+}
+
+// hasRoom reports whether another message fits, q.mux must be held
+func (q *PackagedQueue) hasRoom() bool {
+	return q.capacity == 0 || q.size()+len(q.leases) < q.capacity
+}
+
+// dropOldest removes the oldest message of the lowest priority, as long as
+// it is not more urgent than priority. q.mux must be held
+func (q *PackagedQueue) dropOldest(priority Priority) (PackagedMessage, bool) {
+	for level := 0; level <= q.level(priority); level++ {
+		dropped, ok := q.levels[level].dequeue()
+		if ok {
+			return dropped, true
+		}
+	}
+	return PackagedMessage{}, false
+}
+
+// waitForChange returns a channel that is closed when the queue next changes, q.mux must be held
+func (q *PackagedQueue) waitForChange() <-chan struct{} {
+	if q.changed == nil {
+		q.changed = make(chan struct{})
+	}
+	return q.changed
+}
+
+// notify wakes everyone waiting for the queue to change, q.mux must be held
+func (q *PackagedQueue) notify() {
+	if q.changed != nil {
+		close(q.changed)
+		q.changed = nil
+	}
+}
+
+// level returns where messages of the priority are queued,
+// unknown priorities are queued as routine
+func (q *PackagedQueue) level(priority Priority) int {
+	if !priority.IsValid() {
+		return int(PriorityRoutine)
+	}
+	return int(priority)
 }
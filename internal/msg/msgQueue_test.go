@@ -1,6 +1,13 @@
 package msg
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
 
 var queueSecretKey = []byte("GgfY0UssupyYBlFy92/ENsq5/Qy8dq3bh3Mp8hZcPMDEdSnxMgi5E1TPzJuHVHzRs60aq6r7gKyLGwbauaUn1Q==")
 
@@ -198,43 +205,534 @@ func TestSizeAndEnqueueDequeueFunction(t *testing.T) {
 	}
 }
 
-// old benchmark code
-//
-// func BenchmarkQueueEnqueue(b *testing.B) {
-// 	msgExample, err := NewMessage("kevin", "bob", "important", "this is an example body", queueSecretKey)
-// 	if err != nil {
-// 		b.Errorf("Unable to create msg example due to: %q", err)
-// 	}
-//
-// 	for b.Loop() {
-// 		queue := NewQueue()
-// 		for range 1000 {
-// 			queue.Enqueue(*msgExample)
-// 		}
-// 	}
-// }
-//
-// func BenchmarkQueueDequeue(b *testing.B) {
-// 	msgExample, err := NewMessage("kevin", "bob", "important", "this is an example body", queueSecretKey)
-// 	if err != nil {
-// 		b.Errorf("Unable to create msg example due to: %q", err)
-// 	}
-//
-// 	for b.Loop() {
-// 		// not measuring queue setup
-// 		b.StopTimer()
-// 		queue := NewQueue()
-// 		for range 1000 {
-// 			queue.Enqueue(*msgExample)
-// 		}
-//
-// 		// measuring dequeue explicitly
-// 		b.StartTimer()
-// 		for range 1000 {
-// 			_, ok := queue.Dequeue()
-// 			if !ok {
-// 				b.Error("Unable to dequeue")
-// 			}
-// 		}
-// 	}
-// }
+// packageQueueMessages is a helper that packages a message for each subject
+func packageQueueMessages(t *testing.T, subjects ...string) []PackagedMessage {
+	t.Helper()
+
+	msgs := make([]PackagedMessage, 0)
+	for _, subject := range subjects {
+		rawMsg := RawMessage{
+			ToName:     "Bob",
+			ToVessel:   "Snow",
+			FromName:   "Kevin",
+			FromVessel: "Liberty",
+			Subject:    subject,
+			Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+		}
+		msg, err := rawMsg.ToPackagedMessage(queueSecretKey)
+		if err != nil {
+			t.Fatalf("Unable to make new message due to: %q", err)
+		}
+		msgs = append(msgs, *msg)
+	}
+	return msgs
+}
+
+func TestQueueMessages(t *testing.T) {
+	subjects := []string{"Tuesday", "Re: Tuesday", "Re: Re: Tuesday"}
+
+	queue := NewQueue()
+	for _, msg := range packageQueueMessages(t, subjects...) {
+		queue.Enqueue(msg)
+	}
+
+	msgs := queue.Messages()
+	if len(msgs) != len(subjects) {
+		t.Fatalf("Messages returned wrong count. got=%d want=%d", len(msgs), len(subjects))
+	}
+	for i, subject := range subjects {
+		if msgs[i].Subject != subject {
+			t.Errorf("Messages out of order. got=%q want=%q", msgs[i].Subject, subject)
+		}
+	}
+
+	// should not remove anything from the queue
+	if queue.Size() != len(subjects) {
+		t.Error("Messages should not change the size of the queue")
+	}
+}
+
+func TestQueueReserveCommit(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Re: Tuesday")
+
+	queue := NewQueue()
+	queue.Enqueue(msgs[0])
+	queue.Enqueue(msgs[1])
+
+	lease, ok := queue.Reserve()
+	if !ok {
+		t.Fatal("Unable to reserve message")
+	}
+	if lease.Message != msgs[0] {
+		t.Errorf("Reserved wrong message. got=%q want=%q", lease.Message.Subject, msgs[0].Subject)
+	}
+	if queue.Size() != 1 || queue.InFlight() != 1 {
+		t.Errorf("Reserved message should be in flight. size=%d inFlight=%d", queue.Size(), queue.InFlight())
+	}
+
+	committed, ok := queue.Commit(lease.ID)
+	if !ok {
+		t.Fatal("Unable to commit lease")
+	}
+	if committed != msgs[0] {
+		t.Errorf("Committed wrong message. got=%q want=%q", committed.Subject, msgs[0].Subject)
+	}
+	if queue.InFlight() != 0 {
+		t.Error("Committed message should not be in flight")
+	}
+
+	// committing twice should fail
+	_, ok = queue.Commit(lease.ID)
+	if ok {
+		t.Error("Committing a lease twice should not be ok")
+	}
+}
+
+func TestQueueLeaseIDsCannotBeGuessed(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Re: Tuesday", "Wednesday")
+
+	queue := NewQueue()
+	for _, pkgMsg := range msgs {
+		queue.Enqueue(pkgMsg)
+	}
+
+	var leases []Lease
+	for range msgs {
+		lease, ok := queue.Reserve()
+		if !ok {
+			t.Fatal("Unable to reserve message")
+		}
+		leases = append(leases, lease)
+	}
+
+	// neighbouring ids of a lease that was handed out are not leases
+	for _, lease := range leases {
+		for _, guess := range []uint64{lease.ID - 1, lease.ID + 1} {
+			if _, ok := queue.Commit(guess); ok {
+				t.Errorf("Committed a guessed lease id %d", guess)
+			}
+		}
+	}
+	if queue.InFlight() != len(msgs) {
+		t.Errorf("Guessing should not commit anything. inFlight=%d", queue.InFlight())
+	}
+
+	// leases still come back in the order they were reserved
+	for i, lease := range queue.Leases() {
+		if lease.ID != leases[i].ID {
+			t.Errorf("Lease %d out of order. got=%q want=%q", i, lease.Message.Subject, leases[i].Message.Subject)
+		}
+	}
+}
+
+func TestQueueReserveRequeue(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Re: Tuesday")
+
+	queue := NewQueue()
+	queue.Enqueue(msgs[0])
+	queue.Enqueue(msgs[1])
+
+	lease, ok := queue.Reserve()
+	if !ok {
+		t.Fatal("Unable to reserve message")
+	}
+
+	if !queue.Requeue(lease.ID) {
+		t.Fatal("Unable to requeue lease")
+	}
+	if queue.Size() != 2 || queue.InFlight() != 0 {
+		t.Errorf("Requeued message should be back in queue. size=%d inFlight=%d", queue.Size(), queue.InFlight())
+	}
+
+	// requeued message should be at the front
+	nextMsg, ok := queue.Dequeue()
+	if !ok || nextMsg != msgs[0] {
+		t.Errorf("Requeued message should be at the front. got=%q want=%q", nextMsg.Subject, msgs[0].Subject)
+	}
+}
+
+func TestQueueRequeueExpired(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Re: Tuesday", "Re: Re: Tuesday")
+
+	queue := NewQueue()
+	for _, msg := range msgs {
+		queue.Enqueue(msg)
+	}
+
+	first, _ := queue.Reserve()
+	second, _ := queue.Reserve()
+
+	// nothing has been reserved for an hour
+	if requeued := queue.RequeueExpired(time.Hour); requeued != 0 {
+		t.Errorf("No leases should have expired. got=%d", requeued)
+	}
+
+	requeued := queue.RequeueExpired(0)
+	if requeued != 2 {
+		t.Errorf("Both leases should have expired. got=%d", requeued)
+	}
+
+	// original order should be kept
+	wantOrder := []PackagedMessage{first.Message, second.Message, msgs[2]}
+	for _, want := range wantOrder {
+		got, ok := queue.Dequeue()
+		if !ok || got != want {
+			t.Errorf("Requeued messages out of order. got=%q want=%q", got.Subject, want.Subject)
+		}
+	}
+}
+
+func TestQueueRemoveExpired(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Re: Tuesday", "Re: Re: Tuesday", "Cambridge Bay")
+	now := time.Now().UTC()
+	msgs[0].Expires = now.Add(-time.Minute)
+	msgs[2].Expires = now
+	msgs[3].Expires = now.Add(time.Minute)
+
+	queue := NewQueue()
+	for _, msg := range msgs {
+		queue.Enqueue(msg)
+	}
+
+	expired := queue.RemoveExpired(now)
+	if len(expired) != 2 || expired[0] != msgs[0] || expired[1] != msgs[2] {
+		t.Fatalf("Expired messages mismatch. got=%d want=%d", len(expired), 2)
+	}
+
+	wantOrder := []PackagedMessage{msgs[1], msgs[3]}
+	for _, want := range wantOrder {
+		got, ok := queue.Dequeue()
+		if !ok || got != want {
+			t.Errorf("Remaining messages out of order. got=%q want=%q", got.Subject, want.Subject)
+		}
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Re: Tuesday", "Taking on water", "Ice ahead", "Re: Re: Tuesday")
+	msgs[2].Priority = PriorityDistress
+	msgs[3].Priority = PriorityUrgent
+
+	queue := NewQueue()
+	for _, msg := range msgs {
+		queue.Enqueue(msg)
+	}
+
+	wantOrder := []PackagedMessage{msgs[2], msgs[3], msgs[0], msgs[1], msgs[4]}
+	got := queue.Messages()
+	for i, want := range wantOrder {
+		if got[i] != want {
+			t.Errorf("Messages out of priority order at %d. got=%q want=%q", i, got[i].Subject, want.Subject)
+		}
+	}
+
+	// a requeued message goes back to the front of its own priority
+	distress, _ := queue.Reserve()
+	urgent, _ := queue.Reserve()
+	routine, _ := queue.Reserve()
+	queue.Requeue(routine.ID)
+	queue.Requeue(distress.ID)
+
+	// a later distress message still goes ahead of routine messages
+	later := packageQueueMessages(t, "Man overboard")[0]
+	later.Priority = PriorityDistress
+	queue.Enqueue(later)
+
+	wantOrder = []PackagedMessage{distress.Message, later, routine.Message, msgs[1], msgs[4]}
+	for _, want := range wantOrder {
+		got, ok := queue.Dequeue()
+		if !ok || got != want {
+			t.Errorf("Messages out of priority order. got=%q want=%q", got.Subject, want.Subject)
+		}
+	}
+	committed, ok := queue.Commit(urgent.ID)
+	if !ok || committed != msgs[3] {
+		t.Error("Unable to commit urgent lease")
+	}
+}
+
+func TestQueueConcurrentConsumers(t *testing.T) {
+	const producers, perProducer = 4, 500
+	msgs := numberedMessages(producers * perProducer)
+
+	queue := NewQueue()
+	var producing sync.WaitGroup
+	for p := range producers {
+		producing.Add(1)
+		go func() {
+			defer producing.Done()
+			for _, msg := range msgs[p*perProducer : (p+1)*perProducer] {
+				queue.Enqueue(msg)
+			}
+		}()
+	}
+
+	// consumers race for every message, each should be taken exactly once
+	seen := make(chan PackagedMessage, len(msgs))
+	var consuming sync.WaitGroup
+	for range 4 {
+		consuming.Add(1)
+		go func() {
+			defer consuming.Done()
+			for len(seen) < len(msgs) {
+				msg, ok := queue.Dequeue()
+				if ok {
+					seen <- msg
+				}
+			}
+		}()
+	}
+
+	producing.Wait()
+	consuming.Wait()
+	close(seen)
+
+	counts := make(map[string]int)
+	for msg := range seen {
+		counts[msg.Subject]++
+	}
+	for _, msg := range msgs {
+		if counts[msg.Subject] != 1 {
+			t.Errorf("Message %q dequeued %d times", msg.Subject, counts[msg.Subject])
+		}
+	}
+	if !queue.IsEmpty() {
+		t.Errorf("Queue should be empty. size=%d", queue.Size())
+	}
+}
+
+func TestBoundedQueueOverflow(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Re: Tuesday", "Re: Re: Tuesday")
+
+	rejecting := NewBoundedQueue(2, OverflowReject)
+	rejecting.Enqueue(msgs[0])
+	lease, _ := rejecting.Reserve()
+	rejecting.Enqueue(msgs[1])
+
+	// leased messages take up room until they are committed
+	err := rejecting.Enqueue(msgs[2])
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Full queue should reject. got=%v", err)
+	}
+	rejecting.Commit(lease.ID)
+	err = rejecting.Enqueue(msgs[2])
+	if err != nil {
+		t.Errorf("Did not expect error: got=%q", err)
+	}
+
+	dropping := NewBoundedQueue(2, OverflowDropOldest)
+	dropping.Enqueue(msgs[0])
+	dropping.Enqueue(msgs[1])
+	dropped, err := dropping.EnqueueWait(context.Background(), msgs[2])
+	if err != nil || len(dropped) != 1 || dropped[0] != msgs[0] {
+		t.Fatalf("Oldest message should be dropped. dropped=%d err=%v", len(dropped), err)
+	}
+	got := dropping.Messages()
+	if len(got) != 2 || got[0] != msgs[1] || got[1] != msgs[2] {
+		t.Errorf("Newest messages should be kept. got=%d", len(got))
+	}
+
+	// urgent messages are never dropped for routine ones
+	urgent := NewBoundedQueue(1, OverflowDropOldest)
+	distress := msgs[0]
+	distress.Priority = PriorityDistress
+	urgent.Enqueue(distress)
+	err = urgent.Enqueue(msgs[1])
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Routine message should not push out a distress message. got=%v", err)
+	}
+	dropped, _ = urgent.EnqueueWait(context.Background(), distress)
+	if len(dropped) != 1 {
+		t.Errorf("Distress message should push out an older one. dropped=%d", len(dropped))
+	}
+}
+
+func TestBoundedQueueBlocks(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Re: Tuesday")
+
+	queue := NewBoundedQueue(1, OverflowBlock)
+	queue.Enqueue(msgs[0])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := queue.EnqueueWait(ctx, msgs[1])
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Full queue should block until the context is done. got=%v", err)
+	}
+
+	// making room lets the blocked message in
+	enqueued := make(chan error)
+	go func() {
+		enqueued <- queue.Enqueue(msgs[1])
+	}()
+	queue.Dequeue()
+	err = <-enqueued
+	if err != nil {
+		t.Errorf("Did not expect error: got=%q", err)
+	}
+	if queue.Size() != 1 {
+		t.Errorf("Size mismatch. got=%d want=%d", queue.Size(), 1)
+	}
+}
+
+func TestQueueDequeueWait(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday")
+
+	queue := NewQueue()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := queue.DequeueWait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Empty queue should wait until the context is done. got=%v", err)
+	}
+
+	// every waiter is woken, and only one of them gets the message
+	recieved := make(chan PackagedMessage, 3)
+	waitCtx, stopWaiting := context.WithCancel(context.Background())
+	var waiting sync.WaitGroup
+	for range 3 {
+		waiting.Add(1)
+		go func() {
+			defer waiting.Done()
+			msg, err := queue.DequeueWait(waitCtx)
+			if err == nil {
+				recieved <- msg
+			}
+		}()
+	}
+	queue.Enqueue(msgs[0])
+	got := <-recieved
+	stopWaiting()
+	waiting.Wait()
+	if len(recieved) != 0 {
+		t.Error("Message should only be dequeued once")
+	}
+	if got != msgs[0] {
+		t.Errorf("Message mismatch. got=%q want=%q", got.Subject, msgs[0].Subject)
+	}
+
+	// reserving waits the same way
+	go queue.Enqueue(msgs[0])
+	lease, err := queue.ReserveWait(context.Background())
+	if err != nil || lease.Message != msgs[0] {
+		t.Errorf("Unable to reserve message. err=%v", err)
+	}
+
+	// waiting leaves the message in the queue, a requeued message counts as arriving
+	go queue.Requeue(lease.ID)
+	err = queue.Wait(context.Background())
+	if err != nil || queue.Size() != 1 {
+		t.Errorf("Wait should return once there is a message, and leave it. size=%d err=%v", queue.Size(), err)
+	}
+}
+
+// benchmarks report the cost of a single message, which should stay
+// the same however large the backlog in the queue is
+
+func BenchmarkQueueEnqueue(b *testing.B) {
+	msgExample := packageBenchmarkMessage(b)
+
+	queue := NewQueue()
+	for b.Loop() {
+		queue.Enqueue(msgExample)
+	}
+}
+
+func BenchmarkQueueDequeue(b *testing.B) {
+	msgExample := packageBenchmarkMessage(b)
+
+	for _, backlog := range []int{10, 1_000, 100_000} {
+		b.Run(fmt.Sprintf("backlog=%d", backlog), func(b *testing.B) {
+			queue := NewQueue()
+			for range backlog {
+				queue.Enqueue(msgExample)
+			}
+
+			// each dequeue is matched by an enqueue to keep the backlog steady
+			for b.Loop() {
+				_, ok := queue.Dequeue()
+				if !ok {
+					b.Fatal("Unable to dequeue")
+				}
+				queue.Enqueue(msgExample)
+			}
+		})
+	}
+}
+
+func BenchmarkQueueConcurrent(b *testing.B) {
+	msgExample := packageBenchmarkMessage(b)
+
+	for _, backlog := range []int{10, 1_000, 100_000} {
+		b.Run(fmt.Sprintf("backlog=%d", backlog), func(b *testing.B) {
+			queue := NewQueue()
+			for range backlog {
+				queue.Enqueue(msgExample)
+			}
+
+			// every goroutine is both a producer and a consumer
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					queue.Enqueue(msgExample)
+					queue.Dequeue()
+				}
+			})
+		})
+	}
+}
+
+// packageBenchmarkMessage packages a single message to fill queues with
+func packageBenchmarkMessage(b *testing.B) PackagedMessage {
+	b.Helper()
+
+	rawMsg := RawMessage{
+		ToName:     "Bob",
+		ToVessel:   "Snow",
+		FromName:   "Kevin",
+		FromVessel: "Liberty",
+		Subject:    "important",
+		Body:       "this is an example body",
+	}
+	msg, err := rawMsg.ToPackagedMessage(queueSecretKey)
+	if err != nil {
+		b.Fatalf("Unable to create msg example due to: %q", err)
+	}
+	return *msg
+}
+
+func TestQueueContains(t *testing.T) {
+	msgs := packageQueueMessages(t, "Tuesday", "Re: Tuesday", "Re: Re: Tuesday")
+	queue := NewQueue()
+	for _, msg := range msgs[:2] {
+		queue.Enqueue(msg)
+	}
+	lease, ok := queue.Reserve()
+	if !ok {
+		t.Fatalf("Unable to reserve message")
+	}
+
+	otherSender := UserVessel{Name: "Bob", Vessel: "Snow"}
+	tests := []struct {
+		name string
+		from UserVessel
+		id   string
+		want bool
+	}{
+		{name: "reserved", from: lease.Message.From, id: lease.Message.ID, want: true},
+		{name: "waiting", from: msgs[1].From, id: msgs[1].ID, want: true},
+		{name: "never enqueued", from: msgs[2].From, id: msgs[2].ID, want: false},
+		{name: "other sender", from: otherSender, id: msgs[1].ID, want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := queue.Contains(tc.from, tc.id); got != tc.want {
+				t.Errorf("contains mismatch. got=%t want=%t", got, tc.want)
+			}
+		})
+	}
+
+	queue.Commit(lease.ID)
+	if queue.Contains(lease.Message.From, lease.Message.ID) {
+		t.Errorf("committed message should no longer be in the queue")
+	}
+}
@@ -1,8 +1,6 @@
 package msg
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -14,13 +12,44 @@ import (
 // PackagedMessage is a signed and packaged message
 // This kind of message is ready to be sent and recieved
 type PackagedMessage struct {
-	To        UserVessel `json:"to"`
-	From      UserVessel `json:"from"`
-	Subject   string     `json:"subject"`
-	Body      string     `json:"body"`
-	Signature string     `json:"signature"`
-	Packaged  time.Time  `json:"packagedAt"`
-	Recieved  time.Time  `json:"recievedAt"`
+	ID               string     `json:"id"`
+	To               UserVessel `json:"to"`
+	From             UserVessel `json:"from"`
+	Subject          string     `json:"subject"`
+	Body             string     `json:"body"`
+	Signature        string     `json:"signature"`
+	SignatureVersion int        `json:"sigVersion,omitempty"`
+	Algorithm        string     `json:"sigAlgorithm,omitempty"`
+	Encryption       string     `json:"encryption,omitempty"`
+	EphemeralKey     string     `json:"ephemeralKey,omitempty"`
+	EncryptedSubject bool       `json:"encryptedSubject,omitempty"`
+	Expires          time.Time  `json:"expiresAt,omitzero"`
+	Priority         Priority   `json:"priority,omitempty"`
+	Packaged         time.Time  `json:"packagedAt"`
+	Recieved         time.Time  `json:"recievedAt"`
+}
+
+// Delivery is a message handed to its recipient under a lease.
+// The message stays with the sender until the lease is acknowledged.
+type Delivery struct {
+	Lease   uint64          `json:"lease"`
+	Message PackagedMessage `json:"message"`
+}
+
+// Acknowledgement lists the leases of deliveries that were recieved
+type Acknowledgement struct {
+	Leases []uint64 `json:"leases"`
+}
+
+// SendResult is whether one message of a batch was accepted,
+// with the status it would have been sent on its own
+type SendResult struct {
+	ID     string `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// RetryAfter is how many seconds to wait before sending a message that was not accepted
+	// for now, just as the Retry-After header of the message sent on its own
+	RetryAfter int `json:"retryAfter,omitempty"`
 }
 
 // UserVessel identifies a persons name and a vessel that they are on
@@ -29,6 +58,57 @@ type UserVessel struct {
 	Vessel string `json:"vessel"`
 }
 
+// *** Signature Versions ***
+
+const (
+	// SignatureVersionLegacy joins the to, from, subject and body with '|', as messages
+	// were signed before ids were added. Messages without a signature version use it.
+	SignatureVersionLegacy = 1
+	// SignatureVersionCanonical encodes every signed field, including the time
+	// the message was packaged, as tagged and length-prefixed values
+	SignatureVersionCanonical = 2
+	// CurrentSignatureVersion is used for all newly packaged messages
+	CurrentSignatureVersion = SignatureVersionCanonical
+)
+
+// canonicalMessageDomain starts the signing data of canonical messages
+const canonicalMessageDomain = "async-messages/message/v2"
+
+// tags of the fields within canonical signing data, in the order they are written
+const (
+	tagID byte = iota + 1
+	tagToName
+	tagToVessel
+	tagFromName
+	tagFromVessel
+	tagSubject
+	tagBody
+	tagPackaged
+	tagAlgorithm
+	tagEncryption
+	tagEphemeralKey
+	tagEncryptedSubject
+	tagExpires
+	tagPriority
+)
+
+// *** Errors ***
+
+// ErrUnknownSignatureVersion is returned when a message is signed with a version this package does not know
+var ErrUnknownSignatureVersion = errors.New("signature version is unknown")
+
+// ErrUnknownSigner is returned when a keyring has no key for the sender of a message
+var ErrUnknownSigner = errors.New("no key for signer")
+
+// ErrMessageTooOld is returned when a message was packaged too long ago to be accepted
+var ErrMessageTooOld = errors.New("message was packaged too long ago")
+
+// ErrMessageExpired is returned when a message is past its expiry
+var ErrMessageExpired = errors.New("message has expired")
+
+// ErrMessageFromFuture is returned when a message was packaged further in the future than clock skew allows
+var ErrMessageFromFuture = errors.New("message was packaged in the future")
+
 // *** Functions ***
 
 // String returns a stringified version of the struct for printing
@@ -44,36 +124,164 @@ func (uv *UserVessel) String() string {
 	return fmt.Sprintf("%s@%s", uv.Name, uv.Vessel)
 }
 
-// VerifyMessage verifies the signature on the received message
+// VerifyMessage verifies the hmac signature on the received message
 // The message object should not be altered before this function
 func (m *PackagedMessage) VerifyMessage(secretKey []byte) error {
-	messageData := m.messageDataForSigning()
+	return m.VerifyMessageBy(NewHMACSigner(secretKey))
+}
+
+// VerifyMessageBy verifies a message that was signed by the signer
+func (m *PackagedMessage) VerifyMessageBy(signer Signer) error {
+	if !sameAlgorithm(m.Algorithm, signer.Algorithm()) {
+		return fmt.Errorf("message is signed with %q, not %q", m.Algorithm, signer.Algorithm())
+	}
+	return m.verifyWith(signer)
+}
+
+// VerifyMessageWith verifies the signature using the key of the user the message is from
+func (m *PackagedMessage) VerifyMessageWith(keys Keyring) error {
+	v, err := verifierFor(keys, m.From, m.Algorithm)
+	if err != nil {
+		return err
+	}
+	return m.verifyWith(v)
+}
+
+// verifyWith checks the signature of the message
+func (m *PackagedMessage) verifyWith(v verifier) error {
+	// only canonical signing data covers the algorithm
+	if m.Algorithm != "" && !m.SignsPackagedTime() {
+		return fmt.Errorf("%w: %q requires signature version %d", ErrUnknownAlgorithm, m.Algorithm, SignatureVersionCanonical)
+	}
+	// nor the expiry, priority and encryption fields
+	if !m.Expires.IsZero() && !m.SignsPackagedTime() {
+		return fmt.Errorf("%w: expiry requires signature version %d", ErrUnknownSignatureVersion, SignatureVersionCanonical)
+	}
+	if !m.Priority.IsValid() {
+		return fmt.Errorf("%w: %d", ErrUnknownPriority, int(m.Priority))
+	}
+	if m.Priority != PriorityRoutine && !m.SignsPackagedTime() {
+		return fmt.Errorf("%w: %q requires signature version %d", ErrUnknownPriority, m.Priority, SignatureVersionCanonical)
+	}
+	if m.IsEncrypted() && !m.SignsPackagedTime() {
+		return fmt.Errorf("%w: %q requires signature version %d", ErrUnknownEncryption, m.Encryption, SignatureVersionCanonical)
+	}
+	err := m.checkEncryption()
+	if err != nil {
+		return err
+	}
 
-	// recalculate hash using message
-	h := hmac.New(sha256.New, secretKey)
-	_, err := h.Write([]byte(messageData))
+	messageData, err := m.messageDataForSigning()
 	if err != nil {
-		return fmt.Errorf("failed to create hash for signature check: %w", err)
+		return err
 	}
-	calulatedSignatureData := h.Sum(nil)
 
-	// decode the hash from the message
+	// decode the signature from the message
 	receivedSignatureData, err := hex.DecodeString(m.Signature)
 	if err != nil {
 		return fmt.Errorf("failed to decode the messages signature: %w", err)
 	}
 
-	// securely perform comparison of signatures
-	if hmac.Equal(calulatedSignatureData, receivedSignatureData) {
-		return nil
-	} else {
-		return errors.New("signature of message is invalid")
+	err = v.Verify(messageData, receivedSignatureData)
+	if err != nil {
+		return fmt.Errorf("signature of message is invalid: %w", err)
+	}
+	return nil
+}
+
+// CheckFreshness returns an error when the message was packaged more than window
+// before now, or more than skew after now. Only meaningful for signature versions
+// that sign the packaged time.
+func (m *PackagedMessage) CheckFreshness(now time.Time, window, skew time.Duration) error {
+	age := now.Sub(m.Packaged)
+	if age > window {
+		return fmt.Errorf("%w: packaged %s ago", ErrMessageTooOld, age.Round(time.Second))
+	}
+	if -age > skew {
+		return fmt.Errorf("%w: packaged %s from now", ErrMessageFromFuture, (-age).Round(time.Second))
 	}
+	return nil
+}
+
+// IsExpired reports whether the message has an expiry, and it has passed by now
+func (m *PackagedMessage) IsExpired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// SignsPackagedTime reports whether the signature covers the time the message was packaged
+func (m *PackagedMessage) SignsPackagedTime() bool {
+	return m.signatureVersion() >= SignatureVersionCanonical
+}
+
+// sign sets the algorithm and signature of the message using its signature version
+func (m *PackagedMessage) sign(signer Signer) error {
+	// hmac is the default, so it is left off to keep older signing data the same
+	m.Algorithm = ""
+	if signer.Algorithm() != AlgorithmHMACSHA256 {
+		m.Algorithm = signer.Algorithm()
+	}
+
+	messageData, err := m.messageDataForSigning()
+	if err != nil {
+		return err
+	}
+
+	signatureData, err := signer.Sign(messageData)
+	if err != nil {
+		return err
+	}
+
+	m.Signature = hex.EncodeToString(signatureData)
+	return nil
+}
+
+// signatureVersion returns the version the message is signed with
+func (m *PackagedMessage) signatureVersion() int {
+	if m.SignatureVersion == 0 {
+		return SignatureVersionLegacy
+	}
+	return m.SignatureVersion
 }
 
 // messageDataForSigning is an internal function to prepare data for creating a signature
-func (m *PackagedMessage) messageDataForSigning() []byte {
+func (m *PackagedMessage) messageDataForSigning() ([]byte, error) {
+	switch m.signatureVersion() {
+	case SignatureVersionLegacy:
+		return m.legacyDataForSigning(), nil
+	case SignatureVersionCanonical:
+		return m.canonicalDataForSigning(), nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownSignatureVersion, m.SignatureVersion)
+	}
+}
+
+// legacyDataForSigning joins fields with '|', which is ambiguous when a field
+// contains '|' or '@'. Only kept to verify messages signed before canonical signing,
+// so it must stay exactly as those messages were signed.
+func (m *PackagedMessage) legacyDataForSigning() []byte {
 	messageData := fmt.Sprintf("%s|%s|%s|%s",
 		m.To.String(), m.From.String(), m.Subject, m.Body)
 	return []byte(messageData)
 }
+
+// canonicalDataForSigning encodes every signed field unambiguously
+func (m *PackagedMessage) canonicalDataForSigning() []byte {
+	e := newCanonicalEncoder(canonicalMessageDomain)
+	e.writeString(tagID, m.ID)
+	e.writeString(tagToName, m.To.Name)
+	e.writeString(tagToVessel, m.To.Vessel)
+	e.writeString(tagFromName, m.From.Name)
+	e.writeString(tagFromVessel, m.From.Vessel)
+	e.writeString(tagSubject, m.Subject)
+	e.writeString(tagBody, m.Body)
+	e.writeTime(tagPackaged, m.Packaged)
+	e.writeOptionalString(tagAlgorithm, m.Algorithm)
+	e.writeOptionalString(tagEncryption, m.Encryption)
+	e.writeOptionalString(tagEphemeralKey, m.EphemeralKey)
+	e.writeOptionalBool(tagEncryptedSubject, m.EncryptedSubject)
+	e.writeOptionalTime(tagExpires, m.Expires)
+	if m.Priority != PriorityRoutine {
+		e.writeString(tagPriority, m.Priority.String())
+	}
+	return e.bytes()
+}
@@ -2,11 +2,17 @@ package msg
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"testing"
+	"time"
 )
 
 var pkgMsgSecretKey = []byte("GgfY0UssupyYBlFy92/ENsq5/Qy8dq3bh3Mp8hZcPMDEdSnxMgi5E1TPzJuHVHzRs60aq6r7gKyLGwbauaUn1Q==")
 
+// pkgMsgID is a fixed message id so that signatures are repeatable
+const pkgMsgID = "01J9ZQ4V2V8D0RZ3X6N5K4M2QA"
+
 // tests the String() method of a packaged message
 // a packaged message should already have valid fields
 func TestStringOfPackagedMessage(t *testing.T) {
@@ -58,7 +64,7 @@ func TestStringOfPackagedMessage(t *testing.T) {
 	}
 }
 
-func TestPackagedMessageDataForSigning(t *testing.T) {
+func TestLegacyMessageDataForSigning(t *testing.T) {
 	tt := []struct {
 		rawMsg          RawMessage
 		wantMessageData []byte
@@ -104,10 +110,345 @@ func TestPackagedMessageDataForSigning(t *testing.T) {
 			t.Errorf("failed to package message due to: %q", err)
 		}
 
-		gotMessageData := pkgMsg.messageDataForSigning()
+		// checking the legacy format that older messages are signed with
+		pkgMsg.SignatureVersion = SignatureVersionLegacy
+		gotMessageData, err := pkgMsg.messageDataForSigning()
+		if err != nil {
+			t.Errorf("failed to get message data due to: %q", err)
+		}
 
+		// the id was added after legacy signing, so is not part of it
 		if !bytes.Equal(gotMessageData, tc.wantMessageData) {
 			t.Errorf("message data mismatch. got=%s want=%s", gotMessageData, tc.wantMessageData)
 		}
 	}
 }
+
+func TestLegacySignature(t *testing.T) {
+	tt := []struct {
+		pkgMsg        PackagedMessage
+		wantSignature string
+	}{
+		{
+			pkgMsg: PackagedMessage{
+				ID:      pkgMsgID,
+				To:      UserVessel{Name: "bob", Vessel: "snow"},
+				From:    UserVessel{Name: "kevin", Vessel: "liberty"},
+				Subject: "Tuesday",
+				Body:    "I am planning on proceeding on tuesday since there is a break in the weather",
+			},
+			wantSignature: "2d18d51dee10b1c5b5e673652b9744ebc8f0900c114cb34262b1429738a116f9",
+		},
+		{
+			pkgMsg: PackagedMessage{
+				ID:      pkgMsgID,
+				To:      UserVessel{Name: "kevin", Vessel: "liberty"},
+				From:    UserVessel{Name: "bob", Vessel: "snow"},
+				Subject: "Re: Tuesday",
+				Body:    "I will need to wait longer because of needed repair work. Hope to catch up.",
+			},
+			wantSignature: "7bf816982b5d8c52822a366e68d9fd2662c9192e4a86473d4dfdfbd29cfd64d5",
+		},
+		{
+			pkgMsg: PackagedMessage{
+				ID:      pkgMsgID,
+				To:      UserVessel{Name: "bob", Vessel: "snow"},
+				From:    UserVessel{Name: "kevin", Vessel: "liberty"},
+				Subject: "Re: Re: Tuesday",
+				Body:    "Good idea. Take your time. I will send out a message when we get into Cambridge Bay.",
+			},
+			wantSignature: "1a936de118b68b1cea9469ec5cd22b7bd65bef71027eb35b88c931ad66eaa870",
+		},
+	}
+
+	for _, tc := range tt {
+		// messages without a version are legacy messages
+		err := tc.pkgMsg.sign(NewHMACSigner(pkgMsgSecretKey))
+		if err != nil {
+			t.Errorf("sign failed unexpectedly due to: %q", err)
+		}
+
+		if tc.pkgMsg.Signature != tc.wantSignature {
+			t.Errorf("signature mismatch. got=%s want=%s", tc.pkgMsg.Signature, tc.wantSignature)
+		}
+
+		// legacy messages must still verify during migration
+		err = tc.pkgMsg.VerifyMessage(pkgMsgSecretKey)
+		if err != nil {
+			t.Errorf("legacy message should verify: %q", err)
+		}
+	}
+}
+
+// baselineMessage was packaged by a client from before message ids and signature versions
+var baselineMessage = []byte(`{"to":{"name":"Bob","vessel":"Snow"},"from":{"name":"Kevin","vessel":"Liberty"},` +
+	`"subject":"Tuesday","body":"I am planning on proceeding on tuesday since there is a break in the weather",` +
+	`"signature":"7401dff71678d5d8aa8eb46724b39b0d83a65c61e1b679e51e6b7b2d76e37c63",` +
+	`"packagedAt":"2026-10-17T19:28:22.403900675Z","recievedAt":"0001-01-01T00:00:00Z"}`)
+
+func TestVerifyBaselineMessage(t *testing.T) {
+	var pkgMsg PackagedMessage
+	err := json.Unmarshal(baselineMessage, &pkgMsg)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal message due to: %q", err)
+	}
+	if pkgMsg.SignsPackagedTime() {
+		t.Errorf("Expected a message without a signature version to be legacy")
+	}
+
+	err = pkgMsg.VerifyMessage(pkgMsgSecretKey)
+	if err != nil {
+		t.Errorf("Did not expect error verifying a message from an older client: got=%q", err)
+	}
+
+	// still only by its sender
+	pkgMsg.Body = "I am planning on proceeding on wednesday"
+	err = pkgMsg.VerifyMessage(pkgMsgSecretKey)
+	if err == nil {
+		t.Errorf("Expected a changed message to fail verification")
+	}
+}
+
+func TestCanonicalMessageDataForSigning(t *testing.T) {
+	pkgMsg := PackagedMessage{
+		ID:               pkgMsgID,
+		To:               UserVessel{Name: "bob", Vessel: "snow"},
+		From:             UserVessel{Name: "kevin", Vessel: "liberty"},
+		Subject:          "Hi",
+		Body:             "Go",
+		SignatureVersion: SignatureVersionCanonical,
+		Packaged:         time.Unix(0, 1).UTC(),
+	}
+
+	wantMessageData := []byte("\x19async-messages/message/v2" +
+		"\x01\x1a01J9ZQ4V2V8D0RZ3X6N5K4M2QA" +
+		"\x02\x03bob" + "\x03\x04snow" +
+		"\x04\x05kevin" + "\x05\x07liberty" +
+		"\x06\x02Hi" + "\x07\x02Go" +
+		"\x08\x08\x00\x00\x00\x00\x00\x00\x00\x01")
+
+	gotMessageData, err := pkgMsg.messageDataForSigning()
+	if err != nil {
+		t.Fatalf("failed to get message data due to: %q", err)
+	}
+	if !bytes.Equal(gotMessageData, wantMessageData) {
+		t.Errorf("message data mismatch. got=%q want=%q", gotMessageData, wantMessageData)
+	}
+}
+
+func TestCanonicalSigningIsUnambiguous(t *testing.T) {
+	// both messages join to "bob@snow|kevin@liberty|a|b|c" in the legacy format
+	first := PackagedMessage{
+		ID:      pkgMsgID,
+		To:      UserVessel{Name: "bob", Vessel: "snow"},
+		From:    UserVessel{Name: "kevin", Vessel: "liberty"},
+		Subject: "a|b",
+		Body:    "c",
+	}
+	second := first
+	second.Subject = "a"
+	second.Body = "b|c"
+
+	firstLegacy, _ := first.messageDataForSigning()
+	secondLegacy, _ := second.messageDataForSigning()
+	if !bytes.Equal(firstLegacy, secondLegacy) {
+		t.Fatal("legacy format was expected to be ambiguous for this case")
+	}
+
+	first.SignatureVersion = SignatureVersionCanonical
+	second.SignatureVersion = SignatureVersionCanonical
+	firstCanonical, _ := first.messageDataForSigning()
+	secondCanonical, _ := second.messageDataForSigning()
+	if bytes.Equal(firstCanonical, secondCanonical) {
+		t.Error("canonical format should differ for different messages")
+	}
+}
+
+func TestVerifyMessage(t *testing.T) {
+	rawMsg := RawMessage{
+		ToName:     "Bob",
+		ToVessel:   "Snow",
+		FromName:   "Kevin",
+		FromVessel: "Liberty",
+		Subject:    "Tuesday",
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+	}
+
+	tt := []struct {
+		name      string
+		alter     func(m *PackagedMessage)
+		wantValid bool
+		wantErr   error
+	}{
+		{
+			name:      "unaltered",
+			alter:     func(m *PackagedMessage) {},
+			wantValid: true,
+		},
+		{
+			name:  "altered packaged time",
+			alter: func(m *PackagedMessage) { m.Packaged = m.Packaged.Add(time.Second) },
+		},
+		{
+			name:  "altered id",
+			alter: func(m *PackagedMessage) { m.ID = pkgMsgID },
+		},
+		{
+			name:  "altered body",
+			alter: func(m *PackagedMessage) { m.Body += "!" },
+		},
+		{
+			name:    "unknown version",
+			alter:   func(m *PackagedMessage) { m.SignatureVersion = 99 },
+			wantErr: ErrUnknownSignatureVersion,
+		},
+	}
+
+	for _, tc := range tt {
+		pkgMsg, err := rawMsg.ToPackagedMessage(pkgMsgSecretKey)
+		if err != nil {
+			t.Fatalf("failed to package message due to: %q", err)
+		}
+		if pkgMsg.SignatureVersion != CurrentSignatureVersion {
+			t.Errorf("new messages should use the current signature version. got=%d", pkgMsg.SignatureVersion)
+		}
+
+		tc.alter(pkgMsg)
+		gotErr := pkgMsg.VerifyMessage(pkgMsgSecretKey)
+
+		if tc.wantValid && gotErr != nil {
+			t.Errorf("%s: did not expect error: got=%q", tc.name, gotErr)
+		}
+		if !tc.wantValid && gotErr == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+		if tc.wantErr != nil && !errors.Is(gotErr, tc.wantErr) {
+			t.Errorf("%s: error mismatch. got=%v want=%v", tc.name, gotErr, tc.wantErr)
+		}
+	}
+}
+
+func TestCheckFreshness(t *testing.T) {
+	now := time.Date(2025, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	tt := []struct {
+		name     string
+		packaged time.Time
+		wantErr  error
+	}{
+		{name: "just packaged", packaged: now, wantErr: nil},
+		{name: "within window", packaged: now.Add(-47 * time.Hour), wantErr: nil},
+		{name: "slightly ahead", packaged: now.Add(4 * time.Minute), wantErr: nil},
+		{name: "outside window", packaged: now.Add(-49 * time.Hour), wantErr: ErrMessageTooOld},
+		{name: "too far ahead", packaged: now.Add(6 * time.Minute), wantErr: ErrMessageFromFuture},
+	}
+
+	for _, tc := range tt {
+		pkgMsg := PackagedMessage{Packaged: tc.packaged}
+
+		gotErr := pkgMsg.CheckFreshness(now, 48*time.Hour, 5*time.Minute)
+		if tc.wantErr == nil && gotErr != nil {
+			t.Errorf("%s: did not expect error: got=%q", tc.name, gotErr)
+		}
+		if tc.wantErr != nil && !errors.Is(gotErr, tc.wantErr) {
+			t.Errorf("%s: error mismatch. got=%v want=%v", tc.name, gotErr, tc.wantErr)
+		}
+	}
+}
+
+func TestMessageExpiry(t *testing.T) {
+	rawMsg := RawMessage{
+		ToName:     "Bob",
+		ToVessel:   "Snow",
+		FromName:   "Kevin",
+		FromVessel: "Liberty",
+		Subject:    "Tuesday",
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+		TTL:        time.Hour,
+	}
+	pkgMsg, err := rawMsg.ToPackagedMessage(pkgMsgSecretKey)
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+
+	if pkgMsg.IsExpired(pkgMsg.Packaged) {
+		t.Error("message should not be expired when packaged")
+	}
+	if !pkgMsg.IsExpired(pkgMsg.Expires) {
+		t.Error("message should be expired at its expiry")
+	}
+	noExpiry := PackagedMessage{}
+	if noExpiry.IsExpired(time.Now().Add(100 * 365 * 24 * time.Hour)) {
+		t.Error("message without an expiry should never expire")
+	}
+
+	// the expiry is signed, so it cannot be extended
+	err = pkgMsg.VerifyMessage(pkgMsgSecretKey)
+	if err != nil {
+		t.Errorf("Did not expect error: got=%q", err)
+	}
+	extended := *pkgMsg
+	extended.Expires = extended.Expires.Add(time.Hour)
+	if extended.VerifyMessage(pkgMsgSecretKey) == nil {
+		t.Error("extended expiry should not verify")
+	}
+	removed := *pkgMsg
+	removed.Expires = time.Time{}
+	if removed.VerifyMessage(pkgMsgSecretKey) == nil {
+		t.Error("removed expiry should not verify")
+	}
+
+	// legacy signatures do not cover the expiry
+	legacy := *pkgMsg
+	legacy.SignatureVersion = SignatureVersionLegacy
+	if !errors.Is(legacy.VerifyMessage(pkgMsgSecretKey), ErrUnknownSignatureVersion) {
+		t.Error("expiry should require a canonical signature")
+	}
+}
+
+func TestVerifyMessageWith(t *testing.T) {
+	kevinKey := []byte("kevin's key")
+	bobKey := []byte("bob's key")
+	keys := &testKeyring{
+		secretKeys: map[UserVessel][]byte{
+			{Name: "Kevin", Vessel: "Liberty"}: kevinKey,
+			{Name: "Bob", Vessel: "Snow"}:      bobKey,
+		},
+	}
+
+	rawMsg := RawMessage{
+		ToName:     "Bob",
+		ToVessel:   "Snow",
+		FromName:   "Kevin",
+		FromVessel: "Liberty",
+		Subject:    "Tuesday",
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+	}
+
+	tt := []struct {
+		name       string
+		signingKey []byte
+		fromName   string
+		wantErr    bool
+	}{
+		{name: "signed by sender", signingKey: kevinKey, fromName: "Kevin", wantErr: false},
+		{name: "forged by recipient", signingKey: bobKey, fromName: "Kevin", wantErr: true},
+		{name: "unknown sender", signingKey: kevinKey, fromName: "Craig", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		rawMsg.FromName = tc.fromName
+		pkgMsg, err := rawMsg.ToPackagedMessage(tc.signingKey)
+		if err != nil {
+			t.Fatalf("failed to package message due to: %q", err)
+		}
+
+		gotErr := pkgMsg.VerifyMessageWith(keys)
+		if tc.wantErr && gotErr == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+		if !tc.wantErr && gotErr != nil {
+			t.Errorf("%s: did not expect error: got=%q", tc.name, gotErr)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package msg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// *** Types ***
+
+// Priority is how urgently a message needs to be delivered.
+// Queues deliver higher priorities first, and keep the order within a priority.
+type Priority int
+
+// *** Priorities ***
+
+const (
+	// PriorityRoutine is everyday traffic, messages without a priority use it
+	PriorityRoutine Priority = iota
+	// PriorityHigh is written as "priority", for traffic that should not wait behind routine messages
+	PriorityHigh
+	// PriorityUrgent is for messages about the safety of a vessel or person
+	PriorityUrgent
+	// PriorityDistress is for a vessel or person in grave and imminent danger
+	PriorityDistress
+)
+
+// priorityLevels is the number of priorities, queues hold a level for each
+const priorityLevels = int(PriorityDistress) + 1
+
+var priorityNames = [priorityLevels]string{"routine", "priority", "urgent", "distress"}
+
+// *** Errors ***
+
+// ErrUnknownPriority is returned when a message has a priority that is not known
+var ErrUnknownPriority = errors.New("unknown priority")
+
+// *** Functions ***
+
+// ParsePriority returns the priority with the name, such as "distress"
+func ParsePriority(name string) (Priority, error) {
+	for i, priorityName := range priorityNames {
+		if name == priorityName {
+			return Priority(i), nil
+		}
+	}
+	return PriorityRoutine, fmt.Errorf("%w: %q", ErrUnknownPriority, name)
+}
+
+// IsValid reports whether the priority is one of the known priorities
+func (p Priority) IsValid() bool {
+	return p >= PriorityRoutine && p <= PriorityDistress
+}
+
+func (p Priority) String() string {
+	if !p.IsValid() {
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+// MarshalText writes the priority by name, so that messages are readable
+func (p Priority) MarshalText() ([]byte, error) {
+	if !p.IsValid() {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownPriority, int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText reads a priority written by name
+func (p *Priority) UnmarshalText(text []byte) error {
+	priority, err := ParsePriority(string(text))
+	if err != nil {
+		return err
+	}
+	*p = priority
+	return nil
+}
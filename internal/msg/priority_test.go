@@ -0,0 +1,108 @@
+package msg
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParsePriority(t *testing.T) {
+	tt := []struct {
+		name    string
+		want    Priority
+		wantErr error
+	}{
+		{name: "routine", want: PriorityRoutine},
+		{name: "priority", want: PriorityHigh},
+		{name: "urgent", want: PriorityUrgent},
+		{name: "distress", want: PriorityDistress},
+		{name: "mayday", wantErr: ErrUnknownPriority},
+		{name: "", wantErr: ErrUnknownPriority},
+	}
+
+	for _, tc := range tt {
+		got, gotErr := ParsePriority(tc.name)
+		if tc.wantErr != nil {
+			if !errors.Is(gotErr, tc.wantErr) {
+				t.Errorf("%q: error mismatch. got=%v want=%v", tc.name, gotErr, tc.wantErr)
+			}
+			continue
+		}
+		if gotErr != nil || got != tc.want {
+			t.Errorf("%q: priority mismatch. got=%v want=%v err=%v", tc.name, got, tc.want, gotErr)
+		}
+		if got.String() != tc.name {
+			t.Errorf("%q: name mismatch. got=%q", tc.name, got.String())
+		}
+	}
+}
+
+func TestPriorityJSON(t *testing.T) {
+	pkgMsg := PackagedMessage{ID: pkgMsgID, Priority: PriorityDistress}
+	data, err := json.Marshal(pkgMsg)
+	if err != nil {
+		t.Fatalf("Unable to marshal message due to: %q", err)
+	}
+
+	var got PackagedMessage
+	err = json.Unmarshal(data, &got)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal message due to: %q", err)
+	}
+	if got.Priority != PriorityDistress {
+		t.Errorf("priority mismatch. got=%v want=%v", got.Priority, PriorityDistress)
+	}
+
+	// routine is left out, so older messages are routine
+	routine, _ := json.Marshal(PackagedMessage{ID: pkgMsgID})
+	var fields map[string]any
+	_ = json.Unmarshal(routine, &fields)
+	if _, ok := fields["priority"]; ok {
+		t.Error("routine priority should be left out")
+	}
+
+	err = json.Unmarshal([]byte(`{"priority":"mayday"}`), &got)
+	if !errors.Is(err, ErrUnknownPriority) {
+		t.Errorf("unknown priority should not unmarshal. got=%v", err)
+	}
+}
+
+func TestPrioritySigned(t *testing.T) {
+	rawMsg := RawMessage{
+		ToName:     "Bob",
+		ToVessel:   "Snow",
+		FromName:   "Kevin",
+		FromVessel: "Liberty",
+		Subject:    "Taking on water",
+		Body:       "We have taken on water near the engine room and need assistance.",
+		Priority:   PriorityDistress,
+	}
+	pkgMsg, err := rawMsg.ToPackagedMessage(pkgMsgSecretKey)
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+
+	err = pkgMsg.VerifyMessage(pkgMsgSecretKey)
+	if err != nil {
+		t.Errorf("Did not expect error: got=%q", err)
+	}
+
+	// the priority is signed, so it cannot be raised or lowered along the way
+	changed := *pkgMsg
+	changed.Priority = PriorityRoutine
+	if changed.VerifyMessage(pkgMsgSecretKey) == nil {
+		t.Error("changed priority should not verify")
+	}
+
+	unknown := *pkgMsg
+	unknown.Priority = Priority(10)
+	if !errors.Is(unknown.VerifyMessage(pkgMsgSecretKey), ErrUnknownPriority) {
+		t.Error("unknown priority should not verify")
+	}
+
+	rawMsg.Priority = Priority(-1)
+	_, err = rawMsg.ToPackagedMessage(pkgMsgSecretKey)
+	if !errors.Is(err, ErrUnknownPriority) {
+		t.Errorf("unknown priority should not package. got=%v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package msg
+
+import (
+	"iter"
+	"sync"
+)
+
+// minRingSize is the smallest buffer a ring allocates, and shrinks down to
+const minRingSize = 8
+
+// *** Types ***
+
+// Queue is a first in, first out queue that is safe for concurrent use.
+// It is backed by a ring buffer, so every operation is constant amortised time.
+// The zero value is an empty queue ready to use.
+type Queue[T any] struct {
+	items ring[T]
+	mux   sync.Mutex
+}
+
+// ring is a growable ring buffer of items, oldest first.
+// Pushing and popping at either end is constant time, and the buffer doubles
+// when full and halves when a quarter full, so the amortised cost stays constant.
+// The zero value is an empty ring. It is not safe for concurrent use.
+type ring[T any] struct {
+	buf   []T
+	head  int
+	count int
+}
+
+// *** Queue Functions ***
+
+// Enqueue adds an item to the back of the queue
+func (q *Queue[T]) Enqueue(item T) {
+	q.mux.Lock()
+	q.enqueue(item)
+	q.mux.Unlock()
+}
+
+// Dequeue removes the item at the front of the queue.
+// Returns false if the queue is empty.
+func (q *Queue[T]) Dequeue() (T, bool) {
+	q.mux.Lock()
+	item, ok := q.dequeue()
+	q.mux.Unlock()
+
+	return item, ok
+}
+
+// Peek returns the item at the front of the queue without removing it.
+// Returns false if the queue is empty.
+func (q *Queue[T]) Peek() (T, bool) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if q.len() == 0 {
+		var zero T
+		return zero, false
+	}
+	return q.at(0), true
+}
+
+// Len returns the number of items in the queue
+func (q *Queue[T]) Len() int {
+	q.mux.Lock()
+	qLen := q.len()
+	q.mux.Unlock()
+
+	return qLen
+}
+
+// Drain removes every item from the queue, returning them front first
+func (q *Queue[T]) Drain() []T {
+	q.mux.Lock()
+	items := q.appendTo(make([]T, 0, q.len()))
+	q.items = ring[T]{}
+	q.mux.Unlock()
+
+	return items
+}
+
+// All iterates over the items in the queue front first, without removing them.
+// It iterates over a copy taken when it starts, so the queue can be changed while iterating.
+func (q *Queue[T]) All() iter.Seq[T] {
+	return func(yield func(T) bool) {
+		q.mux.Lock()
+		items := q.appendTo(make([]T, 0, q.len()))
+		q.mux.Unlock()
+
+		for _, item := range items {
+			if !yield(item) {
+				return
+			}
+		}
+	}
+}
+
+// *** Unlocked Queue Functions ***
+
+// These do not take q.mux, so that a queue can be guarded by the lock of whatever holds it,
+// as PackagedQueue does with a queue for each priority. Either q.mux or that lock must be held.
+
+func (q *Queue[T]) len() int {
+	return q.items.len()
+}
+
+// enqueue adds an item to the back of the queue
+func (q *Queue[T]) enqueue(item T) {
+	q.items.pushBack(item)
+}
+
+// enqueueFront adds an item to the front of the queue, to be dequeued next
+func (q *Queue[T]) enqueueFront(item T) {
+	q.items.pushFront(item)
+}
+
+// dequeue removes the item at the front of the queue
+func (q *Queue[T]) dequeue() (T, bool) {
+	return q.items.popFront()
+}
+
+// at returns the item i places from the front
+func (q *Queue[T]) at(i int) T {
+	return q.items.at(i)
+}
+
+// appendTo appends every item, front first, to items
+func (q *Queue[T]) appendTo(items []T) []T {
+	return q.items.appendTo(items)
+}
+
+// removeFunc removes every item that remove returns true for,
+// keeping the order of the rest. Returns the removed items, front first.
+func (q *Queue[T]) removeFunc(remove func(T) bool) []T {
+	return q.items.removeFunc(remove)
+}
+
+// *** Ring Functions ***
+
+func (r *ring[T]) len() int {
+	return r.count
+}
+
+// pushBack adds an item after the newest
+func (r *ring[T]) pushBack(item T) {
+	if r.count == len(r.buf) {
+		r.resize(max(2*len(r.buf), minRingSize))
+	}
+	r.buf[r.index(r.count)] = item
+	r.count++
+}
+
+// pushFront adds an item before the oldest
+func (r *ring[T]) pushFront(item T) {
+	if r.count == len(r.buf) {
+		r.resize(max(2*len(r.buf), minRingSize))
+	}
+	r.head = (r.head - 1 + len(r.buf)) % len(r.buf)
+	r.buf[r.head] = item
+	r.count++
+}
+
+// popFront removes the oldest item
+func (r *ring[T]) popFront() (T, bool) {
+	var zero T
+	if r.count == 0 {
+		return zero, false
+	}
+
+	item := r.buf[r.head]
+	// clear the slot so the item can be garbage collected
+	r.buf[r.head] = zero
+	r.head = (r.head + 1) % len(r.buf)
+	r.count--
+
+	r.shrinkIfSparse()
+	return item, true
+}
+
+// at returns the item i places from the oldest
+func (r *ring[T]) at(i int) T {
+	return r.buf[r.index(i)]
+}
+
+// appendTo appends every item, oldest first, to items
+func (r *ring[T]) appendTo(items []T) []T {
+	for i := range r.count {
+		items = append(items, r.at(i))
+	}
+	return items
+}
+
+// removeFunc removes every item that remove returns true for,
+// keeping the order of the rest. Returns the removed items, oldest first.
+func (r *ring[T]) removeFunc(remove func(T) bool) []T {
+	var removed []T
+	kept := 0
+	for i := range r.count {
+		item := r.at(i)
+		if remove(item) {
+			removed = append(removed, item)
+			continue
+		}
+		r.buf[r.index(kept)] = item
+		kept++
+	}
+
+	var zero T
+	for i := kept; i < r.count; i++ {
+		r.buf[r.index(i)] = zero
+	}
+	r.count = kept
+
+	r.shrinkIfSparse()
+	return removed
+}
+
+// index returns where the item i places from the oldest is in the buffer
+func (r *ring[T]) index(i int) int {
+	return (r.head + i) % len(r.buf)
+}
+
+// shrinkIfSparse halves the buffer once it is a quarter full, so a burst does not hold memory forever
+func (r *ring[T]) shrinkIfSparse() {
+	if len(r.buf) > minRingSize && r.count <= len(r.buf)/4 {
+		r.resize(len(r.buf) / 2)
+	}
+}
+
+// resize moves the items into a buffer of the size, with the oldest first
+func (r *ring[T]) resize(size int) {
+	buf := make([]T, size)
+	r.appendTo(buf[:0])
+	r.buf = buf
+	r.head = 0
+}
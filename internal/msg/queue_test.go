@@ -0,0 +1,154 @@
+package msg
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// numberedMessages makes n messages with their number as the subject
+func numberedMessages(n int) []PackagedMessage {
+	msgs := make([]PackagedMessage, n)
+	for i := range msgs {
+		msgs[i] = PackagedMessage{Subject: strconv.Itoa(i)}
+	}
+	return msgs
+}
+
+func TestQueue(t *testing.T) {
+	var queue Queue[string]
+	_, ok := queue.Peek()
+	if ok || queue.Len() != 0 {
+		t.Fatal("Zero value queue should be empty")
+	}
+
+	for _, item := range []string{"Tuesday", "Re: Tuesday", "Re: Re: Tuesday"} {
+		queue.Enqueue(item)
+	}
+
+	front, ok := queue.Peek()
+	if !ok || front != "Tuesday" || queue.Len() != 3 {
+		t.Errorf("Peek should not remove the front. got=%q len=%d", front, queue.Len())
+	}
+
+	item, ok := queue.Dequeue()
+	if !ok || item != "Tuesday" {
+		t.Errorf("Dequeue mismatch. got=%q want=%q", item, "Tuesday")
+	}
+
+	got := slices.Collect(queue.All())
+	if !slices.Equal(got, []string{"Re: Tuesday", "Re: Re: Tuesday"}) {
+		t.Errorf("All mismatch. got=%q", got)
+	}
+	if queue.Len() != 2 {
+		t.Errorf("All should not remove items. len=%d", queue.Len())
+	}
+
+	// stopping early, and changing the queue while iterating
+	for item := range queue.All() {
+		queue.Enqueue(item + " again")
+		break
+	}
+	if queue.Len() != 3 {
+		t.Errorf("Length mismatch. got=%d want=%d", queue.Len(), 3)
+	}
+
+	drained := queue.Drain()
+	if !slices.Equal(drained, []string{"Re: Tuesday", "Re: Re: Tuesday", "Re: Tuesday again"}) {
+		t.Errorf("Drain mismatch. got=%q", drained)
+	}
+	_, ok = queue.Dequeue()
+	if ok || queue.Len() != 0 {
+		t.Error("Queue should be empty after draining")
+	}
+}
+
+func TestQueueOfDeadLetters(t *testing.T) {
+	msgs := numberedMessages(3)
+
+	var queue Queue[DeadLetter]
+	for _, msg := range msgs {
+		queue.Enqueue(DeadLetter{Message: msg, Reason: "invalid", Attempts: 1})
+	}
+
+	i := 0
+	for deadLetter := range queue.All() {
+		if deadLetter.Message != msgs[i] {
+			t.Errorf("Dead letters out of order at %d. got=%q", i, deadLetter.Message.Subject)
+		}
+		i++
+	}
+}
+
+func TestRingWrapsAndGrows(t *testing.T) {
+	var ring ring[int]
+	// move the head along so that pushes wrap around the end of the buffer
+	for i := range 5 {
+		ring.pushBack(i)
+		ring.popFront()
+	}
+
+	for i := range 100 {
+		ring.pushBack(i)
+	}
+	if ring.len() != 100 {
+		t.Fatalf("Length mismatch. got=%d want=%d", ring.len(), 100)
+	}
+
+	for want := range 100 {
+		got, ok := ring.popFront()
+		if !ok || got != want {
+			t.Fatalf("Items out of order. got=%d want=%d", got, want)
+		}
+	}
+	_, ok := ring.popFront()
+	if ok {
+		t.Error("Popping an empty ring should not be ok")
+	}
+	if len(ring.buf) != minRingSize {
+		t.Errorf("Empty ring should shrink back down. got=%d want=%d", len(ring.buf), minRingSize)
+	}
+}
+
+func TestRingPushFront(t *testing.T) {
+	var ring ring[int]
+	for i := 10; i < 20; i++ {
+		ring.pushBack(i)
+	}
+	// pushed in reverse so that they end up in order
+	for i := 9; i >= 0; i-- {
+		ring.pushFront(i)
+	}
+
+	for i, got := range ring.appendTo(nil) {
+		if got != i {
+			t.Errorf("Items out of order at %d. got=%d", i, got)
+		}
+	}
+}
+
+func TestRingRemoveFunc(t *testing.T) {
+	var ring ring[int]
+	for i := range 3 {
+		ring.pushBack(i)
+		ring.popFront()
+	}
+	for i := range 50 {
+		ring.pushBack(i)
+	}
+
+	removed := ring.removeFunc(func(i int) bool { return i%2 == 1 })
+	if len(removed) != 25 || ring.len() != 25 {
+		t.Fatalf("Removed mismatch. removed=%d left=%d", len(removed), ring.len())
+	}
+
+	for i := range 25 {
+		if removed[i] != 2*i+1 {
+			t.Errorf("Removed out of order at %d. got=%d want=%d", i, removed[i], 2*i+1)
+		}
+		got, _ := ring.popFront()
+		if got != 2*i {
+			t.Errorf("Kept out of order at %d. got=%d want=%d", i, got, 2*i)
+		}
+	}
+}
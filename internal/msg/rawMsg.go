@@ -2,13 +2,16 @@
 package msg
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"crypto/ecdh"
+	"errors"
 	"fmt"
+	"math"
 	"time"
 )
 
+// latestExpiry is the last time that fits in the nanoseconds a signature covers, in the year 2262
+var latestExpiry = time.Unix(0, math.MaxInt64).UTC()
+
 // *** Types ***
 
 // RawMessage is a raw message that needs to be processed further
@@ -20,6 +23,12 @@ type RawMessage struct {
 	FromVessel string
 	Subject    string
 	Body       string
+	// optional, the message expires at Expires or TTL after it is packaged.
+	// Only one of them can be set.
+	Expires time.Time
+	TTL     time.Duration
+	// optional, routine when not set
+	Priority Priority
 }
 
 // MissingFieldError is returned when there is a missing field
@@ -34,7 +43,54 @@ func (err *MissingFieldError) Error() string {
 // *** Functions ***
 
 // ToPackagedMessage takes a raw message and performs operations needed to package it into a packaged message
+// The message is signed with an hmac secret key
 func (rawMsg *RawMessage) ToPackagedMessage(secretKey []byte) (*PackagedMessage, error) {
+	return rawMsg.ToPackagedMessageWith(NewHMACSigner(secretKey))
+}
+
+// ToPackagedMessageWith packages the raw message, signing it with the signer
+func (rawMsg *RawMessage) ToPackagedMessageWith(signer Signer) (*PackagedMessage, error) {
+	packagedMsg, err := rawMsg.pack()
+	if err != nil {
+		return nil, err
+	}
+
+	err = packagedMsg.sign(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return packagedMsg, nil
+}
+
+// ToSealedMessage packages the raw message with the body, and the subject if sealSubject is set,
+// encrypted for the recipients public key. The signature covers the encrypted fields and the
+// ephemeral key, so the signer must sign with a private key.
+func (rawMsg *RawMessage) ToSealedMessage(signer Signer, recipient *ecdh.PublicKey, sealSubject bool) (*PackagedMessage, error) {
+	if sameAlgorithm(signer.Algorithm(), AlgorithmHMACSHA256) {
+		return nil, ErrSealedWithSecret
+	}
+
+	packagedMsg, err := rawMsg.pack()
+	if err != nil {
+		return nil, err
+	}
+
+	err = packagedMsg.seal(recipient, sealSubject)
+	if err != nil {
+		return nil, err
+	}
+
+	err = packagedMsg.sign(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return packagedMsg, nil
+}
+
+// pack checks the fields of the raw message and creates an unsigned packaged message
+func (rawMsg *RawMessage) pack() (*PackagedMessage, error) {
 	// checking to fields
 	if rawMsg.ToName == "" {
 		return nil, &MissingFieldError{Field: "ToName"}
@@ -69,43 +125,51 @@ func (rawMsg *RawMessage) ToPackagedMessage(secretKey []byte) (*PackagedMessage,
 	}
 	// body does not get changed, as it could affect the message
 
-	signature, err := rawMsg.createSignature(secretKey)
+	id, err := NewMessageID()
 	if err != nil {
 		return nil, err
 	}
 
-	packagedMsg := PackagedMessage{
-		To:        toInfo,
-		From:      fromInfo,
-		Subject:   rawMsg.Subject,
-		Body:      rawMsg.Body,
-		Signature: signature,
-		Packaged:  time.Now().UTC(),
+	if !rawMsg.Priority.IsValid() {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownPriority, int(rawMsg.Priority))
 	}
 
-	return &packagedMsg, nil
-}
+	packaged := time.Now().UTC()
+	expires, err := rawMsg.expiresAt(packaged)
+	if err != nil {
+		return nil, err
+	}
 
-// messageDataForSinging returns a stringified representation of the raw message
-// this is needed for creating the signature
-func (rawMsg *RawMessage) messageDataForSigning() []byte {
-	messageData := fmt.Sprintf("%s@%s|%s@%s|%s|%s",
-		rawMsg.ToName, rawMsg.ToVessel, rawMsg.FromName, rawMsg.FromVessel, rawMsg.Subject, rawMsg.Body)
-	return []byte(messageData)
-}
+	packagedMsg := &PackagedMessage{
+		ID:               id,
+		To:               toInfo,
+		From:             fromInfo,
+		Subject:          rawMsg.Subject,
+		Body:             rawMsg.Body,
+		SignatureVersion: CurrentSignatureVersion,
+		Packaged:         packaged,
+		Expires:          expires,
+		Priority:         rawMsg.Priority,
+	}
 
-// createSignature returns the signature that validates the message itself
-func (rawMsg *RawMessage) createSignature(secretKey []byte) (string, error) {
-	messageData := rawMsg.messageDataForSigning()
+	return packagedMsg, nil
+}
 
-	// create hash with sha256 and secret key
-	h := hmac.New(sha256.New, secretKey)
-	_, err := h.Write([]byte(messageData))
-	if err != nil {
-		return "", fmt.Errorf("failed to write message to hmac: %w", err)
+// expiresAt returns when a message packaged at the time expires, or the zero time if it does not
+func (rawMsg *RawMessage) expiresAt(packaged time.Time) (time.Time, error) {
+	if !rawMsg.Expires.IsZero() && rawMsg.TTL != 0 {
+		return time.Time{}, errors.New("raw message can only have one of Expires and TTL")
 	}
 
-	// get the final hash and encode to hex string
-	calulatedSignature := hex.EncodeToString(h.Sum(nil))
-	return calulatedSignature, nil
+	expires := rawMsg.Expires.UTC()
+	if rawMsg.TTL != 0 {
+		expires = packaged.Add(rawMsg.TTL)
+	}
+	if !expires.IsZero() && !expires.After(packaged) {
+		return time.Time{}, fmt.Errorf("%w: expires before it is packaged", ErrMessageExpired)
+	}
+	if expires.After(latestExpiry) {
+		return time.Time{}, fmt.Errorf("raw message cannot expire after %s", latestExpiry.Format(time.RFC3339))
+	}
+	return expires, nil
 }
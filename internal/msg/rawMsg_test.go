@@ -1,9 +1,10 @@
 package msg
 
 import (
-	"bytes"
 	"errors"
+	"math"
 	"testing"
+	"time"
 )
 
 var rawMsgSecretKey = []byte("GgfY0UssupyYBlFy92/ENsq5/Qy8dq3bh3Mp8hZcPMDEdSnxMgi5E1TPzJuHVHzRs60aq6r7gKyLGwbauaUn1Q==")
@@ -139,103 +140,58 @@ func TestToPackagedMessage(t *testing.T) {
 	}
 }
 
-func TestRawMessageDataForSigning(t *testing.T) {
+func TestToPackagedMessageExpiry(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+
 	tt := []struct {
-		rawMsg          RawMessage
-		wantMessageData []byte
+		name    string
+		expires time.Time
+		ttl     time.Duration
+		wantErr bool
 	}{
-		{
-			rawMsg: RawMessage{
-				ToName:     "bob",
-				ToVessel:   "snow",
-				FromName:   "kevin",
-				FromVessel: "liberty",
-				Subject:    "Tuesday",
-				Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
-			},
-			wantMessageData: []byte("bob@snow|kevin@liberty|Tuesday|I am planning on proceeding on tuesday since there is a break in the weather"),
-		},
-		{
-			rawMsg: RawMessage{
-				ToName:     "kevin",
-				ToVessel:   "liberty",
-				FromName:   "bob",
-				FromVessel: "snow",
-				Subject:    "Re: Tuesday",
-				Body:       "I will need to wait longer because of needed repair work. Hope to catch up.",
-			},
-			wantMessageData: []byte("kevin@liberty|bob@snow|Re: Tuesday|I will need to wait longer because of needed repair work. Hope to catch up."),
-		},
-		{
-			rawMsg: RawMessage{
-				ToName:     "bob",
-				ToVessel:   "snow",
-				FromName:   "kevin",
-				FromVessel: "liberty",
-				Subject:    "Re: Re: Tuesday",
-				Body:       "Good idea. Take your time. I will send out a message when we get into Cambridge Bay.",
-			},
-			wantMessageData: []byte("bob@snow|kevin@liberty|Re: Re: Tuesday|Good idea. Take your time. I will send out a message when we get into Cambridge Bay."),
-		},
+		{name: "no expiry"},
+		{name: "absolute expiry", expires: expires},
+		{name: "time to live", ttl: time.Hour},
+		{name: "both set", expires: expires, ttl: time.Hour, wantErr: true},
+		{name: "already expired", expires: time.Now().Add(-time.Hour), wantErr: true},
+		{name: "negative time to live", ttl: -time.Hour, wantErr: true},
+		{name: "latest expiry", expires: latestExpiry},
+		{name: "after latest expiry", expires: latestExpiry.Add(time.Nanosecond), wantErr: true},
+		{name: "far future", expires: time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC), wantErr: true},
+		{name: "time to live past latest expiry", ttl: time.Duration(math.MaxInt64), wantErr: true},
 	}
 
 	for _, tc := range tt {
-		gotMessageData := tc.rawMsg.messageDataForSigning()
-
-		if !bytes.Equal(gotMessageData, tc.wantMessageData) {
-			t.Errorf("message data mismatch. got=%s want=%s", gotMessageData, tc.wantMessageData)
+		rawMsg := RawMessage{
+			ToName:     "Bob",
+			ToVessel:   "Snow",
+			FromName:   "Kevin",
+			FromVessel: "Liberty",
+			Subject:    "Tuesday",
+			Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+			Expires:    tc.expires,
+			TTL:        tc.ttl,
 		}
-	}
-}
 
-func TestCreateSignature(t *testing.T) {
-	tt := []struct {
-		rawMsg        RawMessage
-		wantSignature string
-	}{
-		{
-			rawMsg: RawMessage{
-				ToName:     "bob",
-				ToVessel:   "snow",
-				FromName:   "kevin",
-				FromVessel: "liberty",
-				Subject:    "Tuesday",
-				Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
-			},
-			wantSignature: "2d18d51dee10b1c5b5e673652b9744ebc8f0900c114cb34262b1429738a116f9",
-		},
-		{
-			rawMsg: RawMessage{
-				ToName:     "kevin",
-				ToVessel:   "liberty",
-				FromName:   "bob",
-				FromVessel: "snow",
-				Subject:    "Re: Tuesday",
-				Body:       "I will need to wait longer because of needed repair work. Hope to catch up.",
-			},
-			wantSignature: "7bf816982b5d8c52822a366e68d9fd2662c9192e4a86473d4dfdfbd29cfd64d5",
-		},
-		{
-			rawMsg: RawMessage{
-				ToName:     "bob",
-				ToVessel:   "snow",
-				FromName:   "kevin",
-				FromVessel: "liberty",
-				Subject:    "Re: Re: Tuesday",
-				Body:       "Good idea. Take your time. I will send out a message when we get into Cambridge Bay.",
-			},
-			wantSignature: "1a936de118b68b1cea9469ec5cd22b7bd65bef71027eb35b88c931ad66eaa870",
-		},
-	}
-
-	for _, tc := range tt {
-		gotSignature, err := tc.rawMsg.createSignature(rawMsgSecretKey)
-		if err != nil {
-			t.Errorf("create signature failed unexpectedly due to: %q", err)
+		pkgMsg, gotErr := rawMsg.ToPackagedMessage(rawMsgSecretKey)
+		if tc.wantErr {
+			if gotErr == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if gotErr != nil {
+			t.Errorf("%s: did not expect error: got=%q", tc.name, gotErr)
+			continue
 		}
 
-		if gotSignature != tc.wantSignature {
-			t.Errorf("signature mismatch. got=%s want=%s", gotSignature, tc.wantSignature)
+		switch {
+		case tc.ttl != 0 && !pkgMsg.Expires.Equal(pkgMsg.Packaged.Add(tc.ttl)):
+			t.Errorf("%s: expiry should be ttl after packaging. got=%v", tc.name, pkgMsg.Expires)
+		case !tc.expires.IsZero() && !pkgMsg.Expires.Equal(tc.expires):
+			t.Errorf("%s: expiry mismatch. got=%v want=%v", tc.name, pkgMsg.Expires, tc.expires)
+		case tc.ttl == 0 && tc.expires.IsZero() && !pkgMsg.Expires.IsZero():
+			t.Errorf("%s: message should not expire. got=%v", tc.name, pkgMsg.Expires)
 		}
 	}
 }
@@ -0,0 +1,246 @@
+package msg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// *** Types ***
+
+// RecipientKey is the public key that messages to the recipient are encrypted for
+type RecipientKey struct {
+	Recipient     UserVessel `json:"recipient"`
+	EncryptionKey string     `json:"encryptionKey"`
+}
+
+// *** Encryption Schemes ***
+
+// EncryptionX25519AESGCM encrypts for the recipients x25519 public key using a new
+// ephemeral key per message. The shared secret is expanded with hkdf-sha256 into
+// an aes-256-gcm key, and each encrypted field is stored as base64(nonce || ciphertext).
+const EncryptionX25519AESGCM = "x25519-hkdf-sha256-aes256gcm"
+
+// sealedDomain is the hkdf info, and starts the additional data of every encrypted field
+const sealedDomain = "async-messages/sealed/v1"
+
+// *** Errors ***
+
+// ErrUnknownEncryption is returned when a message is encrypted with a scheme this package does not know
+var ErrUnknownEncryption = errors.New("encryption scheme is unknown")
+
+// ErrNotEncrypted is returned when opening a message that is not encrypted
+var ErrNotEncrypted = errors.New("message is not encrypted")
+
+// ErrSealedWithSecret is returned when a message is encrypted but signed with an hmac secret.
+// Whoever else holds the secret, such as the server, could have sealed it for the recipient instead.
+var ErrSealedWithSecret = errors.New("encrypted messages must be signed with a public key")
+
+// ErrDecryptionFailed is returned when an encrypted field cannot be decrypted,
+// either because it is for someone else or it was altered
+var ErrDecryptionFailed = errors.New("unable to decrypt message")
+
+// *** Encryption Keys ***
+
+// NewEncryptionKey generates a private key that messages can be encrypted for
+func NewEncryptionKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// ParseEncryptionKey parses a base64 encoded x25519 private key
+func ParseEncryptionKey(encodedKey string) (*ecdh.PrivateKey, error) {
+	keyData, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode encryption key: %w", err)
+	}
+	return ecdh.X25519().NewPrivateKey(keyData)
+}
+
+// ParsePublicEncryptionKey parses a base64 encoded x25519 public key
+func ParsePublicEncryptionKey(encodedKey string) (*ecdh.PublicKey, error) {
+	keyData, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode encryption key: %w", err)
+	}
+	return ecdh.X25519().NewPublicKey(keyData)
+}
+
+// EncodeEncryptionKey base64 encodes an x25519 public key
+func EncodeEncryptionKey(publicKey *ecdh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(publicKey.Bytes())
+}
+
+// *** Functions ***
+
+// IsEncrypted reports whether the body, and possibly the subject, are encrypted
+func (m *PackagedMessage) IsEncrypted() bool {
+	return m.Encryption != ""
+}
+
+// Open verifies the message with the public key of its sender, then returns a copy of the message
+// with its encrypted fields decrypted by the recipients private key. The signature covers the
+// ephemeral key, so only the sender could have sealed the message for the recipient.
+func (m *PackagedMessage) Open(privateKey *ecdh.PrivateKey, keys Keyring) (PackagedMessage, error) {
+	if !m.IsEncrypted() {
+		return PackagedMessage{}, ErrNotEncrypted
+	}
+	err := m.checkEncryption()
+	if err != nil {
+		return PackagedMessage{}, err
+	}
+	err = m.VerifyMessageWith(keys)
+	if err != nil {
+		return PackagedMessage{}, err
+	}
+
+	ephemeralKey, err := ParsePublicEncryptionKey(m.EphemeralKey)
+	if err != nil {
+		return PackagedMessage{}, fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	sharedSecret, err := privateKey.ECDH(ephemeralKey)
+	if err != nil {
+		return PackagedMessage{}, fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	aead, err := sealedAEAD(sharedSecret, ephemeralKey, privateKey.PublicKey())
+	if err != nil {
+		return PackagedMessage{}, err
+	}
+
+	opened := *m
+	opened.Encryption = ""
+	opened.EphemeralKey = ""
+	opened.EncryptedSubject = false
+
+	opened.Body, err = m.openField(aead, tagBody, m.Body)
+	if err != nil {
+		return PackagedMessage{}, err
+	}
+	if m.EncryptedSubject {
+		opened.Subject, err = m.openField(aead, tagSubject, m.Subject)
+		if err != nil {
+			return PackagedMessage{}, err
+		}
+	}
+
+	return opened, nil
+}
+
+// seal encrypts the body, and the subject if asked, for the recipient.
+// Must be done after the id and addresses are set, and before signing.
+func (m *PackagedMessage) seal(recipient *ecdh.PublicKey, sealSubject bool) error {
+	ephemeralKey, err := NewEncryptionKey()
+	if err != nil {
+		return err
+	}
+	sharedSecret, err := ephemeralKey.ECDH(recipient)
+	if err != nil {
+		return err
+	}
+	aead, err := sealedAEAD(sharedSecret, ephemeralKey.PublicKey(), recipient)
+	if err != nil {
+		return err
+	}
+
+	m.Encryption = EncryptionX25519AESGCM
+	m.EphemeralKey = EncodeEncryptionKey(ephemeralKey.PublicKey())
+	m.EncryptedSubject = sealSubject
+
+	m.Body, err = m.sealField(aead, tagBody, m.Body)
+	if err != nil {
+		return err
+	}
+	if sealSubject {
+		m.Subject, err = m.sealField(aead, tagSubject, m.Subject)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkEncryption makes sure the encryption fields are consistent
+func (m *PackagedMessage) checkEncryption() error {
+	if !m.IsEncrypted() {
+		if m.EphemeralKey != "" || m.EncryptedSubject {
+			return fmt.Errorf("%w: message has encryption fields but no scheme", ErrUnknownEncryption)
+		}
+		return nil
+	}
+
+	if m.Encryption != EncryptionX25519AESGCM {
+		return fmt.Errorf("%w: %q", ErrUnknownEncryption, m.Encryption)
+	}
+	if m.EphemeralKey == "" {
+		return &MissingFieldError{Field: "EphemeralKey"}
+	}
+	if sameAlgorithm(m.Algorithm, AlgorithmHMACSHA256) {
+		return ErrSealedWithSecret
+	}
+	return nil
+}
+
+// sealField encrypts a single field, binding it to the message it belongs to
+func (m *PackagedMessage) sealField(aead cipher.AEAD, tag byte, plaintext string) (string, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), m.sealedAdditionalData(tag))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openField decrypts a single field sealed by sealField
+func (m *PackagedMessage) openField(aead cipher.AEAD, tag byte, encoded string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("%w: field is too short", ErrDecryptionFailed)
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, m.sealedAdditionalData(tag))
+	if err != nil {
+		return "", ErrDecryptionFailed
+	}
+	return string(plaintext), nil
+}
+
+// sealedAdditionalData ties an encrypted field to the message, so that it
+// cannot be moved into another message or swapped with another field
+func (m *PackagedMessage) sealedAdditionalData(tag byte) []byte {
+	e := newCanonicalEncoder(sealedDomain)
+	e.writeString(tagID, m.ID)
+	e.writeString(tagToName, m.To.Name)
+	e.writeString(tagToVessel, m.To.Vessel)
+	e.writeString(tagFromName, m.From.Name)
+	e.writeString(tagFromVessel, m.From.Vessel)
+	e.writeTime(tagPackaged, m.Packaged)
+	// which field is encrypted goes last
+	e.writeRaw([]byte{tag})
+	return e.bytes()
+}
+
+// sealedAEAD derives the aes-256-gcm cipher shared by the sender and recipient
+func sealedAEAD(sharedSecret []byte, ephemeralKey, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	salt := append(ephemeralKey.Bytes(), recipient.Bytes()...)
+	key, err := hkdf.Key(sha256.New, sharedSecret, salt, sealedDomain, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,293 @@
+package msg
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var sealedRawMsg = RawMessage{
+	ToName:     "Bob",
+	ToVessel:   "Snow",
+	FromName:   "Kevin",
+	FromVessel: "Liberty",
+	Subject:    "Tuesday",
+	Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+}
+
+// sealed messages are signed with a private key, so that only the sender can seal them
+var sealedSigner = &ed25519Signer{privateKey: ed25519.NewKeyFromSeed(signerSeed)}
+
+var sealedKeys = &testKeyring{
+	secretKeys: map[UserVessel][]byte{
+		{Name: "Kevin", Vessel: "Liberty"}: []byte("kevin's hmac key"),
+	},
+	publicKeys: map[UserVessel]ed25519.PublicKey{
+		{Name: "Kevin", Vessel: "Liberty"}: ed25519.NewKeyFromSeed(signerSeed).Public().(ed25519.PublicKey),
+	},
+}
+
+func TestSealedMessageRoundTrip(t *testing.T) {
+	bobKey, err := NewEncryptionKey()
+	if err != nil {
+		t.Fatalf("Unable to create encryption key due to: %q", err)
+	}
+
+	tt := []struct {
+		name        string
+		sealSubject bool
+	}{
+		{name: "body only", sealSubject: false},
+		{name: "body and subject", sealSubject: true},
+	}
+
+	for _, tc := range tt {
+		rawMsg := sealedRawMsg
+		pkgMsg, err := rawMsg.ToSealedMessage(sealedSigner, bobKey.PublicKey(), tc.sealSubject)
+		if err != nil {
+			t.Fatalf("%s: unable to seal message due to: %q", tc.name, err)
+		}
+
+		if !pkgMsg.IsEncrypted() {
+			t.Errorf("%s: message should be encrypted", tc.name)
+		}
+		if strings.Contains(pkgMsg.Body, "tuesday") {
+			t.Errorf("%s: body is in plaintext: %q", tc.name, pkgMsg.Body)
+		}
+		if tc.sealSubject == (pkgMsg.Subject == sealedRawMsg.Subject) {
+			t.Errorf("%s: subject sealed mismatch. got=%q", tc.name, pkgMsg.Subject)
+		}
+
+		// the server can verify without being able to read it
+		err = pkgMsg.VerifyMessageWith(sealedKeys)
+		if err != nil {
+			t.Errorf("%s: did not expect error: got=%q", tc.name, err)
+		}
+
+		opened, err := pkgMsg.Open(bobKey, sealedKeys)
+		if err != nil {
+			t.Fatalf("%s: unable to open message due to: %q", tc.name, err)
+		}
+		if opened.Subject != sealedRawMsg.Subject || opened.Body != sealedRawMsg.Body {
+			t.Errorf("%s: opened message mismatch. got=%q/%q", tc.name, opened.Subject, opened.Body)
+		}
+		if opened.IsEncrypted() || opened.EncryptedSubject || opened.EphemeralKey != "" {
+			t.Errorf("%s: opened message should not have encryption fields", tc.name)
+		}
+		if opened.ID != pkgMsg.ID {
+			t.Errorf("%s: id mismatch. got=%q want=%q", tc.name, opened.ID, pkgMsg.ID)
+		}
+	}
+}
+
+func TestOpenSealedMessageFails(t *testing.T) {
+	bobKey, err := NewEncryptionKey()
+	if err != nil {
+		t.Fatalf("Unable to create encryption key due to: %q", err)
+	}
+	eveKey, err := NewEncryptionKey()
+	if err != nil {
+		t.Fatalf("Unable to create encryption key due to: %q", err)
+	}
+
+	rawMsg := sealedRawMsg
+	sealedMsg, err := rawMsg.ToSealedMessage(sealedSigner, bobKey.PublicKey(), true)
+	if err != nil {
+		t.Fatalf("Unable to seal message due to: %q", err)
+	}
+
+	// altered messages are caught by the signature before they are decrypted
+	tt := []struct {
+		name    string
+		alter   func(m *PackagedMessage)
+		wantErr error
+	}{
+		{
+			name:    "wrong recipient key",
+			alter:   func(m *PackagedMessage) {},
+			wantErr: ErrDecryptionFailed,
+		},
+		{
+			name:    "swapped fields",
+			alter:   func(m *PackagedMessage) { m.Subject, m.Body = m.Body, m.Subject },
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "different id",
+			alter:   func(m *PackagedMessage) { m.ID = "01JWNNSVG00000000000000000" },
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "truncated body",
+			alter:   func(m *PackagedMessage) { m.Body = m.Body[:8] },
+			wantErr: ErrInvalidSignature,
+		},
+	}
+
+	for i, tc := range tt {
+		pkgMsg := *sealedMsg
+		tc.alter(&pkgMsg)
+
+		// only the first case uses someone elses key
+		key := bobKey
+		if i == 0 {
+			key = eveKey
+		}
+
+		_, gotErr := pkgMsg.Open(key, sealedKeys)
+		if !errors.Is(gotErr, tc.wantErr) {
+			t.Errorf("%s: expected %v, got=%v", tc.name, tc.wantErr, gotErr)
+		}
+	}
+
+	// a message that is not encrypted cannot be opened
+	plainMsg, err := rawMsg.ToPackagedMessage([]byte("kevin's hmac key"))
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+	_, gotErr := plainMsg.Open(bobKey, sealedKeys)
+	if !errors.Is(gotErr, ErrNotEncrypted) {
+		t.Errorf("expected ErrNotEncrypted, got=%v", gotErr)
+	}
+}
+
+func TestSealedMessageIsBoundToSender(t *testing.T) {
+	bobKey, err := NewEncryptionKey()
+	if err != nil {
+		t.Fatalf("Unable to create encryption key due to: %q", err)
+	}
+
+	// an hmac secret is shared with the server, which could seal messages in the senders place
+	rawMsg := sealedRawMsg
+	_, err = rawMsg.ToSealedMessage(NewHMACSigner([]byte("kevin's hmac key")), bobKey.PublicKey(), true)
+	if !errors.Is(err, ErrSealedWithSecret) {
+		t.Errorf("Expected ErrSealedWithSecret, got=%v", err)
+	}
+
+	sealedMsg, err := rawMsg.ToSealedMessage(sealedSigner, bobKey.PublicKey(), false)
+	if err != nil {
+		t.Fatalf("Unable to seal message due to: %q", err)
+	}
+
+	// the server seals a body of its own under a new ephemeral key, keeping the senders signature
+	forgedRawMsg := sealedRawMsg
+	forgedRawMsg.Body = "change of plans, proceed on wednesday"
+	forgedMsg, err := forgedRawMsg.ToSealedMessage(sealedSigner, bobKey.PublicKey(), false)
+	if err != nil {
+		t.Fatalf("Unable to seal message due to: %q", err)
+	}
+	resealed := *sealedMsg
+	resealed.EphemeralKey = forgedMsg.EphemeralKey
+	resealed.Body = forgedMsg.Body
+	_, err = resealed.Open(bobKey, sealedKeys)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for a swapped ephemeral key, got=%v", err)
+	}
+
+	// or signs it again with the senders hmac secret
+	resigned := *sealedMsg
+	err = resigned.sign(NewHMACSigner([]byte("kevin's hmac key")))
+	if err != nil {
+		t.Fatalf("Unable to sign message due to: %q", err)
+	}
+	_, err = resigned.Open(bobKey, sealedKeys)
+	if !errors.Is(err, ErrSealedWithSecret) {
+		t.Errorf("Expected ErrSealedWithSecret, got=%v", err)
+	}
+}
+
+func TestVerifySealedMessage(t *testing.T) {
+	bobKey, err := NewEncryptionKey()
+	if err != nil {
+		t.Fatalf("Unable to create encryption key due to: %q", err)
+	}
+
+	rawMsg := sealedRawMsg
+	sealedMsg, err := rawMsg.ToSealedMessage(sealedSigner, bobKey.PublicKey(), false)
+	if err != nil {
+		t.Fatalf("Unable to seal message due to: %q", err)
+	}
+
+	tt := []struct {
+		name  string
+		alter func(m *PackagedMessage)
+	}{
+		{
+			name:  "altered ciphertext",
+			alter: func(m *PackagedMessage) { m.Body = strings.ToLower(m.Body) },
+		},
+		{
+			name:  "unknown scheme",
+			alter: func(m *PackagedMessage) { m.Encryption = "rot13" },
+		},
+		{
+			name:  "subject marked encrypted",
+			alter: func(m *PackagedMessage) { m.EncryptedSubject = true },
+		},
+		{
+			name:  "encryption removed",
+			alter: func(m *PackagedMessage) { m.Encryption = "" },
+		},
+		{
+			name:  "legacy signature version",
+			alter: func(m *PackagedMessage) { m.SignatureVersion = SignatureVersionLegacy },
+		},
+	}
+
+	for _, tc := range tt {
+		pkgMsg := *sealedMsg
+		tc.alter(&pkgMsg)
+
+		gotErr := pkgMsg.VerifyMessageWith(sealedKeys)
+		if gotErr == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestSealedQueueSummary(t *testing.T) {
+	bobKey, err := NewEncryptionKey()
+	if err != nil {
+		t.Fatalf("Unable to create encryption key due to: %q", err)
+	}
+
+	rawMsg := sealedRawMsg
+	sealedMsg, err := rawMsg.ToSealedMessage(sealedSigner, bobKey.PublicKey(), true)
+	if err != nil {
+		t.Fatalf("Unable to seal message due to: %q", err)
+	}
+
+	queue := NewQueue()
+	queue.Enqueue(*sealedMsg)
+
+	wantQueueSummary := "1 messages in queue\nMessage subjects: (encrypted)\n"
+	gotQueueSummary := queue.QueueSummary()
+	if wantQueueSummary != gotQueueSummary {
+		t.Errorf("queue dump does not match. got=%q want=%q", gotQueueSummary, wantQueueSummary)
+	}
+}
+
+func TestParseEncryptionKeys(t *testing.T) {
+	bobKey, err := NewEncryptionKey()
+	if err != nil {
+		t.Fatalf("Unable to create encryption key due to: %q", err)
+	}
+
+	publicKey, err := ParsePublicEncryptionKey(EncodeEncryptionKey(bobKey.PublicKey()))
+	if err != nil {
+		t.Fatalf("Unable to parse public key due to: %q", err)
+	}
+	if !publicKey.Equal(bobKey.PublicKey()) {
+		t.Error("parsed public key does not match")
+	}
+
+	_, err = ParsePublicEncryptionKey("not base64!")
+	if err == nil {
+		t.Error("expected an error for invalid base64")
+	}
+	_, err = ParseEncryptionKey("c2hvcnQ=")
+	if err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
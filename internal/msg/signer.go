@@ -0,0 +1,196 @@
+package msg
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// *** Algorithms ***
+
+const (
+	// AlgorithmHMACSHA256 signs with a secret shared between the user and the server.
+	// Messages without an algorithm use it.
+	AlgorithmHMACSHA256 = "hmac-sha256"
+	// AlgorithmEd25519 signs with a private key, and is verified with the users public key
+	AlgorithmEd25519 = "ed25519"
+)
+
+// *** Types ***
+
+// SenderKey is the public key that messages from the sender are verified with
+type SenderKey struct {
+	Sender    UserVessel `json:"sender"`
+	PublicKey string     `json:"publicKey"`
+}
+
+// Signer signs data on behalf of a single user, and can check its own signatures
+type Signer interface {
+	// Algorithm is recorded on signed messages so they can be verified
+	Algorithm() string
+	Sign(data []byte) ([]byte, error)
+	Verify(data, signature []byte) error
+}
+
+// Keyring looks up the keys that users sign with. Both return an error wrapping
+// ErrUnknownSigner when the user has no such key. A user with a public key only
+// signs with it, so their messages are never verified with an hmac secret.
+type Keyring interface {
+	// SigningKey returns the users hmac secret
+	SigningKey(uv UserVessel) ([]byte, error)
+	// PublicKey returns the users ed25519 public key
+	PublicKey(uv UserVessel) (ed25519.PublicKey, error)
+}
+
+// verifier checks signatures made by a single user
+type verifier interface {
+	Verify(data, signature []byte) error
+}
+
+type hmacSigner struct {
+	secretKey []byte
+}
+
+type ed25519Signer struct {
+	privateKey ed25519.PrivateKey
+}
+
+type ed25519Verifier struct {
+	publicKey ed25519.PublicKey
+}
+
+// *** Errors ***
+
+// ErrUnknownAlgorithm is returned when a message is signed with an algorithm this package does not know
+var ErrUnknownAlgorithm = errors.New("signature algorithm is unknown")
+
+// ErrAlgorithmMismatch is returned when a message is signed with an algorithm the signers key is not for
+var ErrAlgorithmMismatch = errors.New("signature algorithm does not match the signers key")
+
+// ErrInvalidSignature is returned when a signature does not match
+var ErrInvalidSignature = errors.New("signature is invalid")
+
+// *** New Signers ***
+
+// NewHMACSigner signs with an hmac-sha256 secret
+func NewHMACSigner(secretKey []byte) Signer {
+	return &hmacSigner{secretKey: secretKey}
+}
+
+// NewEd25519Signer signs with an ed25519 private key
+func NewEd25519Signer(privateKey ed25519.PrivateKey) (Signer, error) {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("ed25519 private key must be %d bytes, got %d", ed25519.PrivateKeySize, len(privateKey))
+	}
+	return &ed25519Signer{privateKey: privateKey}, nil
+}
+
+// *** Public Keys ***
+
+// ParsePublicKey parses a base64 encoded ed25519 public key
+func ParsePublicKey(encodedKey string) (ed25519.PublicKey, error) {
+	keyData, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode public key: %w", err)
+	}
+	if len(keyData) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("ed25519 public key must be %d bytes, got %d", ed25519.PublicKeySize, len(keyData))
+	}
+	return ed25519.PublicKey(keyData), nil
+}
+
+// EncodePublicKey base64 encodes an ed25519 public key
+func EncodePublicKey(publicKey ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(publicKey)
+}
+
+// *** Functions ***
+
+func (s *hmacSigner) Algorithm() string {
+	return AlgorithmHMACSHA256
+}
+
+func (s *hmacSigner) Sign(data []byte) ([]byte, error) {
+	return hmacSum(data, s.secretKey)
+}
+
+func (s *hmacSigner) Verify(data, signature []byte) error {
+	calculatedSignature, err := hmacSum(data, s.secretKey)
+	if err != nil {
+		return err
+	}
+
+	// securely perform comparison of signatures
+	if !hmac.Equal(calculatedSignature, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (s *ed25519Signer) Algorithm() string {
+	return AlgorithmEd25519
+}
+
+func (s *ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(s.privateKey, data), nil
+}
+
+func (s *ed25519Signer) Verify(data, signature []byte) error {
+	publicKey := s.privateKey.Public().(ed25519.PublicKey)
+	return (&ed25519Verifier{publicKey: publicKey}).Verify(data, signature)
+}
+
+func (v *ed25519Verifier) Verify(data, signature []byte) error {
+	if !ed25519.Verify(v.publicKey, data, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// verifierFor returns a verifier for signatures made by the user with the algorithm
+func verifierFor(keys Keyring, uv UserVessel, algorithm string) (verifier, error) {
+	switch algorithm {
+	case "", AlgorithmHMACSHA256:
+		// otherwise anyone holding a secret the keyring has for the user, such as the
+		// server itself, could sign as a user who only ever signs with their private key
+		_, err := keys.PublicKey(uv)
+		if err == nil {
+			return nil, fmt.Errorf("%w: %s signs with %s", ErrAlgorithmMismatch, uv.String(), AlgorithmEd25519)
+		}
+		if !errors.Is(err, ErrUnknownSigner) {
+			return nil, err
+		}
+
+		secretKey, err := keys.SigningKey(uv)
+		if err != nil {
+			return nil, err
+		}
+		return &hmacSigner{secretKey: secretKey}, nil
+
+	case AlgorithmEd25519:
+		publicKey, err := keys.PublicKey(uv)
+		if err != nil {
+			return nil, err
+		}
+		if len(publicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("ed25519 public key for %s must be %d bytes", uv.String(), ed25519.PublicKeySize)
+		}
+		return &ed25519Verifier{publicKey: publicKey}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, algorithm)
+	}
+}
+
+// sameAlgorithm compares algorithms, treating no algorithm as hmac-sha256
+func sameAlgorithm(a, b string) bool {
+	if a == "" {
+		a = AlgorithmHMACSHA256
+	}
+	if b == "" {
+		b = AlgorithmHMACSHA256
+	}
+	return a == b
+}
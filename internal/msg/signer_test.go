@@ -0,0 +1,162 @@
+package msg
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testKeyring is a keyring backed by maps
+type testKeyring struct {
+	secretKeys map[UserVessel][]byte
+	publicKeys map[UserVessel]ed25519.PublicKey
+}
+
+func (kr *testKeyring) SigningKey(uv UserVessel) ([]byte, error) {
+	key, ok := kr.secretKeys[uv]
+	if !ok {
+		return nil, ErrUnknownSigner
+	}
+	return key, nil
+}
+
+func (kr *testKeyring) PublicKey(uv UserVessel) (ed25519.PublicKey, error) {
+	key, ok := kr.publicKeys[uv]
+	if !ok {
+		return nil, ErrUnknownSigner
+	}
+	return key, nil
+}
+
+// signerSeed is a fixed ed25519 seed so that keys are repeatable
+var signerSeed = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEd25519SignedMessage(t *testing.T) {
+	privateKey := ed25519.NewKeyFromSeed(signerSeed)
+	signer, err := NewEd25519Signer(privateKey)
+	if err != nil {
+		t.Fatalf("Unable to create signer due to: %q", err)
+	}
+
+	kevin := UserVessel{Name: "Kevin", Vessel: "Liberty"}
+	keys := &testKeyring{
+		publicKeys: map[UserVessel]ed25519.PublicKey{kevin: privateKey.Public().(ed25519.PublicKey)},
+	}
+
+	rawMsg := RawMessage{
+		ToName:     "Bob",
+		ToVessel:   "Snow",
+		FromName:   "Kevin",
+		FromVessel: "Liberty",
+		Subject:    "Tuesday",
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+	}
+	pkgMsg, err := rawMsg.ToPackagedMessageWith(signer)
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+
+	if pkgMsg.Algorithm != AlgorithmEd25519 {
+		t.Errorf("Algorithm mismatch. got=%q want=%q", pkgMsg.Algorithm, AlgorithmEd25519)
+	}
+
+	// verifies against the registered public key, and the signer itself
+	err = pkgMsg.VerifyMessageWith(keys)
+	if err != nil {
+		t.Errorf("Did not expect error: got=%q", err)
+	}
+	err = pkgMsg.VerifyMessageBy(signer)
+	if err != nil {
+		t.Errorf("Did not expect error: got=%q", err)
+	}
+
+	// should not be accepted as an hmac message
+	err = pkgMsg.VerifyMessage([]byte("kevin's hmac key"))
+	if err == nil {
+		t.Error("ed25519 message should not verify with an hmac key")
+	}
+
+	// downgrading the algorithm should not verify
+	downgraded := *pkgMsg
+	downgraded.Algorithm = ""
+	err = downgraded.VerifyMessageWith(keys)
+	if err == nil {
+		t.Error("downgraded message should not verify")
+	}
+
+	// altering the body should not verify
+	altered := *pkgMsg
+	altered.Body += "!"
+	err = altered.VerifyMessageWith(keys)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature, but got %v", err)
+	}
+}
+
+func TestHMACFromEd25519UserFails(t *testing.T) {
+	privateKey := ed25519.NewKeyFromSeed(signerSeed)
+	kevin := UserVessel{Name: "Kevin", Vessel: "Liberty"}
+	// the keyring also holds a secret for kevin, such as a key shared by his vessel
+	vesselKey := []byte("liberty's hmac key")
+	keys := &testKeyring{
+		secretKeys: map[UserVessel][]byte{kevin: vesselKey},
+		publicKeys: map[UserVessel]ed25519.PublicKey{kevin: privateKey.Public().(ed25519.PublicKey)},
+	}
+
+	rawMsg := RawMessage{
+		ToName:     "Bob",
+		ToVessel:   "Snow",
+		FromName:   "Kevin",
+		FromVessel: "Liberty",
+		Subject:    "Tuesday",
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+	}
+	forged, err := rawMsg.ToPackagedMessageWith(NewHMACSigner(vesselKey))
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+
+	err = forged.VerifyMessageWith(keys)
+	if !errors.Is(err, ErrAlgorithmMismatch) {
+		t.Errorf("Expected ErrAlgorithmMismatch, but got %v", err)
+	}
+
+	// nor can the secret sign mailbox requests as kevin
+	req, err := NewMailboxRequest(kevin, NewHMACSigner(vesselKey), "GET", "/get-messages", nil)
+	if err != nil {
+		t.Fatalf("Unable to create mailbox request due to: %q", err)
+	}
+	err = req.VerifyRequest(keys, time.Now(), time.Minute)
+	if !errors.Is(err, ErrAlgorithmMismatch) {
+		t.Errorf("Expected ErrAlgorithmMismatch, but got %v", err)
+	}
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	rawMsg := RawMessage{
+		ToName:     "Bob",
+		ToVessel:   "Snow",
+		FromName:   "Kevin",
+		FromVessel: "Liberty",
+		Subject:    "Tuesday",
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+	}
+	pkgMsg, err := rawMsg.ToPackagedMessage([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+
+	pkgMsg.Algorithm = "rot13"
+	err = pkgMsg.VerifyMessageWith(&testKeyring{})
+	if !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("Expected ErrUnknownAlgorithm, but got %v", err)
+	}
+}
+
+func TestNewEd25519SignerBadKey(t *testing.T) {
+	_, err := NewEd25519Signer(ed25519.PrivateKey("too short"))
+	if err == nil {
+		t.Error("Expected an error for a short private key")
+	}
+}
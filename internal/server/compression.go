@@ -0,0 +1,237 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// minCompressBytes is how large a response must be before it is worth compressing,
+// smaller responses grow from the framing of the encoding
+const minCompressBytes = 1024
+
+// acceptedEncodings is advertised on every response, so clients know they can compress requests (RFC 7694)
+const acceptedEncodings = "gzip, deflate"
+
+// *** Errors ***
+
+// errUnsupportedEncoding is returned when a request body is compressed with an encoding the server cannot decode
+var errUnsupportedEncoding = errors.New("content encoding is not supported")
+
+// *** Internal Types ***
+
+// compressWriter compresses the response written through it.
+// It holds back the start of the response until there is enough to be worth compressing,
+// and sends it as is if there never is.
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding   string
+	held       []byte
+	compressor compressor
+	// set once the response is sent without compression
+	identity bool
+}
+
+// compressor is the writer of an encoding, both gzip and zlib writers are
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// decodedBody reads the decoded contents of a request body, closing the body once done
+type decodedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+// *** Functions ***
+
+// compression decodes compressed request bodies and compresses responses
+// for clients that accept it, so handlers only ever see plain bodies
+func compression(c *gin.Context) {
+	c.Header("Accept-Encoding", acceptedEncodings)
+
+	err := decodeRequestBody(c)
+	if errors.Is(err, errUnsupportedEncoding) {
+		log.Printf("unable to decode request body due to: %q", err)
+		c.AbortWithStatus(415) // unsupported media type
+		return
+	}
+	if err != nil {
+		log.Printf("unable to decode request body due to: %q", err)
+		c.AbortWithStatus(400) // bad request
+		return
+	}
+
+	encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"))
+	if encoding == "" {
+		c.Next()
+		return
+	}
+
+	// caches must keep compressed and plain responses apart
+	c.Writer.Header().Add("Vary", "Accept-Encoding")
+	writer := &compressWriter{ResponseWriter: c.Writer, encoding: encoding}
+	c.Writer = writer
+	c.Next()
+
+	err = writer.Close()
+	if err != nil {
+		log.Printf("unable to compress response due to: %q", err)
+	}
+}
+
+// decodeRequestBody replaces a compressed request body with its decoded contents.
+// The decoded body is bounded by the largest body any endpoint accepts.
+func decodeRequestBody(c *gin.Context) error {
+	encoding := strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding")))
+
+	var decoded io.ReadCloser
+	var err error
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		decoded, err = gzip.NewReader(c.Request.Body)
+	case "deflate":
+		// http calls the zlib format deflate
+		decoded, err = zlib.NewReader(c.Request.Body)
+	default:
+		return fmt.Errorf("%w: %q", errUnsupportedEncoding, encoding)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s body: %w", encoding, err)
+	}
+
+	c.Request.Body = &decodedBody{
+		Reader: http.MaxBytesReader(c.Writer, decoded, maxBatchBytes),
+		body:   c.Request.Body,
+	}
+	c.Request.Header.Del("Content-Encoding")
+	c.Request.Header.Del("Content-Length")
+	c.Request.ContentLength = -1
+	return nil
+}
+
+func (d *decodedBody) Close() error {
+	return d.body.Close()
+}
+
+// negotiateEncoding picks the encoding to compress a response with from the Accept-Encoding header.
+// gzip is preferred over deflate when both are accepted equally, returns "" when neither is accepted.
+func negotiateEncoding(acceptEncoding string) string {
+	best := ""
+	bestQuality := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+
+		quality := 1.0
+		rawQuality, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if ok {
+			parsed, err := strconv.ParseFloat(rawQuality, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+
+		if quality > bestQuality || (quality == bestQuality && name == "gzip") {
+			best, bestQuality = name, quality
+		}
+	}
+	return best
+}
+
+// Write holds back the response until it is large enough to compress
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.identity {
+		return w.ResponseWriter.Write(data)
+	}
+	if w.compressor != nil {
+		return w.compressor.Write(data)
+	}
+
+	w.held = append(w.held, data...)
+	if len(w.held) >= minCompressBytes {
+		err := w.start(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends what has been written so far, compressing it if the response is a stream
+func (w *compressWriter) Flush() {
+	if !w.identity && w.compressor == nil {
+		err := w.start(len(w.held) > 0)
+		if err != nil {
+			log.Printf("unable to compress response due to: %q", err)
+			return
+		}
+	}
+	if w.compressor != nil {
+		err := w.compressor.Flush()
+		if err != nil {
+			log.Printf("unable to compress response due to: %q", err)
+			return
+		}
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Close finishes the response, sending anything that was held back
+func (w *compressWriter) Close() error {
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+	if w.identity || len(w.held) == 0 {
+		return nil
+	}
+	return w.start(false)
+}
+
+// start sends the held back response, either compressed or as is
+func (w *compressWriter) start(compress bool) error {
+	// headers that were already sent cannot announce the encoding,
+	// and events are left as they are so that each one arrives straight away
+	if w.ResponseWriter.Written() || strings.HasPrefix(w.ResponseWriter.Header().Get("Content-Type"), "text/event-stream") {
+		compress = false
+	}
+
+	held := w.held
+	w.held = nil
+	if !compress {
+		w.identity = true
+		_, err := w.ResponseWriter.Write(held)
+		return err
+	}
+
+	header := w.ResponseWriter.Header()
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+
+	if w.encoding == "gzip" {
+		w.compressor = gzip.NewWriter(w.ResponseWriter)
+	} else {
+		w.compressor = zlib.NewWriter(w.ResponseWriter)
+	}
+	_, err := w.compressor.Write(held)
+	return err
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newCompressionServer serves plain responses of a few sizes through the compression middleware
+func newCompressionServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(compression)
+	r.GET("/small", func(c *gin.Context) {
+		c.String(200, strings.Repeat("a", minCompressBytes-1))
+	})
+	r.GET("/large", func(c *gin.Context) {
+		c.String(200, strings.Repeat("a", minCompressBytes))
+	})
+	r.GET("/stream", func(c *gin.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		c.String(200, strings.Repeat("a", 2*minCompressBytes))
+	})
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResponseCompression(t *testing.T) {
+	server := newCompressionServer(t)
+
+	tests := []struct {
+		name           string
+		target         string
+		acceptEncoding string
+		wantEncoding   string
+		wantLength     int
+	}{
+		{"gzip", "/large", "gzip", "gzip", minCompressBytes},
+		{"deflate", "/large", "deflate", "deflate", minCompressBytes},
+		{"gzip preferred on a tie", "/large", "deflate, gzip", "gzip", minCompressBytes},
+		{"quality", "/large", "gzip;q=0.5, deflate", "deflate", minCompressBytes},
+		{"identity", "/large", "identity", "", minCompressBytes},
+		{"unsupported", "/large", "br", "", minCompressBytes},
+		{"below threshold", "/small", "gzip", "", minCompressBytes - 1},
+		{"event stream", "/stream", "gzip", "", 2 * minCompressBytes},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+tt.target, nil)
+			if err != nil {
+				t.Fatalf("Unable to create request due to: %q", err)
+			}
+			// setting the header stops net/http from decoding the response itself
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Unable to get response due to: %q", err)
+			}
+			defer res.Body.Close()
+
+			encoding := res.Header.Get("Content-Encoding")
+			if encoding != tt.wantEncoding {
+				t.Fatalf("Content-Encoding mismatch. got=%q want=%q", encoding, tt.wantEncoding)
+			}
+			if got := res.Header.Get("Accept-Encoding"); got != acceptedEncodings {
+				t.Errorf("Expected the accepted encodings to be advertised. got=%q", got)
+			}
+
+			var body io.Reader = res.Body
+			switch encoding {
+			case "gzip":
+				body, err = gzip.NewReader(res.Body)
+			case "deflate":
+				body, err = zlib.NewReader(res.Body)
+			}
+			if err != nil {
+				t.Fatalf("Unable to decode response due to: %q", err)
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("Unable to read response due to: %q", err)
+			}
+			if len(data) != tt.wantLength || strings.Trim(string(data), "a") != "" {
+				t.Errorf("Response body mismatch. got=%d bytes want=%d", len(data), tt.wantLength)
+			}
+		})
+	}
+}
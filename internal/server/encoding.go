@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// acceptedContentTypes is advertised on every response, so clients know they can send the binary encoding
+const acceptedContentTypes = binding.MIMEJSON + ", " + msg.BinaryContentType
+
+// *** Functions ***
+
+// advertiseContentTypes lists the encodings messages can be sent in, with the Accept-Post header
+func advertiseContentTypes(c *gin.Context) {
+	c.Header("Accept-Post", acceptedContentTypes)
+	c.Next()
+}
+
+// isBinary reports whether the request body is in the binary encoding rather than JSON
+func isBinary(c *gin.Context) bool {
+	return c.ContentType() == msg.BinaryContentType
+}
+
+// bindBinaryMessage decodes a message sent in the binary encoding
+func bindBinaryMessage(c *gin.Context, pkgMsg *msg.PackagedMessage) error {
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+	return pkgMsg.UnmarshalBinary(data)
+}
+
+// bindBatch decodes a batch of messages sent as JSON or in the binary encoding
+func bindBatch(c *gin.Context) ([]msg.PackagedMessage, error) {
+	if !isBinary(c) {
+		var batch []msg.PackagedMessage
+		err := json.NewDecoder(c.Request.Body).Decode(&batch)
+		return batch, err
+	}
+
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+	return msg.UnmarshalMessagesBinary(data)
+}
+
+// respondDeliveries responds with the deliveries in the binary encoding
+// when the client accepts it ahead of JSON, otherwise as JSON
+func respondDeliveries(c *gin.Context, deliveries []msg.Delivery) {
+	c.Writer.Header().Add("Vary", "Accept")
+	if c.NegotiateFormat(binding.MIMEJSON, msg.BinaryContentType) != msg.BinaryContentType {
+		c.JSON(200, deliveries) // ok
+		return
+	}
+
+	data, err := msg.MarshalDeliveriesBinary(deliveries)
+	if err != nil {
+		// the leases run out, and the messages are delivered again
+		log.Printf("unable to encode deliveries due to: %q", err)
+		c.Status(500) // internal server error
+		return
+	}
+	c.Data(200, msg.BinaryContentType, data) // ok
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// *** Types ***
+
+// KeyEntry is a single entry in the keys file.
+// An entry without a name applies to everyone aboard the vessel who has no entry of their own.
+// Each entry needs either an hmac secret or a base64 encoded ed25519 public key, which decides
+// the algorithm that user or vessel signs with.
+// The optional encryption key is a base64 encoded x25519 public key that others encrypt messages for.
+type KeyEntry struct {
+	Name          string `json:"name,omitempty"`
+	Vessel        string `json:"vessel"`
+	HMACKey       string `json:"hmacKey,omitempty"`
+	PublicKey     string `json:"publicKey,omitempty"`
+	EncryptionKey string `json:"encryptionKey,omitempty"`
+}
+
+// userKeys are the keys registered for a single user or vessel
+type userKeys struct {
+	hmacKey       []byte
+	publicKey     ed25519.PublicKey
+	encryptionKey *ecdh.PublicKey
+}
+
+// keysFile is the layout of the keys file
+type keysFile struct {
+	Keys []KeyEntry `json:"keys"`
+}
+
+// KeyRegistry maps each user, or a whole vessel, to the keys they sign with
+type KeyRegistry struct {
+	users   map[msg.UserVessel]userKeys
+	vessels map[string]userKeys
+}
+
+// *** Errors ***
+
+// ErrNoEncryptionKey is returned when a recipient has not registered an encryption key
+var ErrNoEncryptionKey = errors.New("no encryption key for recipient")
+
+// *** New Key Registry ***
+
+func NewKeyRegistry(entries []KeyEntry) (*KeyRegistry, error) {
+	kr := &KeyRegistry{
+		users:   make(map[msg.UserVessel]userKeys),
+		vessels: make(map[string]userKeys),
+	}
+
+	for i, entry := range entries {
+		if entry.Vessel == "" {
+			return nil, fmt.Errorf("key entry %d is missing a vessel", i)
+		}
+		if entry.HMACKey == "" && entry.PublicKey == "" {
+			return nil, fmt.Errorf("key entry %d is missing a key", i)
+		}
+		// an hmac secret would let whoever else holds it, such as the server, sign as them
+		if entry.HMACKey != "" && entry.PublicKey != "" {
+			return nil, fmt.Errorf("key entry %d has both an hmac key and a public key, it can only have one", i)
+		}
+
+		keys := userKeys{}
+		if entry.HMACKey != "" {
+			keys.hmacKey = []byte(entry.HMACKey)
+		}
+		if entry.PublicKey != "" {
+			publicKey, err := msg.ParsePublicKey(entry.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("key entry %d has an invalid public key: %w", i, err)
+			}
+			keys.publicKey = publicKey
+		}
+		if entry.EncryptionKey != "" {
+			encryptionKey, err := msg.ParsePublicEncryptionKey(entry.EncryptionKey)
+			if err != nil {
+				return nil, fmt.Errorf("key entry %d has an invalid encryption key: %w", i, err)
+			}
+			keys.encryptionKey = encryptionKey
+		}
+
+		if entry.Name == "" {
+			kr.vessels[entry.Vessel] = keys
+			continue
+		}
+		owner := msg.UserVessel{Name: entry.Name, Vessel: entry.Vessel}
+		kr.users[owner] = keys
+	}
+
+	return kr, nil
+}
+
+// LoadKeyRegistry reads a json keys file such as:
+//
+//	{"keys": [
+//		{"name": "Bob", "vessel": "Snow", "hmacKey": "..."},
+//		{"name": "Kevin", "vessel": "Liberty", "publicKey": "<base64>", "encryptionKey": "<base64>"},
+//		{"vessel": "Liberty", "hmacKey": "..."}
+//	]}
+//
+// Kevin only signs with his public key, while the rest of the Liberty crew use the vessel hmac key.
+func LoadKeyRegistry(path string) (*KeyRegistry, error) {
+	keysData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read keys file: %w", err)
+	}
+
+	var keys keysFile
+	err = json.Unmarshal(keysData, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse keys file: %w", err)
+	}
+
+	return NewKeyRegistry(keys.Keys)
+}
+
+// *** Functions ***
+
+// SigningKey returns the hmac secret for the user, or for their vessel if they have no entry of their own
+func (kr *KeyRegistry) SigningKey(uv msg.UserVessel) ([]byte, error) {
+	keys, ok := kr.lookup(uv)
+	if !ok || keys.hmacKey == nil {
+		return nil, fmt.Errorf("%w: %s", msg.ErrUnknownSigner, uv.String())
+	}
+	return keys.hmacKey, nil
+}
+
+// PublicKey returns the ed25519 public key for the user, or for their vessel if they have no entry of their own
+func (kr *KeyRegistry) PublicKey(uv msg.UserVessel) (ed25519.PublicKey, error) {
+	keys, ok := kr.lookup(uv)
+	if !ok || keys.publicKey == nil {
+		return nil, fmt.Errorf("%w: %s", msg.ErrUnknownSigner, uv.String())
+	}
+	return keys.publicKey, nil
+}
+
+// EncryptionKey returns the x25519 public key for the user, or for their vessel if they have no entry of their own
+func (kr *KeyRegistry) EncryptionKey(uv msg.UserVessel) (*ecdh.PublicKey, error) {
+	keys, ok := kr.lookup(uv)
+	if !ok || keys.encryptionKey == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoEncryptionKey, uv.String())
+	}
+	return keys.encryptionKey, nil
+}
+
+// lookup returns the entry of the user, falling back to the entry of their vessel only when
+// they have none, so that a vessel key can never be used to sign as a user with their own key
+func (kr *KeyRegistry) lookup(uv msg.UserVessel) (userKeys, bool) {
+	if keys, ok := kr.users[uv]; ok {
+		return keys, true
+	}
+	keys, ok := kr.vessels[uv.Vessel]
+	return keys, ok
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+func TestKeyRegistryDoesNotFallBackForUsersWithKeys(t *testing.T) {
+	privateKey := ed25519.NewKeyFromSeed([]byte("0123456789abcdef0123456789abcdef"))
+	publicKey := base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey))
+	vesselKey := []byte("liberty's hmac key")
+
+	keys, err := NewKeyRegistry([]KeyEntry{
+		{Name: "Kevin", Vessel: "Liberty", PublicKey: publicKey},
+		{Vessel: "Liberty", HMACKey: string(vesselKey)},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create key registry due to: %q", err)
+	}
+
+	kevin := msg.UserVessel{Name: "Kevin", Vessel: "Liberty"}
+	anna := msg.UserVessel{Name: "Anna", Vessel: "Liberty"}
+	rawMsg := msg.RawMessage{
+		ToName:     "Bob",
+		ToVessel:   "Snow",
+		FromName:   kevin.Name,
+		FromVessel: kevin.Vessel,
+		Subject:    "Tuesday",
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+	}
+
+	// anyone holding the vessel key cannot sign as kevin
+	forged, err := rawMsg.ToPackagedMessage(vesselKey)
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+	err = forged.VerifyMessageWith(keys)
+	if err == nil {
+		t.Errorf("Expected a message signed with the vessel key to fail as %s", kevin.String())
+	}
+
+	// kevin signs with his own key
+	signer, err := msg.NewEd25519Signer(privateKey)
+	if err != nil {
+		t.Fatalf("Unable to create signer due to: %q", err)
+	}
+	signed, err := rawMsg.ToPackagedMessageWith(signer)
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+	err = signed.VerifyMessageWith(keys)
+	if err != nil {
+		t.Errorf("Did not expect error: got=%q", err)
+	}
+
+	// while the rest of the crew still use the vessel key
+	rawMsg.FromName = anna.Name
+	crewMsg, err := rawMsg.ToPackagedMessage(vesselKey)
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+	err = crewMsg.VerifyMessageWith(keys)
+	if err != nil {
+		t.Errorf("Did not expect error: got=%q", err)
+	}
+
+	_, err = keys.SigningKey(kevin)
+	if !errors.Is(err, msg.ErrUnknownSigner) {
+		t.Errorf("Expected no hmac key for %s. got=%v", kevin.String(), err)
+	}
+}
+
+func TestKeyEntryWithBothKeysIsRejected(t *testing.T) {
+	privateKey := ed25519.NewKeyFromSeed([]byte("0123456789abcdef0123456789abcdef"))
+	publicKey := base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey))
+
+	_, err := NewKeyRegistry([]KeyEntry{{Name: "Kevin", Vessel: "Liberty", HMACKey: "secret", PublicKey: publicKey}})
+	if err == nil {
+		t.Errorf("Expected an entry with both an hmac key and a public key to be rejected")
+	}
+}
@@ -0,0 +1,645 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+	"github.com/nicholasss/async-messages/internal/store"
+)
+
+// compactAfter is how many deleted messages the journal can hold before it is compacted
+const compactAfter = 1000
+
+// leaseTimeout is how long a recipient has to acknowledge a delivery
+// before the message is put back into their mailbox
+const leaseTimeout = 2 * time.Minute
+
+// maxDeadLetters is how many rejected messages are kept, the oldest are dropped first
+const maxDeadLetters = 1000
+
+// deadLetterBox is the journal box that dead letters are kept in
+const deadLetterBox = "deadletter"
+
+// ErrDuplicateMessage is returned when a message with the same id was already accepted from the same sender
+var ErrDuplicateMessage = errors.New("message has already been accepted")
+
+// ErrReplayedRequest is returned when a mailbox request is sent again,
+// or was made before the server started and so cannot be checked
+var ErrReplayedRequest = errors.New("mailbox request has already been used")
+
+// ErrMailboxFull is returned when the recipients mailbox is at its capacity
+var ErrMailboxFull = fmt.Errorf("mailbox is full: %w", msg.ErrQueueFull)
+
+// *** Types ***
+
+// Mailbox holds the messages waiting to be retrieved by a single recipient
+type Mailbox struct {
+	Owner msg.UserVessel
+	queue *msg.PackagedQueue
+	bytes int
+	mux   *sync.Mutex
+	// closes the stream delivering to the owner, a newer stream replaces it
+	closeStream context.CancelFunc
+	streams     uint64
+	// deliveries made over streams that may not be acknowledged yet, oldest first
+	streamed []streamedDelivery
+}
+
+// Mailboxes holds a mailbox for every recipient the server has seen.
+// When a journal is present every change is written to it first.
+type Mailboxes struct {
+	boxes   map[msg.UserVessel]*Mailbox
+	mux     *sync.RWMutex
+	journal *store.Journal
+	// held for reading while journaling, and for writing while compacting
+	journalMux *sync.RWMutex
+	// ids of accepted messages, and when they were accepted
+	accepted          store.Seen
+	acceptedRetention time.Duration
+	acceptMux         *sync.Mutex
+	// messages that were rejected, held while journaling them so the journal keeps the same order
+	deadLetters *msg.DeadLetterQueue
+	deadMux     *sync.Mutex
+	// how many messages each mailbox can hold, unbounded when 0
+	capacity int
+	// nonces of mailbox requests, and when they were requested, so that none is used twice.
+	// Nonces are not journaled, so requests from before started are refused.
+	nonces      map[string]time.Time
+	noncesSwept time.Time
+	nonceMux    *sync.Mutex
+	started     time.Time
+	// how long a recipient has to acknowledge a delivery, leaseTimeout unless changed by tests
+	leaseTimeout time.Duration
+}
+
+// *** New Mailboxes ***
+
+func NewMailbox(owner msg.UserVessel) *Mailbox {
+	return &Mailbox{
+		Owner: owner,
+		queue: msg.NewQueue(),
+		mux:   &sync.Mutex{},
+	}
+}
+
+// NewMailboxes creates mailboxes that are only kept in memory.
+// Ids of accepted messages are remembered for acceptedRetention.
+func NewMailboxes(acceptedRetention time.Duration) *Mailboxes {
+	return &Mailboxes{
+		boxes:             make(map[msg.UserVessel]*Mailbox),
+		mux:               &sync.RWMutex{},
+		journalMux:        &sync.RWMutex{},
+		accepted:          make(store.Seen),
+		acceptedRetention: acceptedRetention,
+		acceptMux:         &sync.Mutex{},
+		deadLetters:       msg.NewDeadLetterQueue(maxDeadLetters),
+		deadMux:           &sync.Mutex{},
+		nonces:            make(map[string]time.Time),
+		nonceMux:          &sync.Mutex{},
+		started:           time.Now().UTC(),
+		leaseTimeout:      leaseTimeout,
+	}
+}
+
+// OpenMailboxes creates mailboxes backed by the journal at path,
+// restoring any messages that were waiting when the server stopped
+func OpenMailboxes(path string, acceptedRetention time.Duration) (*Mailboxes, error) {
+	journal, boxes, err := store.Open(path, acceptedRetention)
+	if err != nil {
+		return nil, err
+	}
+
+	mbs := NewMailboxes(acceptedRetention)
+	mbs.journal = journal
+	mbs.accepted = journal.Seen()
+
+	// mailboxes are unbounded until a capacity is set, so nothing is lost here
+	restored := 0
+	renamed := false
+	for box, pkgMsgs := range boxes {
+		for _, pkgMsg := range pkgMsgs {
+			err = mbs.Mailbox(pkgMsg.To).deliver(pkgMsg)
+			if err != nil {
+				return nil, err
+			}
+			restored++
+			renamed = renamed || box != mailboxBox(pkgMsg.To)
+		}
+	}
+	log.Printf("Restored %d messages from '%s'\n", restored, path)
+
+	for _, deadLetter := range journal.DeadLetters()[deadLetterBox] {
+		mbs.deadLetters.Restore(deadLetter)
+	}
+
+	// journals from before boxes were escaped are rewritten,
+	// so that later deletes are made from the boxes the messages are in
+	if renamed {
+		err = mbs.compact()
+		if err != nil {
+			return nil, fmt.Errorf("unable to rename mailboxes in journal: %w", err)
+		}
+	}
+
+	return mbs, nil
+}
+
+// *** Mailbox Functions ***
+
+// deliver places a message at the back of the mailbox,
+// returning ErrMailboxFull if it is at its capacity
+func (mb *Mailbox) deliver(pkgMsg msg.PackagedMessage) error {
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+
+	err := mb.queue.Enqueue(pkgMsg)
+	if errors.Is(err, msg.ErrQueueFull) {
+		return ErrMailboxFull
+	}
+	if err != nil {
+		return err
+	}
+	mb.bytes += messageSize(&pkgMsg)
+	return nil
+}
+
+// reserveAll leases every message in the mailbox, in the order they were delivered.
+// Leases older than leaseTimeout are put back first so that they are delivered again,
+// and messages that are past their expiry are taken out and returned instead.
+func (mb *Mailbox) reserveAll(now time.Time, leaseTimeout time.Duration) ([]msg.Lease, []msg.PackagedMessage) {
+	leases := make([]msg.Lease, 0)
+
+	mb.mux.Lock()
+	mb.queue.RequeueExpired(leaseTimeout)
+	expired := mb.queue.RemoveExpired(now)
+	for _, pkgMsg := range expired {
+		mb.bytes -= messageSize(&pkgMsg)
+	}
+	for {
+		lease, ok := mb.queue.Reserve()
+		if !ok {
+			break
+		}
+		leases = append(leases, lease)
+	}
+	mb.mux.Unlock()
+
+	return leases, expired
+}
+
+// wait waits for a message to arrive in the mailbox, or a lease to be given back.
+// Nothing gives back a lease that times out, so they are put back here as each one does.
+func (mb *Mailbox) wait(ctx context.Context, leaseTimeout time.Duration) error {
+	for {
+		waitCtx, cancel := ctx, context.CancelFunc(func() {})
+		leases := mb.queue.Leases()
+		if len(leases) > 0 {
+			// the oldest lease times out first
+			waitCtx, cancel = context.WithDeadline(ctx, leases[0].Reserved.Add(leaseTimeout))
+		}
+		err := mb.queue.Wait(waitCtx)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		mb.mux.Lock()
+		mb.queue.RequeueExpired(leaseTimeout)
+		mb.mux.Unlock()
+	}
+}
+
+// commit removes a leased message from the mailbox for good
+func (mb *Mailbox) commit(leaseID uint64) (msg.PackagedMessage, bool) {
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+
+	pkgMsg, ok := mb.queue.Commit(leaseID)
+	if ok {
+		mb.bytes -= messageSize(&pkgMsg)
+	}
+	return pkgMsg, ok
+}
+
+// messages returns every message still held by the mailbox, leased or not
+func (mb *Mailbox) messages() []msg.PackagedMessage {
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+
+	pkgMsgs := make([]msg.PackagedMessage, 0)
+	for _, lease := range mb.queue.Leases() {
+		pkgMsgs = append(pkgMsgs, lease.Message)
+	}
+	return append(pkgMsgs, mb.queue.Messages()...)
+}
+
+// Size returns the number of messages in the mailbox, including unacknowledged deliveries
+func (mb *Mailbox) Size() int {
+	return mb.queue.Size() + mb.queue.InFlight()
+}
+
+// Bytes returns the size of the subjects and bodies waiting in the mailbox
+func (mb *Mailbox) Bytes() int {
+	mb.mux.Lock()
+	bytes := mb.bytes
+	mb.mux.Unlock()
+
+	return bytes
+}
+
+// Summary returns a printable summary of the mailbox
+func (mb *Mailbox) Summary() string {
+	return fmt.Sprintf("Mailbox for %s (%d bytes)\n%s", mb.Owner.String(), mb.Bytes(), mb.queue.QueueSummary())
+}
+
+// *** Mailboxes Functions ***
+
+// Mailbox returns the mailbox for the owner, creating it if needed
+func (mbs *Mailboxes) Mailbox(owner msg.UserVessel) *Mailbox {
+	mbs.mux.RLock()
+	mb, ok := mbs.boxes[owner]
+	mbs.mux.RUnlock()
+	if ok {
+		return mb
+	}
+
+	mbs.mux.Lock()
+	defer mbs.mux.Unlock()
+
+	// another goroutine may have created it between locks
+	mb, ok = mbs.boxes[owner]
+	if !ok {
+		mb = NewMailbox(owner)
+		mb.queue.SetCapacity(mbs.capacity, msg.OverflowReject)
+		mbs.boxes[owner] = mb
+	}
+	return mb
+}
+
+// SetCapacity limits every mailbox to capacity messages, or unlimits them when 0.
+// Messages beyond the capacity are turned away with ErrMailboxFull, so that
+// senders keep them and back off until the recipient has collected their mail.
+// Mailboxes already over the capacity keep their messages.
+func (mbs *Mailboxes) SetCapacity(capacity int) {
+	mbs.mux.Lock()
+	defer mbs.mux.Unlock()
+
+	mbs.capacity = capacity
+	for _, mb := range mbs.boxes {
+		mb.queue.SetCapacity(capacity, msg.OverflowReject)
+	}
+}
+
+// Deliver places the message into the recipients mailbox.
+// The message is journaled before it is placed. Returns ErrDuplicateMessage
+// if a message with the same id has already been accepted from the same sender.
+// Senders choose their own ids, so one sender cannot stop another's message by reusing its id.
+func (mbs *Mailboxes) Deliver(pkgMsg msg.PackagedMessage) (*Mailbox, error) {
+	mbs.journalMux.RLock()
+	defer mbs.journalMux.RUnlock()
+
+	// held until delivered so the same message cannot be accepted twice at once
+	mbs.acceptMux.Lock()
+	defer mbs.acceptMux.Unlock()
+
+	// keyed by sender and id, as every mailbox shares the accepted ids
+	key := store.MessageKey(&pkgMsg)
+	if _, ok := mbs.accepted[key]; ok {
+		return mbs.Mailbox(pkgMsg.To), ErrDuplicateMessage
+	}
+
+	if mbs.journal != nil {
+		err := mbs.journal.Put(mailboxBox(pkgMsg.To), pkgMsg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mb := mbs.Mailbox(pkgMsg.To)
+	err := mb.deliver(pkgMsg)
+	if err != nil {
+		// take it back out of the journal so that it is not restored after a restart
+		if mbs.journal != nil {
+			err = errors.Join(err, mbs.journal.Delete(mailboxBox(pkgMsg.To), pkgMsg))
+		}
+		return mb, err
+	}
+	mbs.accepted[key] = time.Now().UTC()
+	return mb, nil
+}
+
+// Collect leases every message in the owners mailbox, stamped with the time they
+// were recieved. The messages stay in the mailbox until they are acknowledged.
+// Messages that expired while waiting are dead lettered instead of delivered.
+func (mbs *Mailboxes) Collect(owner msg.UserVessel) []msg.Delivery {
+	recieved := time.Now().UTC()
+	leases, expired := mbs.Mailbox(owner).reserveAll(recieved, mbs.leaseTimeout)
+	mbs.expire(owner, expired)
+
+	deliveries := make([]msg.Delivery, 0, len(leases))
+	for _, lease := range leases {
+		lease.Message.Recieved = recieved
+		deliveries = append(deliveries, msg.Delivery{Lease: lease.ID, Message: lease.Message})
+	}
+	return deliveries
+}
+
+// CollectWait collects the owners messages like Collect, waiting up to wait
+// for one to arrive when there are none. Returns no deliveries if ctx is done first.
+func (mbs *Mailboxes) CollectWait(ctx context.Context, owner msg.UserVessel, wait time.Duration) []msg.Delivery {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	mb := mbs.Mailbox(owner)
+	for {
+		deliveries := mbs.Collect(owner)
+		if len(deliveries) > 0 {
+			return deliveries
+		}
+
+		// woken as soon as a message is delivered, or a lease is given back or times out
+		err := mb.wait(ctx, mbs.leaseTimeout)
+		if err != nil {
+			return deliveries
+		}
+	}
+}
+
+// Acknowledge removes delivered messages from the owners mailbox for good.
+// Returns how many of the leases were acknowledged.
+func (mbs *Mailboxes) Acknowledge(owner msg.UserVessel, leaseIDs []uint64) int {
+	mb := mbs.Mailbox(owner)
+	acknowledged := 0
+
+	mbs.journalMux.RLock()
+	for _, leaseID := range leaseIDs {
+		pkgMsg, ok := mb.commit(leaseID)
+		if !ok {
+			continue
+		}
+		acknowledged++
+
+		if mbs.journal != nil {
+			err := mbs.journal.Delete(mailboxBox(owner), pkgMsg)
+			if err != nil {
+				// worst case the message is delivered again after a restart
+				log.Printf("unable to journal acknowledged message due to: %q", err)
+			}
+		}
+	}
+	mbs.journalMux.RUnlock()
+
+	mbs.compactIfNeeded()
+	return acknowledged
+}
+
+// UseNonce records the nonce of a mailbox request requested at the time given, returning
+// ErrReplayedRequest if it was already used. Nonces are forgotten after maxAge, once the
+// requests they came with are too old to be accepted anyway.
+func (mbs *Mailboxes) UseNonce(nonce string, requested time.Time, maxAge time.Duration) error {
+	mbs.nonceMux.Lock()
+	defer mbs.nonceMux.Unlock()
+
+	if requested.Before(mbs.started) {
+		return ErrReplayedRequest
+	}
+	if _, ok := mbs.nonces[nonce]; ok {
+		return ErrReplayedRequest
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(mbs.noncesSwept) > maxAge {
+		cutoff := now.Add(-maxAge)
+		for usedNonce, at := range mbs.nonces {
+			if at.Before(cutoff) {
+				delete(mbs.nonces, usedNonce)
+			}
+		}
+		mbs.noncesSwept = now
+	}
+	mbs.nonces[nonce] = requested
+	return nil
+}
+
+// DeadLetter records a message that was rejected, and why. Only messages that were
+// verified should be dead lettered, as anyone could send the rest.
+// Rejecting a message that is already a dead letter counts up its attempts, while
+// a different message with the same id is refused with msg.ErrDeadLetterConflict.
+func (mbs *Mailboxes) DeadLetter(pkgMsg msg.PackagedMessage, reason error) (msg.DeadLetter, error) {
+	mbs.journalMux.RLock()
+	defer mbs.journalMux.RUnlock()
+	mbs.deadMux.Lock()
+	defer mbs.deadMux.Unlock()
+
+	deadLetter, dropped, err := mbs.deadLetters.Add(pkgMsg, reason.Error(), time.Now().UTC())
+	if err != nil {
+		return deadLetter, err
+	}
+	if mbs.journal == nil {
+		return deadLetter, nil
+	}
+
+	err = mbs.journal.PutDeadLetter(deadLetterBox, deadLetter)
+	if err != nil {
+		return deadLetter, err
+	}
+	for _, droppedLetter := range dropped {
+		err = mbs.journal.DeleteDeadLetter(deadLetterBox, droppedLetter)
+		if err != nil {
+			return deadLetter, err
+		}
+	}
+	return deadLetter, nil
+}
+
+// expire dead letters messages that were taken out of the owners mailbox after they expired
+func (mbs *Mailboxes) expire(owner msg.UserVessel, expired []msg.PackagedMessage) {
+	if len(expired) == 0 {
+		return
+	}
+
+	if mbs.journal != nil {
+		mbs.journalMux.RLock()
+		for _, pkgMsg := range expired {
+			err := mbs.journal.Delete(mailboxBox(owner), pkgMsg)
+			if err != nil {
+				// worst case the message is dead lettered again after a restart
+				log.Printf("unable to journal expired message due to: %q", err)
+			}
+		}
+		mbs.journalMux.RUnlock()
+	}
+
+	for _, pkgMsg := range expired {
+		_, err := mbs.DeadLetter(pkgMsg, msg.ErrMessageExpired)
+		if err != nil {
+			log.Printf("unable to dead letter expired message due to: %q", err)
+		}
+	}
+
+	mbs.compactIfNeeded()
+}
+
+// DeadLetters returns every dead letter, oldest first
+func (mbs *Mailboxes) DeadLetters() []msg.DeadLetter {
+	return mbs.deadLetters.List()
+}
+
+// DeadLetterFor returns the dead letter for the message id
+func (mbs *Mailboxes) DeadLetterFor(id string) (msg.DeadLetter, bool) {
+	return mbs.deadLetters.Get(id)
+}
+
+// RemoveDeadLetter removes the dead letter for the message id for good
+func (mbs *Mailboxes) RemoveDeadLetter(id string) (msg.DeadLetter, bool, error) {
+	mbs.journalMux.RLock()
+	mbs.deadMux.Lock()
+	deadLetter, ok := mbs.deadLetters.Remove(id)
+	var err error
+	if ok && mbs.journal != nil {
+		err = mbs.journal.DeleteDeadLetter(deadLetterBox, deadLetter)
+	}
+	mbs.deadMux.Unlock()
+	mbs.journalMux.RUnlock()
+
+	mbs.compactIfNeeded()
+	return deadLetter, ok, err
+}
+
+// PurgeDeadLetters removes every dead letter for good, returning how many there were
+func (mbs *Mailboxes) PurgeDeadLetters() (int, error) {
+	mbs.journalMux.RLock()
+	mbs.deadMux.Lock()
+	purged := mbs.deadLetters.Purge()
+	var err error
+	if mbs.journal != nil {
+		for _, deadLetter := range purged {
+			err = mbs.journal.DeleteDeadLetter(deadLetterBox, deadLetter)
+			if err != nil {
+				break
+			}
+		}
+	}
+	mbs.deadMux.Unlock()
+	mbs.journalMux.RUnlock()
+
+	mbs.compactIfNeeded()
+	return len(purged), err
+}
+
+// Owners returns every recipient with a mailbox, sorted by vessel then name
+func (mbs *Mailboxes) Owners() []msg.UserVessel {
+	mbs.mux.RLock()
+	owners := make([]msg.UserVessel, 0, len(mbs.boxes))
+	for owner := range mbs.boxes {
+		owners = append(owners, owner)
+	}
+	mbs.mux.RUnlock()
+
+	sort.Slice(owners, func(i, j int) bool {
+		if owners[i].Vessel != owners[j].Vessel {
+			return owners[i].Vessel < owners[j].Vessel
+		}
+		return owners[i].Name < owners[j].Name
+	})
+	return owners
+}
+
+// VesselSize returns the number of messages waiting for everyone aboard a vessel
+func (mbs *Mailboxes) VesselSize(vessel string) int {
+	size := 0
+	for _, owner := range mbs.Owners() {
+		if owner.Vessel == vessel {
+			size += mbs.Mailbox(owner).Size()
+		}
+	}
+	return size
+}
+
+// Summary returns a printable summary of every non-empty mailbox
+func (mbs *Mailboxes) Summary() string {
+	var summaries []string
+	for _, owner := range mbs.Owners() {
+		mb := mbs.Mailbox(owner)
+		if mb.Size() == 0 {
+			continue
+		}
+		summaries = append(summaries, mb.Summary())
+	}
+
+	if len(summaries) == 0 {
+		return "All mailboxes are empty.\n"
+	}
+	return strings.Join(summaries, "")
+}
+
+// Close closes the journal, if there is one
+func (mbs *Mailboxes) Close() error {
+	if mbs.journal == nil {
+		return nil
+	}
+	return mbs.journal.Close()
+}
+
+// compactIfNeeded rewrites the journal once enough messages have been collected
+func (mbs *Mailboxes) compactIfNeeded() {
+	if mbs.journal == nil || mbs.journal.Garbage() < compactAfter {
+		return
+	}
+
+	err := mbs.compact()
+	if err != nil {
+		log.Printf("unable to compact journal due to: %q", err)
+	}
+}
+
+// compact rewrites the journal so that it only holds what is in the mailboxes
+func (mbs *Mailboxes) compact() error {
+	mbs.journalMux.Lock()
+	defer mbs.journalMux.Unlock()
+
+	boxes := make(store.Boxes)
+	for _, owner := range mbs.Owners() {
+		pkgMsgs := mbs.Mailbox(owner).messages()
+		if len(pkgMsgs) > 0 {
+			boxes[mailboxBox(owner)] = pkgMsgs
+		}
+	}
+
+	// forget ids that are too old to be retried
+	mbs.acceptMux.Lock()
+	cutoff := time.Now().UTC().Add(-mbs.acceptedRetention)
+	for key, at := range mbs.accepted {
+		if at.Before(cutoff) {
+			delete(mbs.accepted, key)
+		}
+	}
+	accepted := make(store.Seen, len(mbs.accepted))
+	for key, at := range mbs.accepted {
+		accepted[key] = at
+	}
+	mbs.acceptMux.Unlock()
+
+	dead := store.DeadLetters{deadLetterBox: mbs.deadLetters.List()}
+
+	return mbs.journal.Compact(boxes, accepted, dead)
+}
+
+// mailboxBox returns the journal box of the owners mailbox. The name and vessel are escaped
+// before they are joined, so that no two owners share a box whatever their names hold.
+func mailboxBox(owner msg.UserVessel) string {
+	return "mailbox:" + url.QueryEscape(owner.Name) + "@" + url.QueryEscape(owner.Vessel)
+}
+
+// messageSize is the number of bytes a message takes up in a mailbox
+func messageSize(pkgMsg *msg.PackagedMessage) int {
+	return len(pkgMsg.Subject) + len(pkgMsg.Body)
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+	"github.com/nicholasss/async-messages/internal/store"
+)
+
+// newTestMessage packages a message signed with an hmac key
+func newTestMessage(t *testing.T, from, to msg.UserVessel, subject string, key []byte) msg.PackagedMessage {
+	t.Helper()
+
+	rawMsg := msg.RawMessage{
+		ToName:     to.Name,
+		ToVessel:   to.Vessel,
+		FromName:   from.Name,
+		FromVessel: from.Vessel,
+		Subject:    subject,
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+	}
+	pkgMsg, err := rawMsg.ToPackagedMessage(key)
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+	return *pkgMsg
+}
+
+func TestMailboxesArePerRecipient(t *testing.T) {
+	kevin := msg.UserVessel{Name: "Kevin", Vessel: "Liberty"}
+	bob := msg.UserVessel{Name: "Bob", Vessel: "Snow"}
+	alice := msg.UserVessel{Name: "Alice", Vessel: "Snow"}
+	key := []byte("k")
+
+	mbs := NewMailboxes(time.Hour)
+	sent := []msg.PackagedMessage{
+		newTestMessage(t, kevin, bob, "Tuesday", key),
+		newTestMessage(t, kevin, alice, "Wednesday", key),
+		newTestMessage(t, bob, kevin, "Re: Tuesday", key),
+		newTestMessage(t, kevin, bob, "Thursday", key),
+	}
+	for _, pkgMsg := range sent {
+		_, err := mbs.Deliver(pkgMsg)
+		if err != nil {
+			t.Fatalf("Unable to deliver message due to: %q", err)
+		}
+	}
+
+	wantOwners := []msg.UserVessel{kevin, alice, bob}
+	owners := mbs.Owners()
+	if len(owners) != len(wantOwners) {
+		t.Fatalf("Expected a mailbox for each recipient. got=%v", owners)
+	}
+	for i := range wantOwners {
+		if owners[i] != wantOwners[i] {
+			t.Errorf("owner %d mismatch. got=%s want=%s", i, owners[i], wantOwners[i])
+		}
+	}
+
+	tests := []struct {
+		owner     msg.UserVessel
+		wantIDs   []string
+		wantBytes int
+	}{
+		{bob, []string{sent[0].ID, sent[3].ID}, messageSize(&sent[0]) + messageSize(&sent[3])},
+		{alice, []string{sent[1].ID}, messageSize(&sent[1])},
+		{kevin, []string{sent[2].ID}, messageSize(&sent[2])},
+	}
+	leaseIDs := make(map[msg.UserVessel][]uint64)
+	for _, tt := range tests {
+		t.Run(tt.owner.String(), func(t *testing.T) {
+			mb := mbs.Mailbox(tt.owner)
+			if size := mb.Size(); size != len(tt.wantIDs) {
+				t.Errorf("Size mismatch. got=%d want=%d", size, len(tt.wantIDs))
+			}
+			if bytes := mb.Bytes(); bytes != tt.wantBytes {
+				t.Errorf("Bytes mismatch. got=%d want=%d", bytes, tt.wantBytes)
+			}
+
+			// only the owners messages are collected, in the order they were delivered
+			deliveries := mbs.Collect(tt.owner)
+			if len(deliveries) != len(tt.wantIDs) {
+				t.Fatalf("Expected %d deliveries. got=%d", len(tt.wantIDs), len(deliveries))
+			}
+			for i, delivery := range deliveries {
+				if delivery.Message.ID != tt.wantIDs[i] {
+					t.Errorf("delivery %d mismatch. got=%s want=%s", i, delivery.Message.ID, tt.wantIDs[i])
+				}
+				leaseIDs[tt.owner] = append(leaseIDs[tt.owner], delivery.Lease)
+			}
+		})
+	}
+
+	if size := mbs.VesselSize("Snow"); size != 3 {
+		t.Errorf("Expected three messages aboard Snow. size=%d", size)
+	}
+
+	// acknowledging one mailbox leaves the rest alone
+	if acknowledged := mbs.Acknowledge(bob, leaseIDs[bob]); acknowledged != 2 {
+		t.Errorf("Expected both of Bob's messages to be acknowledged. got=%d", acknowledged)
+	}
+	// leases are per mailbox, so Bob cannot acknowledge Alice's
+	if acknowledged := mbs.Acknowledge(bob, leaseIDs[alice]); acknowledged != 0 {
+		t.Errorf("Expected Alice's lease to not be acknowledged from Bob's mailbox. got=%d", acknowledged)
+	}
+	if size := mbs.VesselSize("Snow"); size != 1 {
+		t.Errorf("Expected one message left aboard Snow. size=%d", size)
+	}
+	if size := mbs.Mailbox(kevin).Size(); size != 1 {
+		t.Errorf("Expected Kevin's mailbox to keep its message. size=%d", size)
+	}
+}
+
+func TestMailboxesWithAmbiguousNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mailboxes.journal")
+	kevin := msg.UserVessel{Name: "Kevin", Vessel: "Liberty"}
+	// both join to "a@b@c"
+	first := msg.UserVessel{Name: "a@b", Vessel: "c"}
+	second := msg.UserVessel{Name: "a", Vessel: "b@c"}
+
+	mbs, err := OpenMailboxes(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to open mailboxes due to: %q", err)
+	}
+	for _, to := range []msg.UserVessel{first, second} {
+		_, err = mbs.Deliver(newTestMessage(t, kevin, to, "Tuesday", []byte("k")))
+		if err != nil {
+			t.Fatalf("Unable to deliver message due to: %q", err)
+		}
+	}
+
+	deliveries := mbs.Collect(first)
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected one message for %s. got=%d", first.String(), len(deliveries))
+	}
+	mbs.Acknowledge(first, []uint64{deliveries[0].Lease})
+	mbs.Close()
+
+	// replaying the journal keeps the mailboxes apart
+	mbs, err = OpenMailboxes(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to reopen mailboxes due to: %q", err)
+	}
+	defer mbs.Close()
+	if size := mbs.Mailbox(first).Size(); size != 0 {
+		t.Errorf("Expected the acknowledged message to stay gone. size=%d", size)
+	}
+	if size := mbs.Mailbox(second).Size(); size != 1 {
+		t.Errorf("Expected the other mailbox to keep its message. size=%d", size)
+	}
+}
+
+func TestOpenMailboxesRenamesOldBoxes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mailboxes.journal")
+	kevin := msg.UserVessel{Name: "Kevin", Vessel: "Liberty"}
+	bob := msg.UserVessel{Name: "Bob", Vessel: "Snow"}
+
+	// journaled before boxes were escaped
+	journal, _, err := store.Open(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to open journal due to: %q", err)
+	}
+	err = journal.Put(bob.String(), newTestMessage(t, kevin, bob, "Tuesday", []byte("k")))
+	if err != nil {
+		t.Fatalf("Unable to journal message due to: %q", err)
+	}
+	journal.Close()
+
+	mbs, err := OpenMailboxes(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to open mailboxes due to: %q", err)
+	}
+	deliveries := mbs.Collect(bob)
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected the old message to be restored. got=%d", len(deliveries))
+	}
+	mbs.Acknowledge(bob, []uint64{deliveries[0].Lease})
+	mbs.Close()
+
+	mbs, err = OpenMailboxes(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to reopen mailboxes due to: %q", err)
+	}
+	defer mbs.Close()
+	if size := mbs.Mailbox(bob).Size(); size != 0 {
+		t.Errorf("Expected the acknowledged message to stay gone. size=%d", size)
+	}
+}
+
+func TestCollectWaitWakesForTimedOutLease(t *testing.T) {
+	kevin := msg.UserVessel{Name: "Kevin", Vessel: "Liberty"}
+	bob := msg.UserVessel{Name: "Bob", Vessel: "Snow"}
+
+	mbs := NewMailboxes(time.Hour)
+	mbs.leaseTimeout = 100 * time.Millisecond
+	pkgMsg := newTestMessage(t, kevin, bob, "Tuesday", []byte("k"))
+	_, err := mbs.Deliver(pkgMsg)
+	if err != nil {
+		t.Fatalf("Unable to deliver message due to: %q", err)
+	}
+
+	// delivered, but never acknowledged
+	if deliveries := mbs.Collect(bob); len(deliveries) != 1 {
+		t.Fatalf("Expected the message to be delivered. got=%d", len(deliveries))
+	}
+
+	started := time.Now()
+	deliveries := mbs.CollectWait(context.Background(), bob, 5*time.Second)
+	if len(deliveries) != 1 || deliveries[0].Message.ID != pkgMsg.ID {
+		t.Fatalf("Expected the message to be delivered again. got=%d", len(deliveries))
+	}
+	if waited := time.Since(started); waited > 2*time.Second {
+		t.Errorf("Expected the wait to end once the lease timed out. waited=%s", waited)
+	}
+}
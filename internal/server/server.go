@@ -2,23 +2,89 @@
 package server
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/nicholasss/async-messages/internal/msg"
 )
 
+// mailboxRequestMaxAge is how old a signed mailbox request can be before being rejected.
+// Each request is made just before it is sent, so this only needs to cover the trip to the server.
+const mailboxRequestMaxAge = time.Minute
+
+// maxMailboxWait bounds how long a request for messages is held open waiting for one to arrive
+const maxMailboxWait = time.Minute
+
+// mailboxFullRetryAfter is how long senders are asked to wait before sending to a full mailbox again
+const mailboxFullRetryAfter = 30 * time.Second
+
+// limits on a batch of messages sent at once
+const (
+	maxBatchMessages = 500
+	maxBatchBytes    = 8 << 20
+)
+
+// defaultDataDir is where the server keeps its data when 'DATA_DIR' is not set
+const defaultDataDir = "data"
+
+// defaults for replay protection, vessels can be offline for days before sending
+const (
+	defaultReplayWindow = 7 * 24 * time.Hour
+	defaultClockSkew    = 5 * time.Minute
+)
+
+// reasons a message is rejected that do not come with an error of their own
+var (
+	errLegacySignature  = errors.New("message uses a legacy signature")
+	errInvalidMessageID = errors.New("message has an invalid id")
+)
+
+// unverifiedError is why a message failed verification. Anyone could have sent it,
+// so it is never kept as a dead letter.
+type unverifiedError struct {
+	err error
+}
+
+func (err *unverifiedError) Error() string {
+	return err.err.Error()
+}
+
+func (err *unverifiedError) Unwrap() error {
+	return err.err
+}
+
 type HealthCheck struct {
 	Health string `json:"health"`
 }
 
 // Config holds all the configuration data
 type Config struct {
-	SecretKey []byte
-	Queue     *msg.PackagedQueue
+	Keys      *KeyRegistry
+	DataDir   string
+	Mailboxes *Mailboxes
+	// messages packaged longer than ReplayWindow ago, or further than
+	// ClockSkew in the future, are rejected
+	ReplayWindow time.Duration
+	ClockSkew    time.Duration
+	// legacy signatures do not cover the packaged time, so they cannot be checked for replays
+	AllowLegacySignatures bool
+	// AdminToken guards the admin endpoints, which are disabled when it is empty
+	AdminToken string
+	// MailboxCapacity is how many messages each mailbox holds, unbounded when 0
+	MailboxCapacity int
+	// now returns the time messages are checked against, time.Now when nil
+	now func() time.Time
 }
 
 func LoadConfig() (*Config, error) {
@@ -27,32 +93,112 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("unable to load './.env'. error: %w", err)
 	}
 
-	rawHMAC := os.Getenv("HMAC_SECRET")
-	if rawHMAC == "" {
-		return nil, fmt.Errorf("unable to find 'HMAC_SECRET' in './.env'")
+	keysPath := os.Getenv("KEYS_FILE")
+	if keysPath == "" {
+		return nil, fmt.Errorf("unable to find 'KEYS_FILE' in './.env'")
+	}
+	keys, err := LoadKeyRegistry(keysPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load keys from '%s'. error: %w", keysPath, err)
+	}
+
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = defaultDataDir
 	}
 
-	queue := msg.NewQueue()
+	replayWindow, err := durationFromEnv("REPLAY_WINDOW", defaultReplayWindow)
+	if err != nil {
+		return nil, err
+	}
+	clockSkew, err := durationFromEnv("CLOCK_SKEW", defaultClockSkew)
+	if err != nil {
+		return nil, err
+	}
+	allowLegacy := os.Getenv("ALLOW_LEGACY_SIGNATURES") == "true"
+
+	mailboxCapacity := 0
+	rawCapacity := os.Getenv("MAILBOX_CAPACITY")
+	if rawCapacity != "" {
+		mailboxCapacity, err = strconv.Atoi(rawCapacity)
+		if err != nil || mailboxCapacity < 0 {
+			return nil, fmt.Errorf("unable to parse 'MAILBOX_CAPACITY' in './.env' as a count of messages")
+		}
+	}
+
+	// ids must be remembered for as long as a replayed message could still be fresh
+	mailboxes, err := OpenMailboxes(filepath.Join(dataDir, "mailboxes.journal"), replayWindow+clockSkew)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open mailboxes in '%s'. error: %w", dataDir, err)
+	}
+	mailboxes.SetCapacity(mailboxCapacity)
 
 	cfg := Config{
-		SecretKey: []byte(rawHMAC),
-		Queue:     queue,
+		Keys:                  keys,
+		DataDir:               dataDir,
+		Mailboxes:             mailboxes,
+		ReplayWindow:          replayWindow,
+		ClockSkew:             clockSkew,
+		AllowLegacySignatures: allowLegacy,
+		AdminToken:            os.Getenv("ADMIN_TOKEN"),
+		MailboxCapacity:       mailboxCapacity,
 	}
 
 	return &cfg, nil
 }
 
+// durationFromEnv parses a duration such as '72h' from the environment,
+// returning the fallback if it is not set
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	rawDuration := os.Getenv(name)
+	if rawDuration == "" {
+		return fallback, nil
+	}
+
+	duration, err := time.ParseDuration(rawDuration)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse '%s' in './.env'. error: %w", name, err)
+	}
+	return duration, nil
+}
+
 func (cfg *Config) SetupGinEngine() (*gin.Engine, error) {
 	r := gin.Default()
 
+	// accept compressed requests, and compress responses for clients that can decode them
+	r.Use(compression)
+
+	// messages can be sent and retrieved as JSON, or in the more compact binary encoding
+	r.Use(advertiseContentTypes)
+
 	// allow clients to check health of server
 	r.GET("/health", cfg.health)
 
-	// allow clients to send messages
+	// allow clients to send messages, one at a time or in batches
 	r.POST("/send-message", cfg.sendMessage)
+	r.POST("/send-messages", cfg.sendMessages)
+
+	// allow clients to retrieve their messages
+	r.GET("/get-messages", cfg.getMessages)
+
+	// allow clients to have their messages streamed to them as they arrive
+	r.GET("/stream-messages", cfg.streamMessages)
+
+	// allow clients to acknowledge the messages they retrieved
+	r.POST("/ack-messages", cfg.ackMessages)
+
+	// allow clients to look up who they can encrypt messages for
+	r.GET("/encryption-key", cfg.encryptionKey)
+
+	// allow clients to verify who messages they recieve are from
+	r.GET("/public-key", cfg.publicKey)
 
-	// allow clients to check for messages
-	// r.GET("/check-messages", cfg.checkMessages)
+	// allow the admin to inspect, retry and purge rejected messages
+	deadLetters := r.Group("/dead-letters", cfg.requireAdmin)
+	deadLetters.GET("", cfg.listDeadLetters)
+	deadLetters.POST("/:id/retry", cfg.retryDeadLetter)
+	deadLetters.DELETE("/:id", cfg.purgeDeadLetter)
+	deadLetters.DELETE("", cfg.purgeDeadLetters)
 
 	return r, nil
 }
@@ -64,18 +210,387 @@ func (cfg *Config) health(c *gin.Context) {
 
 func (cfg *Config) sendMessage(c *gin.Context) {
 	requestMsg := &msg.PackagedMessage{}
-	c.Bind(requestMsg)
+	if isBinary(c) {
+		err := bindBinaryMessage(c, requestMsg)
+		if err != nil {
+			log.Printf("unable to decode message due to: %q", err)
+			c.Status(400) // bad request
+			return
+		}
+	} else {
+		c.Bind(requestMsg)
+	}
+
+	status, _ := cfg.receiveMessage(*requestMsg)
+	if status == 429 {
+		c.Header("Retry-After", strconv.Itoa(int(mailboxFullRetryAfter/time.Second)))
+	}
+	c.Status(status)
+}
+
+// sendMessages accepts a batch of messages, responding with whether each one was accepted
+// in the order they were sent. A bad message does not stop the rest of the batch.
+func (cfg *Config) sendMessages(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBytes)
 
-	err := requestMsg.VerifyMessage(cfg.SecretKey)
+	batch, err := bindBatch(c)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		log.Printf("batch of messages is larger than %d bytes", maxBatchBytes)
+		c.Status(413) // request entity too large
+		return
+	}
+	if err != nil {
+		log.Printf("unable to decode batch of messages due to: %q", err)
+		c.Status(400) // bad request
+		return
+	}
+	if len(batch) > maxBatchMessages {
+		log.Printf("batch of %d messages is more than %d", len(batch), maxBatchMessages)
+		c.Status(413) // request entity too large
+		return
+	}
+
+	results := make([]msg.SendResult, 0, len(batch))
+	for _, pkgMsg := range batch {
+		status, err := cfg.receiveMessage(pkgMsg)
+		result := msg.SendResult{ID: pkgMsg.ID, Status: status}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if status == 429 {
+			result.RetryAfter = int(mailboxFullRetryAfter / time.Second)
+		}
+		results = append(results, result)
+	}
+	log.Printf("Recieved batch of %d messages", len(batch))
+
+	c.JSON(200, results) // ok
+}
+
+// receiveMessage accepts a message that was sent to the server, keeping it as a dead letter
+// if it was rejected after being verified. Returns the status of the message, and why it was not accepted.
+func (cfg *Config) receiveMessage(pkgMsg msg.PackagedMessage) (int, error) {
+	status, err := cfg.acceptMessage(pkgMsg)
+	var unverified *unverifiedError
+	if status == 400 && !errors.As(err, &unverified) {
+		cfg.deadLetter(pkgMsg, err)
+	}
+
+	// the sender retried a message that was rejected before, and this time it went through
+	deadLetter, wasDeadLetter := cfg.Mailboxes.DeadLetterFor(pkgMsg.ID)
+	wasDeadLetter = wasDeadLetter && deadLetter.Message.From == pkgMsg.From && deadLetter.Message.Signature == pkgMsg.Signature
+	if status == 200 && wasDeadLetter {
+		_, _, removeErr := cfg.Mailboxes.RemoveDeadLetter(pkgMsg.ID)
+		if removeErr != nil {
+			log.Printf("unable to journal delivered dead letter due to: %q", removeErr)
+		}
+	}
+	return status, err
+}
+
+// acceptMessage checks a message then delivers it into the recipients mailbox.
+// Returns the status to respond with, and why the message was not accepted.
+func (cfg *Config) acceptMessage(pkgMsg msg.PackagedMessage) (int, error) {
+	err := pkgMsg.VerifyMessageWith(cfg.Keys)
 	if err != nil {
 		log.Printf("unable to verify message due to: %q", err)
+		return 400, &unverifiedError{err: err} // bad request
+	}
+
+	// the signature binds the packaged time and id, so together they stop replays
+	if !pkgMsg.SignsPackagedTime() && !cfg.AllowLegacySignatures {
+		log.Printf("message %s uses a legacy signature", pkgMsg.ID)
+		return 400, errLegacySignature // bad request
+	}
+	// messages from before ids were added are given one, legacy signatures do not cover it anyway
+	if !pkgMsg.SignsPackagedTime() && pkgMsg.ID == "" {
+		pkgMsg.ID = msg.LegacyMessageID(&pkgMsg)
+	}
+	now := cfg.currentTime()
+	err = pkgMsg.CheckFreshness(now, cfg.ReplayWindow, cfg.ClockSkew)
+	if err != nil {
+		log.Printf("rejecting message %s due to: %q", pkgMsg.ID, err)
+		return 400, err // bad request
+	}
+	if pkgMsg.IsExpired(now) {
+		log.Printf("rejecting message %s as it expired at %s", pkgMsg.ID, pkgMsg.Expires.Format(time.RFC3339))
+		return 400, msg.ErrMessageExpired // bad request
+	}
+
+	if !msg.IsValidMessageID(pkgMsg.ID) {
+		log.Printf("message from %s has an invalid id: %q", pkgMsg.From.String(), pkgMsg.ID)
+		return 400, errInvalidMessageID // bad request
+	}
+
+	// add to recipients mailbox
+	mb, err := cfg.Mailboxes.Deliver(pkgMsg)
+	if errors.Is(err, ErrDuplicateMessage) {
+		// either a replay, or the sender did not get our last response.
+		// accept again without delivering twice
+		log.Printf("message %s was already accepted", pkgMsg.ID)
+		return 200, nil // ok
+	}
+	if errors.Is(err, ErrMailboxFull) {
+		// the sender keeps the message and tries again once the recipient has caught up
+		log.Printf("unable to deliver message %s as the mailbox of %s is full", pkgMsg.ID, pkgMsg.To.String())
+		return 429, err // too many requests
+	}
+	if err != nil {
+		log.Printf("unable to store message due to: %q", err)
+		return 500, err // internal server error
+	}
+	log.Printf("Server mailbox\n%s\n", mb.Summary())
+
+	return 200, nil // ok
+}
+
+// currentTime returns the time messages are checked against
+func (cfg *Config) currentTime() time.Time {
+	if cfg.now == nil {
+		return time.Now().UTC()
+	}
+	return cfg.now().UTC()
+}
+
+// deadLetter keeps a rejected message so that it can be inspected and retried.
+// Messages without a valid id are only logged, as they cannot be told apart.
+func (cfg *Config) deadLetter(pkgMsg msg.PackagedMessage, reason error) {
+	if !msg.IsValidMessageID(pkgMsg.ID) {
+		return
+	}
+
+	deadLetter, err := cfg.Mailboxes.DeadLetter(pkgMsg, reason)
+	if err != nil {
+		log.Printf("unable to dead letter message due to: %q", err)
+		return
+	}
+	log.Printf("message %s is a dead letter after %d attempts", pkgMsg.ID, deadLetter.Attempts)
+}
+
+func (cfg *Config) getMessages(c *gin.Context) {
+	owner, ok := cfg.authenticateMailbox(c)
+	if !ok {
+		return
+	}
+
+	// clients that cannot stream hold the request open until a message arrives
+	wait, err := parseWait(c.Query("wait"))
+	if err != nil {
+		log.Printf("unable to parse wait due to: %q", err)
 		c.Status(400) // bad request
 		return
 	}
 
-	// add to server queue
-	cfg.Queue.Enqueue(*requestMsg)
-	log.Printf("Server message queue\n%s\n", cfg.Queue.QueueSummary())
+	deliveries := cfg.Mailboxes.CollectWait(c.Request.Context(), owner, wait)
+	if c.Request.Context().Err() != nil {
+		// the leases run out, and the messages are delivered again
+		log.Printf("%s stopped waiting for messages", owner.String())
+		return
+	}
+
+	log.Printf("Delivering %d messages to %s\n", len(deliveries), owner.String())
+	respondDeliveries(c, deliveries)
+}
+
+// parseWait parses how long a request for messages waits for one to arrive,
+// a duration such as "30s" that is cut down to maxMailboxWait. No wait is 0.
+func parseWait(rawWait string) (time.Duration, error) {
+	if rawWait == "" {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(rawWait)
+	if err != nil {
+		return 0, err
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("wait of %s is negative", wait)
+	}
+	return min(wait, maxMailboxWait), nil
+}
+
+func (cfg *Config) ackMessages(c *gin.Context) {
+	owner, ok := cfg.authenticateMailbox(c)
+	if !ok {
+		return
+	}
+
+	ack := &msg.Acknowledgement{}
+	err := c.BindJSON(ack)
+	if err != nil {
+		log.Printf("unable to bind acknowledgement due to: %q", err)
+		return // BindJSON has already responded with 400
+	}
+
+	acknowledged := cfg.Mailboxes.Acknowledge(owner, ack.Leases)
 
+	log.Printf("%s acknowledged %d of %d messages\n", owner.String(), acknowledged, len(ack.Leases))
 	c.Status(200) // ok
 }
+
+// encryptionKey returns the public key that messages to the user in the query are encrypted for.
+// The server only forwards encrypted messages, it never holds the private keys.
+func (cfg *Config) encryptionKey(c *gin.Context) {
+	recipient := msg.UserVessel{
+		Name:   c.Query("name"),
+		Vessel: c.Query("vessel"),
+	}
+	if recipient.Name == "" || recipient.Vessel == "" {
+		c.Status(400) // bad request
+		return
+	}
+
+	key, err := cfg.Keys.EncryptionKey(recipient)
+	if err != nil {
+		log.Printf("unable to find encryption key due to: %q", err)
+		c.Status(404) // not found
+		return
+	}
+
+	recipientKey := msg.RecipientKey{
+		Recipient:     recipient,
+		EncryptionKey: msg.EncodeEncryptionKey(key),
+	}
+	c.JSON(200, recipientKey) // ok
+}
+
+// publicKey returns the public key that messages from the user in the query are verified with.
+// Users who sign with an hmac secret have none, as only the server can check their messages.
+func (cfg *Config) publicKey(c *gin.Context) {
+	sender := msg.UserVessel{
+		Name:   c.Query("name"),
+		Vessel: c.Query("vessel"),
+	}
+	if sender.Name == "" || sender.Vessel == "" {
+		c.Status(400) // bad request
+		return
+	}
+
+	key, err := cfg.Keys.PublicKey(sender)
+	if err != nil {
+		log.Printf("unable to find public key due to: %q", err)
+		c.Status(404) // not found
+		return
+	}
+
+	senderKey := msg.SenderKey{
+		Sender:    sender,
+		PublicKey: msg.EncodePublicKey(key),
+	}
+	c.JSON(200, senderKey) // ok
+}
+
+// requireAdmin only lets through requests with the admin token as a bearer token.
+// Admin endpoints are hidden when no admin token is set.
+func (cfg *Config) requireAdmin(c *gin.Context) {
+	if cfg.AdminToken == "" {
+		c.AbortWithStatus(404) // not found
+		return
+	}
+
+	wantAuth := "Bearer " + cfg.AdminToken
+	gotAuth := c.GetHeader("Authorization")
+	if subtle.ConstantTimeCompare([]byte(gotAuth), []byte(wantAuth)) != 1 {
+		c.AbortWithStatus(401) // unauthorized
+		return
+	}
+	c.Next()
+}
+
+func (cfg *Config) listDeadLetters(c *gin.Context) {
+	c.JSON(200, cfg.Mailboxes.DeadLetters()) // ok
+}
+
+// retryDeadLetter runs a dead letter through the same checks as a newly sent message,
+// delivering it if it passes this time
+func (cfg *Config) retryDeadLetter(c *gin.Context) {
+	deadLetter, ok := cfg.Mailboxes.DeadLetterFor(c.Param("id"))
+	if !ok {
+		c.Status(404) // not found
+		return
+	}
+
+	status, err := cfg.acceptMessage(deadLetter.Message)
+	switch status {
+	case 200:
+		_, _, err = cfg.Mailboxes.RemoveDeadLetter(deadLetter.Message.ID)
+		if err != nil {
+			log.Printf("unable to journal retried dead letter due to: %q", err)
+		}
+		c.Status(200) // ok
+
+	case 400:
+		deadLetter, err = cfg.Mailboxes.DeadLetter(deadLetter.Message, err)
+		if err != nil {
+			log.Printf("unable to journal dead letter due to: %q", err)
+		}
+		c.JSON(400, deadLetter) // bad request
+
+	default:
+		c.Status(status)
+	}
+}
+
+func (cfg *Config) purgeDeadLetter(c *gin.Context) {
+	_, ok, err := cfg.Mailboxes.RemoveDeadLetter(c.Param("id"))
+	if err != nil {
+		log.Printf("unable to journal purged dead letter due to: %q", err)
+		c.Status(500) // internal server error
+		return
+	}
+	if !ok {
+		c.Status(404) // not found
+		return
+	}
+	c.Status(200) // ok
+}
+
+func (cfg *Config) purgeDeadLetters(c *gin.Context) {
+	purged, err := cfg.Mailboxes.PurgeDeadLetters()
+	if err != nil {
+		log.Printf("unable to journal purged dead letters due to: %q", err)
+		c.Status(500) // internal server error
+		return
+	}
+
+	log.Printf("Purged %d dead letters\n", purged)
+	c.Status(200) // ok
+}
+
+// authenticateMailbox verifies the signed mailbox request in the Authorization header against
+// the request it came with, and returns its owner. Responds to the request itself when not ok.
+func (cfg *Config) authenticateMailbox(c *gin.Context) (msg.UserVessel, bool) {
+	// the signature covers the body, which is put back for the handler to read
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBytes))
+	if err != nil {
+		log.Printf("unable to read mailbox request due to: %q", err)
+		c.Status(400) // bad request
+		return msg.UserVessel{}, false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	mailboxReq, err := msg.ParseMailboxRequest(c.GetHeader("Authorization"), c.Request.Method, c.Request.URL.RequestURI(), body)
+	if err != nil {
+		log.Printf("unable to parse mailbox request due to: %q", err)
+		c.Status(400) // bad request
+		return msg.UserVessel{}, false
+	}
+
+	err = mailboxReq.VerifyRequest(cfg.Keys, time.Now().UTC(), mailboxRequestMaxAge)
+	if err != nil {
+		log.Printf("unable to verify mailbox request due to: %q", err)
+		c.Status(401) // unauthorized
+		return msg.UserVessel{}, false
+	}
+
+	// only checked once verified, so that nobody else can use up the owners nonces
+	err = cfg.Mailboxes.UseNonce(mailboxReq.Nonce, mailboxReq.Requested, mailboxRequestMaxAge)
+	if err != nil {
+		log.Printf("unable to accept mailbox request of %s due to: %q", mailboxReq.Owner.String(), err)
+		c.Status(401) // unauthorized
+		return msg.UserVessel{}, false
+	}
+
+	return mailboxReq.Owner, true
+}
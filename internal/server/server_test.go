@@ -0,0 +1,597 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// test users, each signing with their own hmac key
+var (
+	kevin = msg.UserVessel{Name: "Kevin", Vessel: "Liberty"}
+	bob   = msg.UserVessel{Name: "Bob", Vessel: "Snow"}
+
+	kevinKey = []byte("kevin's key")
+	bobKey   = []byte("bob's key")
+)
+
+// newTestConfig creates a server config that keeps its mailboxes in memory
+func newTestConfig(t *testing.T) *Config {
+	t.Helper()
+
+	keys, err := NewKeyRegistry([]KeyEntry{
+		{Name: kevin.Name, Vessel: kevin.Vessel, HMACKey: string(kevinKey)},
+		{Name: bob.Name, Vessel: bob.Vessel, HMACKey: string(bobKey)},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create key registry due to: %q", err)
+	}
+
+	return &Config{
+		Keys:         keys,
+		Mailboxes:    NewMailboxes(time.Hour),
+		ReplayWindow: 48 * time.Hour,
+		ClockSkew:    5 * time.Minute,
+	}
+}
+
+// newTestServer serves the config over http until the test ends
+func newTestServer(t *testing.T, cfg *Config) *httptest.Server {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	r, err := cfg.SetupGinEngine()
+	if err != nil {
+		t.Fatalf("Unable to setup engine due to: %q", err)
+	}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// postJSON posts the value as JSON, returning the response
+func postJSON(t *testing.T, url string, value any) *http.Response {
+	t.Helper()
+
+	body, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("Unable to marshal body due to: %q", err)
+	}
+	res, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unable to post due to: %q", err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+// newMailboxRequest creates a request to the owners mailbox, signed with their hmac key
+func newMailboxRequest(t *testing.T, ctx context.Context, method, serverURL, target string, owner msg.UserVessel, key, body []byte) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(ctx, method, serverURL+target, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unable to create request due to: %q", err)
+	}
+	mailboxReq, err := msg.NewMailboxRequest(owner, msg.NewHMACSigner(key), method, target, body)
+	if err != nil {
+		t.Fatalf("Unable to create mailbox request due to: %q", err)
+	}
+	req.Header.Set("Authorization", mailboxReq.Authorization())
+	return req
+}
+
+// readEventIDs reads the ids of count message events from a stream
+func readEventIDs(t *testing.T, reader *bufio.Reader, count int) []string {
+	t.Helper()
+
+	var ids []string
+	for len(ids) < count {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unable to read stream after %d events due to: %q", len(ids), err)
+		}
+		id, ok := strings.CutPrefix(strings.TrimSpace(line), "id:")
+		if ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// getDeliveries asks for the owners messages, waiting up to wait for one to arrive
+func getDeliveries(t *testing.T, ctx context.Context, serverURL string, owner msg.UserVessel, key []byte, wait string) ([]msg.Delivery, error) {
+	t.Helper()
+
+	target := "/get-messages"
+	if wait != "" {
+		target += "?wait=" + wait
+	}
+	res, err := http.DefaultClient.Do(newMailboxRequest(t, ctx, http.MethodGet, serverURL, target, owner, key, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 getting messages. got=%d", res.StatusCode)
+	}
+
+	var deliveries []msg.Delivery
+	err = json.NewDecoder(res.Body).Decode(&deliveries)
+	return deliveries, err
+}
+
+func TestUnverifiedMessagesAreNotDeadLettered(t *testing.T) {
+	cfg := newTestConfig(t)
+
+	// signed with the wrong key, anyone could have sent it
+	forged := newTestMessage(t, kevin, bob, "Tuesday", []byte("not kevin's key"))
+	status, err := cfg.receiveMessage(forged)
+	if status != 400 || err == nil {
+		t.Errorf("Expected the forged message to be rejected. got=%d %v", status, err)
+	}
+	if _, ok := cfg.Mailboxes.DeadLetterFor(forged.ID); ok {
+		t.Errorf("Expected the forged message to not be dead lettered")
+	}
+}
+
+func TestDeadLetterIsNotReplacedByID(t *testing.T) {
+	cfg := newTestConfig(t)
+	// every message is too old to be accepted, once it has been verified
+	cfg.ReplayWindow = time.Nanosecond
+
+	pkgMsg := newTestMessage(t, kevin, bob, "Tuesday", kevinKey)
+	status, _ := cfg.receiveMessage(pkgMsg)
+	if status != 400 {
+		t.Fatalf("Expected the message to be rejected. got=%d", status)
+	}
+	if _, ok := cfg.Mailboxes.DeadLetterFor(pkgMsg.ID); !ok {
+		t.Fatalf("Expected the verified message to be dead lettered")
+	}
+
+	// another message claiming the same id does not replace it
+	impostor := newTestMessage(t, bob, kevin, "Wednesday", bobKey)
+	impostor.ID = pkgMsg.ID
+	_, err := cfg.Mailboxes.DeadLetter(impostor, msg.ErrMessageTooOld)
+	if !errors.Is(err, msg.ErrDeadLetterConflict) {
+		t.Errorf("Expected ErrDeadLetterConflict, but got %v", err)
+	}
+
+	deadLetter, ok := cfg.Mailboxes.DeadLetterFor(pkgMsg.ID)
+	if !ok || deadLetter.Message.From != kevin || deadLetter.Message.Subject != "Tuesday" {
+		t.Errorf("Expected the dead letter to be left as it was. got=%+v", deadLetter.Message)
+	}
+}
+
+func TestSendOutsideReplayWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		shift      time.Duration
+		wantStatus int
+	}{
+		{"fresh", 0, http.StatusOK},
+		{"within the window", 47 * time.Hour, http.StatusOK},
+		{"stale", 48*time.Hour + time.Minute, http.StatusBadRequest},
+		{"within the skew", -4 * time.Minute, http.StatusOK},
+		{"future dated", -6 * time.Minute, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			// moving the server's clock ages the message, which is packaged now
+			cfg.now = func() time.Time { return time.Now().Add(tt.shift) }
+			server := newTestServer(t, cfg)
+
+			pkgMsg := newTestMessage(t, kevin, bob, "Tuesday", kevinKey)
+			res := postJSON(t, server.URL+"/send-message", pkgMsg)
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("Status mismatch. got=%d want=%d", res.StatusCode, tt.wantStatus)
+			}
+
+			deliveries, err := getDeliveries(t, context.Background(), server.URL, bob, bobKey, "")
+			if err != nil {
+				t.Fatalf("Unable to get messages due to: %q", err)
+			}
+			_, deadLettered := cfg.Mailboxes.DeadLetterFor(pkgMsg.ID)
+			if tt.wantStatus == http.StatusOK {
+				if len(deliveries) != 1 || deadLettered {
+					t.Errorf("Expected the message to be delivered. got=%d deliveries, dead lettered=%t", len(deliveries), deadLettered)
+				}
+				return
+			}
+			if len(deliveries) != 0 || !deadLettered {
+				t.Errorf("Expected the message to be dead lettered. got=%d deliveries, dead lettered=%t", len(deliveries), deadLettered)
+			}
+		})
+	}
+}
+
+func TestMessageExpiringWhileQueuedIsDeadLettered(t *testing.T) {
+	cfg := newTestConfig(t)
+	server := newTestServer(t, cfg)
+
+	rawMsg := msg.RawMessage{
+		ToName:     bob.Name,
+		ToVessel:   bob.Vessel,
+		FromName:   kevin.Name,
+		FromVessel: kevin.Vessel,
+		Subject:    "Tuesday",
+		Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+		TTL:        200 * time.Millisecond,
+	}
+	pkgMsg, err := rawMsg.ToPackagedMessage(kevinKey)
+	if err != nil {
+		t.Fatalf("Unable to package message due to: %q", err)
+	}
+	res := postJSON(t, server.URL+"/send-message", pkgMsg)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the message to be accepted before it expires. got=%d", res.StatusCode)
+	}
+
+	time.Sleep(time.Until(pkgMsg.Expires) + 50*time.Millisecond)
+
+	deliveries, err := getDeliveries(t, context.Background(), server.URL, bob, bobKey, "")
+	if err != nil {
+		t.Fatalf("Unable to get messages due to: %q", err)
+	}
+	if len(deliveries) != 0 {
+		t.Errorf("Expected the expired message to not be delivered. got=%d", len(deliveries))
+	}
+	deadLetter, ok := cfg.Mailboxes.DeadLetterFor(pkgMsg.ID)
+	if !ok {
+		t.Fatalf("Expected the expired message to be dead lettered")
+	}
+	if deadLetter.Reason != msg.ErrMessageExpired.Error() {
+		t.Errorf("Dead letter reason mismatch. got=%q want=%q", deadLetter.Reason, msg.ErrMessageExpired.Error())
+	}
+}
+
+func TestSendToFullMailbox(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Mailboxes.SetCapacity(1)
+	server := newTestServer(t, cfg)
+
+	res := postJSON(t, server.URL+"/send-message", newTestMessage(t, kevin, bob, "Tuesday", kevinKey))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the first message to be delivered. got=%d", res.StatusCode)
+	}
+
+	// sent on its own
+	res = postJSON(t, server.URL+"/send-message", newTestMessage(t, kevin, bob, "Wednesday", kevinKey))
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 for a full mailbox. got=%d", res.StatusCode)
+	}
+	if retryAfter := res.Header.Get("Retry-After"); retryAfter != "30" {
+		t.Errorf("Retry-After mismatch. got=%q want=%q", retryAfter, "30")
+	}
+
+	// and in a batch, where only the message to the full mailbox is turned away
+	batch := []msg.PackagedMessage{
+		newTestMessage(t, kevin, bob, "Thursday", kevinKey),
+		newTestMessage(t, bob, kevin, "Re: Tuesday", bobKey),
+	}
+	res = postJSON(t, server.URL+"/send-messages", batch)
+	var results []msg.SendResult
+	err := json.NewDecoder(res.Body).Decode(&results)
+	if err != nil {
+		t.Fatalf("Unable to decode results due to: %q", err)
+	}
+	if len(results) != 2 || results[0].Status != 429 || results[0].RetryAfter != 30 || results[1].Status != 200 {
+		t.Errorf("Expected only the message to the full mailbox to be turned away. got=%+v", results)
+	}
+
+	// nothing that was turned away for now is a dead letter
+	if deadLetters := cfg.Mailboxes.DeadLetters(); len(deadLetters) != 0 {
+		t.Errorf("Expected no dead letters. got=%d", len(deadLetters))
+	}
+}
+
+func TestSendBatchPartialFailure(t *testing.T) {
+	cfg := newTestConfig(t)
+	server := newTestServer(t, cfg)
+
+	batch := []msg.PackagedMessage{
+		newTestMessage(t, kevin, bob, "Tuesday", kevinKey),
+		newTestMessage(t, kevin, bob, "forged", []byte("not kevin's key")),
+		newTestMessage(t, kevin, bob, "Wednesday", kevinKey),
+	}
+	res := postJSON(t, server.URL+"/send-messages", batch)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the batch to be taken. got=%d", res.StatusCode)
+	}
+
+	var results []msg.SendResult
+	err := json.NewDecoder(res.Body).Decode(&results)
+	if err != nil {
+		t.Fatalf("Unable to decode results due to: %q", err)
+	}
+	wantStatuses := []int{200, 400, 200}
+	if len(results) != len(wantStatuses) {
+		t.Fatalf("Expected a result for each message. got=%d", len(results))
+	}
+	for i, result := range results {
+		if result.ID != batch[i].ID || result.Status != wantStatuses[i] {
+			t.Errorf("result %d mismatch. got=%s %d want=%s %d", i, result.ID, result.Status, batch[i].ID, wantStatuses[i])
+		}
+	}
+	if results[1].Error == "" {
+		t.Errorf("Expected the rejected message to say why")
+	}
+
+	// the bad message did not stop the rest from being delivered
+	if size := cfg.Mailboxes.Mailbox(bob).Size(); size != 2 {
+		t.Errorf("Expected two messages in the mailbox. size=%d", size)
+	}
+}
+
+func TestStreamResumesAfterLastEventID(t *testing.T) {
+	cfg := newTestConfig(t)
+	server := newTestServer(t, cfg)
+
+	var sent []string
+	for _, subject := range []string{"Tuesday", "Wednesday", "Thursday"} {
+		pkgMsg := newTestMessage(t, kevin, bob, subject, kevinKey)
+		_, err := cfg.Mailboxes.Deliver(pkgMsg)
+		if err != nil {
+			t.Fatalf("Unable to deliver message due to: %q", err)
+		}
+		sent = append(sent, pkgMsg.ID)
+	}
+
+	stream := func(lastEventID string, count int) []string {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		req := newMailboxRequest(t, ctx, http.MethodGet, server.URL, "/stream-messages", bob, bobKey, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unable to stream messages due to: %q", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 streaming messages. got=%d", res.StatusCode)
+		}
+		return readEventIDs(t, bufio.NewReader(res.Body), count)
+	}
+
+	// the link drops after every message was streamed, but only the first was put into the inbox
+	ids := stream("", 3)
+	for i := range sent {
+		if ids[i] != sent[i] {
+			t.Fatalf("event %d mismatch. got=%s want=%s", i, ids[i], sent[i])
+		}
+	}
+
+	// resuming acknowledges the first, and streams the others again in order
+	ids = stream(sent[0], 2)
+	if ids[0] != sent[1] || ids[1] != sent[2] {
+		t.Errorf("Expected the messages after the last event again. got=%v want=%v", ids, sent[1:])
+	}
+	if size := cfg.Mailboxes.Mailbox(bob).Size(); size != 2 {
+		t.Errorf("Expected the first message to be acknowledged. size=%d", size)
+	}
+}
+
+func TestGetMessagesLongPoll(t *testing.T) {
+	cfg := newTestConfig(t)
+	server := newTestServer(t, cfg)
+
+	// nothing arrives, so the wait runs out
+	started := time.Now()
+	deliveries, err := getDeliveries(t, context.Background(), server.URL, bob, bobKey, "200ms")
+	if err != nil {
+		t.Fatalf("Unable to get messages due to: %q", err)
+	}
+	if len(deliveries) != 0 {
+		t.Errorf("Expected no deliveries. got=%d", len(deliveries))
+	}
+	if waited := time.Since(started); waited < 200*time.Millisecond {
+		t.Errorf("Expected the request to be held open for the wait. waited=%s", waited)
+	}
+
+	// a message arriving while waiting is delivered straight away
+	pkgMsg := newTestMessage(t, kevin, bob, "Tuesday", kevinKey)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cfg.Mailboxes.Deliver(pkgMsg)
+	}()
+	started = time.Now()
+	deliveries, err = getDeliveries(t, context.Background(), server.URL, bob, bobKey, "10s")
+	if err != nil {
+		t.Fatalf("Unable to get messages due to: %q", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Message.ID != pkgMsg.ID {
+		t.Errorf("Expected the message that arrived. got=%d deliveries", len(deliveries))
+	}
+	if waited := time.Since(started); waited > 5*time.Second {
+		t.Errorf("Expected the message to be delivered as it arrived. waited=%s", waited)
+	}
+}
+
+func TestGetMessagesLongPollCancelled(t *testing.T) {
+	cfg := newTestConfig(t)
+	server := newTestServer(t, cfg)
+
+	// the client gives up waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := getDeliveries(t, ctx, server.URL, bob, bobKey, "10s")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the request to be cancelled. got=%v", err)
+	}
+
+	// a message arriving afterwards is not leased to the request that went away
+	time.Sleep(50 * time.Millisecond)
+	pkgMsg := newTestMessage(t, kevin, bob, "Tuesday", kevinKey)
+	_, err = cfg.Mailboxes.Deliver(pkgMsg)
+	if err != nil {
+		t.Fatalf("Unable to deliver message due to: %q", err)
+	}
+	deliveries, err := getDeliveries(t, context.Background(), server.URL, bob, bobKey, "")
+	if err != nil {
+		t.Fatalf("Unable to get messages due to: %q", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Message.ID != pkgMsg.ID {
+		t.Errorf("Expected the message to still be delivered. got=%d deliveries", len(deliveries))
+	}
+}
+
+func TestDecompressionBombIsCapped(t *testing.T) {
+	cfg := newTestConfig(t)
+	server := newTestServer(t, cfg)
+
+	// a few kilobytes that decode to more than a batch can be. Spaces keep the json
+	// decoder reading, so it is the size cap that stops it
+	var body bytes.Buffer
+	writer := gzip.NewWriter(&body)
+	writer.Write([]byte("["))
+	writer.Write(bytes.Repeat([]byte(" "), maxBatchBytes+1<<20))
+	writer.Write([]byte("]"))
+	writer.Close()
+	if body.Len() > maxBatchBytes/100 {
+		t.Fatalf("Expected the compressed body to be small. got=%d bytes", body.Len())
+	}
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/send-messages", &body)
+	if err != nil {
+		t.Fatalf("Unable to create request due to: %q", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unable to post due to: %q", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413 for a body that decodes past the cap. got=%d", res.StatusCode)
+	}
+}
+
+func TestDuplicatesAreKeyedBySender(t *testing.T) {
+	cfg := newTestConfig(t)
+	server := newTestServer(t, cfg)
+
+	// the sender did not get the response, so sends it again
+	pkgMsg := newTestMessage(t, kevin, bob, "Tuesday", kevinKey)
+	for range 2 {
+		res := postJSON(t, server.URL+"/send-message", pkgMsg)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200 for the message and its duplicate. got=%d", res.StatusCode)
+		}
+	}
+	if size := cfg.Mailboxes.Mailbox(bob).Size(); size != 1 {
+		t.Fatalf("Expected the duplicate to not be delivered twice. size=%d", size)
+	}
+
+	// ids are chosen by senders, so another sender using the same id is not a duplicate
+	collision := newTestMessage(t, bob, bob, "Wednesday", bobKey)
+	collision.ID = pkgMsg.ID
+	_, err := cfg.Mailboxes.Deliver(collision)
+	if err != nil {
+		t.Fatalf("Expected a message from another sender with the same id to be delivered. got=%q", err)
+	}
+	if size := cfg.Mailboxes.Mailbox(bob).Size(); size != 2 {
+		t.Errorf("Expected both messages in the mailbox. size=%d", size)
+	}
+	_, err = cfg.Mailboxes.Deliver(collision)
+	if !errors.Is(err, ErrDuplicateMessage) {
+		t.Errorf("Expected the second message to also be kept from being delivered twice. got=%v", err)
+	}
+}
+
+func TestStreamRedeliversTimedOutLease(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Mailboxes.leaseTimeout = 100 * time.Millisecond
+	server := newTestServer(t, cfg)
+
+	pkgMsg := newTestMessage(t, kevin, bob, "Tuesday", kevinKey)
+	_, err := cfg.Mailboxes.Deliver(pkgMsg)
+	if err != nil {
+		t.Fatalf("Unable to deliver message due to: %q", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := http.DefaultClient.Do(newMailboxRequest(t, ctx, http.MethodGet, server.URL, "/stream-messages", bob, bobKey, nil))
+	if err != nil {
+		t.Fatalf("Unable to stream messages due to: %q", err)
+	}
+	defer res.Body.Close()
+
+	// never acknowledged, so it is streamed again once the lease times out rather than after the keep-alive
+	ids := readEventIDs(t, bufio.NewReader(res.Body), 2)
+	if ids[0] != pkgMsg.ID || ids[1] != pkgMsg.ID {
+		t.Errorf("Expected the message to be streamed twice. got=%v", ids)
+	}
+}
+
+func TestPublicKey(t *testing.T) {
+	anna := msg.UserVessel{Name: "Anna", Vessel: "Liberty"}
+	publicKey := ed25519.NewKeyFromSeed([]byte("0123456789abcdef0123456789abcdef")).Public().(ed25519.PublicKey)
+
+	cfg := newTestConfig(t)
+	keys, err := NewKeyRegistry([]KeyEntry{
+		{Name: kevin.Name, Vessel: kevin.Vessel, HMACKey: string(kevinKey)},
+		{Name: anna.Name, Vessel: anna.Vessel, PublicKey: msg.EncodePublicKey(publicKey)},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create key registry due to: %q", err)
+	}
+	cfg.Keys = keys
+	server := newTestServer(t, cfg)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{"public key", "?name=Anna&vessel=Liberty", http.StatusOK},
+		// only the server can check messages signed with an hmac secret
+		{"hmac key", "?name=Kevin&vessel=Liberty", http.StatusNotFound},
+		{"unknown", "?name=Bob&vessel=Snow", http.StatusNotFound},
+		{"missing vessel", "?name=Anna", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Get(server.URL + "/public-key" + tt.query)
+			if err != nil {
+				t.Fatalf("Unable to get public key due to: %q", err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("Status mismatch. got=%d want=%d", res.StatusCode, tt.wantStatus)
+			}
+			if res.StatusCode != http.StatusOK {
+				return
+			}
+
+			var senderKey msg.SenderKey
+			err = json.NewDecoder(res.Body).Decode(&senderKey)
+			if err != nil {
+				t.Fatalf("Unable to decode public key due to: %q", err)
+			}
+			if senderKey.Sender != anna || senderKey.PublicKey != msg.EncodePublicKey(publicKey) {
+				t.Errorf("Public key mismatch. got=%+v", senderKey)
+			}
+		})
+	}
+}
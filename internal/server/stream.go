@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// streamKeepAlive is how often an idle stream sends a comment,
+// so that clients can tell a quiet stream from a dropped link
+const streamKeepAlive = 15 * time.Second
+
+// *** Internal Types ***
+
+// streamedDelivery is a delivery made over a stream, remembered until the owner resumes their stream
+type streamedDelivery struct {
+	lease     uint64
+	messageID string
+}
+
+// *** Functions ***
+
+// streamMessages sends each message to its owner as a server-sent event the moment it is in
+// their mailbox. Every event is a delivery, acknowledged as usual, with the message id as its id.
+// Reconnecting with the Last-Event-ID header acknowledges every delivery streamed up to and
+// including that event, and streams the deliveries after it again, so nothing is missed.
+func (cfg *Config) streamMessages(c *gin.Context) {
+	owner, ok := cfg.authenticateMailbox(c)
+	if !ok {
+		return
+	}
+
+	// a client that lost its link reconnects before the server notices, so the old stream is closed
+	mb := cfg.Mailboxes.Mailbox(owner)
+	ctx, closeStream := mb.openStream(c.Request.Context())
+	defer closeStream()
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID != "" {
+		acknowledged, redelivered := cfg.Mailboxes.Resume(owner, lastEventID)
+		log.Printf("%s resumed their stream after %s, %d acknowledged and %d to send again\n", owner.String(), lastEventID, acknowledged, redelivered)
+	}
+	log.Printf("Streaming messages to %s\n", owner.String())
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(200) // ok
+	c.Writer.Flush()
+
+	for {
+		deliveries := cfg.Mailboxes.CollectStream(owner)
+		for _, delivery := range deliveries {
+			c.Render(-1, sse.Event{Id: delivery.Message.ID, Event: "message", Data: delivery})
+		}
+		if len(deliveries) > 0 {
+			log.Printf("Streamed %d messages to %s\n", len(deliveries), owner.String())
+		}
+		c.Writer.Flush()
+
+		waitCtx, cancel := context.WithTimeout(ctx, streamKeepAlive)
+		err := mb.wait(waitCtx, cfg.Mailboxes.leaseTimeout)
+		cancel()
+		if ctx.Err() != nil {
+			log.Printf("Stream to %s closed\n", owner.String())
+			return
+		}
+		if err != nil {
+			// nothing arrived in time, a comment keeps the stream alive
+			c.Writer.WriteString(": keep-alive\n\n")
+		}
+	}
+}
+
+// openStream makes a new stream the one delivering to the owner, closing any stream open before it.
+// Returns the context the stream runs under, and a function to call once it ends.
+func (mb *Mailbox) openStream(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	mb.mux.Lock()
+	if mb.closeStream != nil {
+		mb.closeStream()
+	}
+	mb.closeStream = cancel
+	mb.streams++
+	stream := mb.streams
+	mb.mux.Unlock()
+
+	return ctx, func() {
+		cancel()
+
+		mb.mux.Lock()
+		if mb.streams == stream {
+			mb.closeStream = nil
+		}
+		mb.mux.Unlock()
+	}
+}
+
+// recordStreamed remembers deliveries made over a stream,
+// forgetting earlier ones that are no longer leased
+func (mb *Mailbox) recordStreamed(deliveries []msg.Delivery) {
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+
+	leased := make(map[uint64]bool)
+	for _, lease := range mb.queue.Leases() {
+		leased[lease.ID] = true
+	}
+
+	streamed := mb.streamed[:0]
+	for _, delivery := range mb.streamed {
+		if leased[delivery.lease] {
+			streamed = append(streamed, delivery)
+		}
+	}
+	for _, delivery := range deliveries {
+		streamed = append(streamed, streamedDelivery{lease: delivery.Lease, messageID: delivery.Message.ID})
+	}
+	mb.streamed = streamed
+}
+
+// takeStreamed returns the deliveries made over streams, oldest first, and forgets them
+func (mb *Mailbox) takeStreamed() []streamedDelivery {
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+
+	streamed := mb.streamed
+	mb.streamed = nil
+	return streamed
+}
+
+// CollectStream collects the owners messages like Collect,
+// remembering the order they were streamed in so that the stream can be resumed
+func (mbs *Mailboxes) CollectStream(owner msg.UserVessel) []msg.Delivery {
+	deliveries := mbs.Collect(owner)
+	if len(deliveries) > 0 {
+		mbs.Mailbox(owner).recordStreamed(deliveries)
+	}
+	return deliveries
+}
+
+// Resume settles the deliveries made over the owners earlier streams once they reconnect.
+// Deliveries up to and including the message lastID were recieved and are acknowledged,
+// those after it are put back at the front of the mailbox to be streamed again. Every
+// delivery is put back when lastID was not streamed. Returns how many were acknowledged and put back.
+func (mbs *Mailboxes) Resume(owner msg.UserVessel, lastID string) (int, int) {
+	mb := mbs.Mailbox(owner)
+	streamed := mb.takeStreamed()
+
+	recieved := -1
+	for i, delivery := range streamed {
+		if delivery.messageID == lastID {
+			recieved = i
+		}
+	}
+
+	leaseIDs := make([]uint64, 0, recieved+1)
+	for _, delivery := range streamed[:recieved+1] {
+		leaseIDs = append(leaseIDs, delivery.lease)
+	}
+	acknowledged := mbs.Acknowledge(owner, leaseIDs)
+
+	// newest first so that the oldest ends up at the front
+	redelivered := 0
+	for i := len(streamed) - 1; i > recieved; i-- {
+		if mb.queue.Requeue(streamed[i].lease) {
+			redelivered++
+		}
+	}
+	return acknowledged, redelivered
+}
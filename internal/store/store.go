@@ -0,0 +1,437 @@
+// Package store implements an append-only journal that keeps queued messages on disk
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+// *** Types ***
+
+// Op is the kind of change a record makes to a box
+type Op string
+
+const (
+	// OpPut adds a message to the back of a box
+	OpPut Op = "put"
+	// OpDel removes a message from a box
+	OpDel Op = "del"
+	// OpSeen remembers a message key after the message itself is deleted
+	OpSeen Op = "seen"
+	// OpDead records a dead letter in a box, replacing one with the same key
+	OpDead Op = "dead"
+	// OpRevive removes a dead letter from a box
+	OpRevive Op = "revive"
+)
+
+// Record is a single line in the journal
+type Record struct {
+	Op   Op                   `json:"op"`
+	Box  string               `json:"box,omitempty"`
+	Key  string               `json:"key,omitempty"`
+	At   time.Time            `json:"at,omitzero"`
+	Msg  *msg.PackagedMessage `json:"msg,omitempty"`
+	Dead *msg.DeadLetter      `json:"dead,omitempty"`
+}
+
+// Journal is an append-only log of puts and deletes for named boxes of messages.
+// Every write is synced to disk before returning.
+type Journal struct {
+	path    string
+	file    *os.File
+	garbage int
+	seen    map[string]time.Time
+	dead    DeadLetters
+	mux     *sync.Mutex
+}
+
+// Boxes is the state of every box after replaying the journal
+type Boxes map[string][]msg.PackagedMessage
+
+// Seen holds the key of every message ever put, and when it was put
+type Seen map[string]time.Time
+
+// DeadLetters is the dead letters of every box, oldest first
+type DeadLetters map[string][]msg.DeadLetter
+
+// *** Errors ***
+
+// ErrCorruptJournal is returned when a record in the middle of the journal cannot be read
+var ErrCorruptJournal = errors.New("journal is corrupt")
+
+// *** Functions ***
+
+// MessageKey returns the key a message is identified by within the journal.
+// Ids are chosen by senders, so they are only unique along with the sender,
+// which is escaped the same way as mailboxes so that no two senders share keys.
+// Messages from before ids were added are identified by their signature.
+func MessageKey(pkgMsg *msg.PackagedMessage) string {
+	if pkgMsg.ID == "" {
+		return pkgMsg.Signature
+	}
+	return url.QueryEscape(pkgMsg.From.Name) + "@" + url.QueryEscape(pkgMsg.From.Vessel) + "/" + pkgMsg.ID
+}
+
+// hasKey reports whether the message is identified by the key. Journals written
+// before the sender was part of the key identify messages by their id alone.
+func hasKey(pkgMsg *msg.PackagedMessage, key string) bool {
+	return MessageKey(pkgMsg) == key || (pkgMsg.ID != "" && pkgMsg.ID == key)
+}
+
+// Open opens or creates the journal at path, replays it and compacts it.
+// Seen keys older than seenRetention are forgotten, a retention of 0 forgets them all.
+// A partially written record at the end of the journal is discarded.
+func Open(path string, seenRetention time.Duration) (*Journal, Boxes, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create journal directory: %w", err)
+	}
+
+	boxes, seen, dead, err := replay(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cutoff := time.Now().UTC().Add(-seenRetention)
+	for key, at := range seen {
+		if at.Before(cutoff) {
+			delete(seen, key)
+		}
+	}
+
+	j := &Journal{
+		path: path,
+		seen: seen,
+		dead: dead,
+		mux:  &sync.Mutex{},
+	}
+
+	// compacting on open drops deleted messages and any torn record
+	err = j.Compact(boxes, seen, dead)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return j, boxes, nil
+}
+
+// Put records a message being added to a box
+func (j *Journal) Put(box string, pkgMsg msg.PackagedMessage) error {
+	return j.append(Record{Op: OpPut, Box: box, At: time.Now().UTC(), Msg: &pkgMsg})
+}
+
+// Delete records a message being removed from a box
+func (j *Journal) Delete(box string, pkgMsg msg.PackagedMessage) error {
+	err := j.append(Record{Op: OpDel, Box: box, Key: MessageKey(&pkgMsg)})
+	if err != nil {
+		return err
+	}
+
+	j.mux.Lock()
+	j.garbage++
+	j.mux.Unlock()
+	return nil
+}
+
+// PutDeadLetter records a dead letter in a box, replacing any for the same message
+func (j *Journal) PutDeadLetter(box string, deadLetter msg.DeadLetter) error {
+	return j.append(Record{Op: OpDead, Box: box, Key: MessageKey(&deadLetter.Message), Dead: &deadLetter})
+}
+
+// DeleteDeadLetter records a dead letter being removed from a box
+func (j *Journal) DeleteDeadLetter(box string, deadLetter msg.DeadLetter) error {
+	err := j.append(Record{Op: OpRevive, Box: box, Key: MessageKey(&deadLetter.Message)})
+	if err != nil {
+		return err
+	}
+
+	j.mux.Lock()
+	j.garbage++
+	j.mux.Unlock()
+	return nil
+}
+
+// DeadLetters returns the dead letters that were in the journal when it was opened
+func (j *Journal) DeadLetters() DeadLetters {
+	j.mux.Lock()
+	dead := make(DeadLetters, len(j.dead))
+	for box, deadLetters := range j.dead {
+		dead[box] = append([]msg.DeadLetter(nil), deadLetters...)
+	}
+	j.mux.Unlock()
+
+	return dead
+}
+
+// Seen returns the message keys that were put into the journal
+// before it was opened, and when they were put
+func (j *Journal) Seen() Seen {
+	j.mux.Lock()
+	seen := make(Seen, len(j.seen))
+	for key, at := range j.seen {
+		seen[key] = at
+	}
+	j.mux.Unlock()
+
+	return seen
+}
+
+// Garbage returns how many deleted messages are still taking space in the journal
+func (j *Journal) Garbage() int {
+	j.mux.Lock()
+	garbage := j.garbage
+	j.mux.Unlock()
+
+	return garbage
+}
+
+// Compact rewrites the journal so that it only contains the boxes, seen keys and dead letters given.
+// The caller must make sure no puts or deletes happen while compacting.
+func (j *Journal) Compact(boxes Boxes, seen Seen, dead DeadLetters) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	tmpPath := j.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to create compacted journal: %w", err)
+	}
+
+	writer := bufio.NewWriter(tmpFile)
+	for key, at := range seen {
+		err = writeRecord(writer, Record{Op: OpSeen, Key: key, At: at})
+		if err != nil {
+			tmpFile.Close()
+			return err
+		}
+	}
+	for box, pkgMsgs := range boxes {
+		for _, pkgMsg := range pkgMsgs {
+			err = writeRecord(writer, Record{Op: OpPut, Box: box, At: seen[MessageKey(&pkgMsg)], Msg: &pkgMsg})
+			if err != nil {
+				tmpFile.Close()
+				return err
+			}
+		}
+	}
+	for box, deadLetters := range dead {
+		for _, deadLetter := range deadLetters {
+			err = writeRecord(writer, Record{Op: OpDead, Box: box, Key: MessageKey(&deadLetter.Message), Dead: &deadLetter})
+			if err != nil {
+				tmpFile.Close()
+				return err
+			}
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("unable to write compacted journal: %w", err)
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("unable to close compacted journal: %w", err)
+	}
+
+	// swap the compacted journal in. The old file is kept open until the swap is done,
+	// so that a failed rename leaves the journal working as it was
+	err = os.Rename(tmpPath, j.path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("unable to replace journal: %w", err)
+	}
+
+	// the old file has been replaced, so it is closed even if the new one cannot be opened,
+	// as anything written to it would be lost
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = file
+	if err != nil {
+		return fmt.Errorf("unable to reopen journal: %w", err)
+	}
+	j.garbage = 0
+
+	return syncDir(filepath.Dir(j.path))
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// append writes a single record and syncs it to disk
+func (j *Journal) append(rec Record) error {
+	var buf bytes.Buffer
+	err := writeRecord(&buf, rec)
+	if err != nil {
+		return err
+	}
+
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	if j.file == nil {
+		return errors.New("journal is closed")
+	}
+
+	_, err = j.file.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("unable to write to journal: %w", err)
+	}
+
+	err = j.file.Sync()
+	if err != nil {
+		return fmt.Errorf("unable to sync journal: %w", err)
+	}
+	return nil
+}
+
+// writeRecord writes a record as a single line of json
+func writeRecord(w io.Writer, rec Record) error {
+	recData, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("unable to marshal journal record: %w", err)
+	}
+
+	_, err = w.Write(append(recData, '\n'))
+	return err
+}
+
+// replay reads the journal at path and returns the resulting boxes, seen keys and dead letters
+func replay(path string) (Boxes, Seen, DeadLetters, error) {
+	boxes := make(Boxes)
+	seen := make(Seen)
+	dead := make(DeadLetters)
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return boxes, seen, dead, nil
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to open journal: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// anything without a newline is a torn write from a crash
+			return boxes, seen, dead, nil
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("unable to read journal: %w", err)
+		}
+
+		var rec Record
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: line %d: %w", ErrCorruptJournal, lineNum, err)
+		}
+
+		switch rec.Op {
+		case OpPut:
+			if rec.Msg == nil {
+				return nil, nil, nil, fmt.Errorf("%w: line %d: put without message", ErrCorruptJournal, lineNum)
+			}
+			boxes[rec.Box] = append(boxes[rec.Box], *rec.Msg)
+			seen[MessageKey(rec.Msg)] = rec.At
+
+		case OpDel:
+			boxes[rec.Box] = deleteFirst(boxes[rec.Box], rec.Key)
+			if len(boxes[rec.Box]) == 0 {
+				delete(boxes, rec.Box)
+			}
+
+		case OpSeen:
+			seen[rec.Key] = rec.At
+
+		case OpDead:
+			if rec.Dead == nil {
+				return nil, nil, nil, fmt.Errorf("%w: line %d: dead letter without message", ErrCorruptJournal, lineNum)
+			}
+			dead[rec.Box] = replaceDeadLetter(dead[rec.Box], *rec.Dead)
+
+		case OpRevive:
+			dead[rec.Box] = deleteDeadLetter(dead[rec.Box], rec.Key)
+			if len(dead[rec.Box]) == 0 {
+				delete(dead, rec.Box)
+			}
+
+		default:
+			return nil, nil, nil, fmt.Errorf("%w: line %d: unknown op %q", ErrCorruptJournal, lineNum, rec.Op)
+		}
+	}
+}
+
+// deleteFirst removes the first message with the key, keeping the order of the rest
+func deleteFirst(pkgMsgs []msg.PackagedMessage, key string) []msg.PackagedMessage {
+	for i := range pkgMsgs {
+		if hasKey(&pkgMsgs[i], key) {
+			return append(pkgMsgs[:i], pkgMsgs[i+1:]...)
+		}
+	}
+	return pkgMsgs
+}
+
+// replaceDeadLetter replaces the dead letter with the same key, or adds it to the end
+func replaceDeadLetter(deadLetters []msg.DeadLetter, deadLetter msg.DeadLetter) []msg.DeadLetter {
+	key := MessageKey(&deadLetter.Message)
+	for i := range deadLetters {
+		if MessageKey(&deadLetters[i].Message) == key {
+			deadLetters[i] = deadLetter
+			return deadLetters
+		}
+	}
+	return append(deadLetters, deadLetter)
+}
+
+// deleteDeadLetter removes the dead letter with the key, keeping the order of the rest
+func deleteDeadLetter(deadLetters []msg.DeadLetter, key string) []msg.DeadLetter {
+	for i := range deadLetters {
+		if hasKey(&deadLetters[i].Message, key) {
+			return append(deadLetters[:i], deadLetters[i+1:]...)
+		}
+	}
+	return deadLetters
+}
+
+// syncDir syncs a directory so that renames within it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to open journal directory: %w", err)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("unable to sync journal directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,426 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicholasss/async-messages/internal/msg"
+)
+
+var storeSecretKey = []byte("GgfY0UssupyYBlFy92/ENsq5/Qy8dq3bh3Mp8hZcPMDEdSnxMgi5E1TPzJuHVHzRs60aq6r7gKyLGwbauaUn1Q==")
+
+// packageMessages is a helper that packages a message for each subject
+func packageMessages(t *testing.T, subjects ...string) []msg.PackagedMessage {
+	t.Helper()
+
+	pkgMsgs := make([]msg.PackagedMessage, 0)
+	for _, subject := range subjects {
+		rawMsg := msg.RawMessage{
+			ToName:     "Bob",
+			ToVessel:   "Snow",
+			FromName:   "Kevin",
+			FromVessel: "Liberty",
+			Subject:    subject,
+			Body:       "I am planning on proceeding on tuesday since there is a break in the weather",
+		}
+		pkgMsg, err := rawMsg.ToPackagedMessage(storeSecretKey)
+		if err != nil {
+			t.Fatalf("Unable to make new message due to: %q", err)
+		}
+		pkgMsgs = append(pkgMsgs, *pkgMsg)
+	}
+	return pkgMsgs
+}
+
+// subjectsOf is a helper that returns the subjects of messages in order
+func subjectsOf(pkgMsgs []msg.PackagedMessage) []string {
+	subjects := make([]string, 0)
+	for _, pkgMsg := range pkgMsgs {
+		subjects = append(subjects, pkgMsg.Subject)
+	}
+	return subjects
+}
+
+func equalSubjects(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.journal")
+	pkgMsgs := packageMessages(t, "Tuesday", "Re: Tuesday", "Re: Re: Tuesday")
+
+	journal, boxes, err := Open(path, 0)
+	if err != nil {
+		t.Fatalf("Unable to open journal due to: %q", err)
+	}
+	if len(boxes) != 0 {
+		t.Errorf("New journal should not have any boxes. got=%d", len(boxes))
+	}
+
+	for _, pkgMsg := range pkgMsgs {
+		err = journal.Put("Bob@Snow", pkgMsg)
+		if err != nil {
+			t.Fatalf("Unable to put message due to: %q", err)
+		}
+	}
+	err = journal.Put("outbox", pkgMsgs[0])
+	if err != nil {
+		t.Fatalf("Unable to put message due to: %q", err)
+	}
+	err = journal.Delete("Bob@Snow", pkgMsgs[1])
+	if err != nil {
+		t.Fatalf("Unable to delete message due to: %q", err)
+	}
+	if journal.Garbage() != 1 {
+		t.Errorf("Garbage should count deleted messages. got=%d want=%d", journal.Garbage(), 1)
+	}
+	journal.Close()
+
+	// reopening should replay what was written
+	journal, boxes, err = Open(path, 0)
+	if err != nil {
+		t.Fatalf("Unable to reopen journal due to: %q", err)
+	}
+	defer journal.Close()
+
+	wantBob := []string{"Tuesday", "Re: Re: Tuesday"}
+	if got := subjectsOf(boxes["Bob@Snow"]); !equalSubjects(got, wantBob) {
+		t.Errorf("Replayed box mismatch. got=%q want=%q", got, wantBob)
+	}
+	wantOutbox := []string{"Tuesday"}
+	if got := subjectsOf(boxes["outbox"]); !equalSubjects(got, wantOutbox) {
+		t.Errorf("Replayed box mismatch. got=%q want=%q", got, wantOutbox)
+	}
+
+	// should be compacted after opening
+	if journal.Garbage() != 0 {
+		t.Errorf("Journal should be compacted on open. got=%d", journal.Garbage())
+	}
+	if boxes["Bob@Snow"][0] != pkgMsgs[0] {
+		t.Errorf("Replayed message does not match. got=%q want=%q", boxes["Bob@Snow"][0].String(), pkgMsgs[0].String())
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.journal")
+	pkgMsgs := packageMessages(t, "Tuesday", "Re: Tuesday")
+
+	journal, _, err := Open(path, 0)
+	if err != nil {
+		t.Fatalf("Unable to open journal due to: %q", err)
+	}
+
+	err = journal.Compact(Boxes{"Bob@Snow": pkgMsgs[1:]}, nil, nil)
+	if err != nil {
+		t.Fatalf("Unable to compact journal due to: %q", err)
+	}
+
+	// writing after compaction should go into the new file
+	err = journal.Put("Bob@Snow", pkgMsgs[0])
+	if err != nil {
+		t.Fatalf("Unable to put message due to: %q", err)
+	}
+	journal.Close()
+
+	journal, boxes, err := Open(path, 0)
+	if err != nil {
+		t.Fatalf("Unable to reopen journal due to: %q", err)
+	}
+	defer journal.Close()
+
+	want := []string{"Re: Tuesday", "Tuesday"}
+	if got := subjectsOf(boxes["Bob@Snow"]); !equalSubjects(got, want) {
+		t.Errorf("Compacted box mismatch. got=%q want=%q", got, want)
+	}
+}
+
+func TestJournalCompactFailedRename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.journal")
+	movedPath := filepath.Join(dir, "moved.journal")
+	pkgMsgs := packageMessages(t, "Tuesday", "Re: Tuesday")
+
+	journal, _, err := Open(path, 0)
+	if err != nil {
+		t.Fatalf("Unable to open journal due to: %q", err)
+	}
+	err = journal.Put("Bob@Snow", pkgMsgs[0])
+	if err != nil {
+		t.Fatalf("Unable to put message due to: %q", err)
+	}
+
+	// a directory in the way of the journal makes replacing it fail,
+	// while the open journal keeps writing to where it was moved
+	err = os.Rename(path, movedPath)
+	if err != nil {
+		t.Fatalf("Unable to move journal due to: %q", err)
+	}
+	err = os.MkdirAll(filepath.Join(path, "blocker"), 0o700)
+	if err != nil {
+		t.Fatalf("Unable to create directory due to: %q", err)
+	}
+
+	err = journal.Compact(Boxes{"Bob@Snow": pkgMsgs[:1]}, nil, nil)
+	if err == nil {
+		t.Fatalf("Expected compacting to fail")
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the compacted journal to be removed. got=%v", err)
+	}
+
+	// the journal still works after the failed compaction
+	err = journal.Put("Bob@Snow", pkgMsgs[1])
+	if err != nil {
+		t.Fatalf("Unable to put message after failed compaction due to: %q", err)
+	}
+	journal.Close()
+
+	err = os.RemoveAll(path)
+	if err != nil {
+		t.Fatalf("Unable to remove directory due to: %q", err)
+	}
+	err = os.Rename(movedPath, path)
+	if err != nil {
+		t.Fatalf("Unable to move journal back due to: %q", err)
+	}
+	journal, boxes, err := Open(path, 0)
+	if err != nil {
+		t.Fatalf("Unable to reopen journal due to: %q", err)
+	}
+	defer journal.Close()
+
+	want := []string{"Tuesday", "Re: Tuesday"}
+	if got := subjectsOf(boxes["Bob@Snow"]); !equalSubjects(got, want) {
+		t.Errorf("Expected no message to be lost. got=%q want=%q", got, want)
+	}
+}
+
+func TestJournalSeen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.journal")
+	pkgMsgs := packageMessages(t, "Tuesday", "Re: Tuesday")
+
+	journal, _, err := Open(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to open journal due to: %q", err)
+	}
+	for _, pkgMsg := range pkgMsgs {
+		err = journal.Put("Bob@Snow", pkgMsg)
+		if err != nil {
+			t.Fatalf("Unable to put message due to: %q", err)
+		}
+	}
+	err = journal.Delete("Bob@Snow", pkgMsgs[0])
+	if err != nil {
+		t.Fatalf("Unable to delete message due to: %q", err)
+	}
+	journal.Close()
+
+	// deleted messages should still be seen after compacting on open
+	journal, _, err = Open(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to reopen journal due to: %q", err)
+	}
+	journal.Close()
+
+	journal, _, err = Open(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to reopen journal due to: %q", err)
+	}
+	seen := journal.Seen()
+	journal.Close()
+
+	for _, pkgMsg := range pkgMsgs {
+		if _, ok := seen[MessageKey(&pkgMsg)]; !ok {
+			t.Errorf("Message %q should have been seen", pkgMsg.ID)
+		}
+	}
+
+	// no retention should forget every key
+	journal, _, err = Open(path, 0)
+	if err != nil {
+		t.Fatalf("Unable to reopen journal due to: %q", err)
+	}
+	defer journal.Close()
+
+	if len(journal.Seen()) != 0 {
+		t.Errorf("Seen keys should be forgotten without retention. got=%d", len(journal.Seen()))
+	}
+}
+
+func TestJournalTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.journal")
+	pkgMsgs := packageMessages(t, "Tuesday")
+
+	journal, _, err := Open(path, 0)
+	if err != nil {
+		t.Fatalf("Unable to open journal due to: %q", err)
+	}
+	err = journal.Put("Bob@Snow", pkgMsgs[0])
+	if err != nil {
+		t.Fatalf("Unable to put message due to: %q", err)
+	}
+	journal.Close()
+
+	// simulate a crash part way through writing a record
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatalf("Unable to open journal file due to: %q", err)
+	}
+	file.WriteString(`{"op":"put","box":"Bob@Sn`)
+	file.Close()
+
+	journal, boxes, err := Open(path, 0)
+	if err != nil {
+		t.Fatalf("Torn write should not stop the journal from opening: %q", err)
+	}
+	defer journal.Close()
+
+	want := []string{"Tuesday"}
+	if got := subjectsOf(boxes["Bob@Snow"]); !equalSubjects(got, want) {
+		t.Errorf("Replayed box mismatch. got=%q want=%q", got, want)
+	}
+}
+
+func TestJournalCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.journal")
+
+	err := os.WriteFile(path, []byte("not json\n"), 0o600)
+	if err != nil {
+		t.Fatalf("Unable to write journal file due to: %q", err)
+	}
+
+	_, _, err = Open(path, 0)
+	if !errors.Is(err, ErrCorruptJournal) {
+		t.Errorf("Expected ErrCorruptJournal, but got %v", err)
+	}
+}
+
+func TestJournalDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.journal")
+	pkgMsgs := packageMessages(t, "Tuesday", "Re: Tuesday", "Re: Re: Tuesday")
+	failed := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	journal, _, err := Open(path, 0)
+	if err != nil {
+		t.Fatalf("Unable to open journal due to: %q", err)
+	}
+
+	for _, pkgMsg := range pkgMsgs {
+		err = journal.PutDeadLetter("deadletter", msg.DeadLetter{Message: pkgMsg, Reason: "invalid", Attempts: 1, Failed: failed})
+		if err != nil {
+			t.Fatalf("Unable to put dead letter due to: %q", err)
+		}
+	}
+	// failing again replaces the first, and the second is retried
+	err = journal.PutDeadLetter("deadletter", msg.DeadLetter{Message: pkgMsgs[0], Reason: "stale", Attempts: 2, Failed: failed})
+	if err != nil {
+		t.Fatalf("Unable to put dead letter due to: %q", err)
+	}
+	err = journal.DeleteDeadLetter("deadletter", msg.DeadLetter{Message: pkgMsgs[1]})
+	if err != nil {
+		t.Fatalf("Unable to delete dead letter due to: %q", err)
+	}
+	journal.Close()
+
+	// reopened twice so the compacted journal is read back as well
+	for range 2 {
+		journal, boxes, err := Open(path, 0)
+		if err != nil {
+			t.Fatalf("Unable to reopen journal due to: %q", err)
+		}
+		journal.Close()
+
+		if len(boxes) != 0 {
+			t.Errorf("dead letters should not be in the boxes, got %d boxes", len(boxes))
+		}
+
+		deadLetters := journal.DeadLetters()["deadletter"]
+		if len(deadLetters) != 2 {
+			t.Fatalf("dead letter count mismatch. got=%d want=%d", len(deadLetters), 2)
+		}
+		if deadLetters[0].Message.ID != pkgMsgs[0].ID || deadLetters[0].Reason != "stale" || deadLetters[0].Attempts != 2 {
+			t.Errorf("first dead letter mismatch. got=%q/%q/%d", deadLetters[0].Message.Subject, deadLetters[0].Reason, deadLetters[0].Attempts)
+		}
+		if deadLetters[1].Message.ID != pkgMsgs[2].ID {
+			t.Errorf("second dead letter mismatch. got=%q", deadLetters[1].Message.Subject)
+		}
+	}
+}
+
+func TestMessageKey(t *testing.T) {
+	pkgMsg := packageMessages(t, "Tuesday")[0]
+
+	// the same id from a different sender, including one whose names join to the same string
+	otherSender := pkgMsg
+	otherSender.From = msg.UserVessel{Name: "Bob", Vessel: "Snow"}
+	ambiguous := pkgMsg
+	ambiguous.From = msg.UserVessel{Name: "Kevin@Liberty", Vessel: ""}
+	legacy := pkgMsg
+	legacy.ID = ""
+
+	keys := make(map[string]string)
+	for name, keyed := range map[string]msg.PackagedMessage{
+		"original":     pkgMsg,
+		"other sender": otherSender,
+		"ambiguous":    ambiguous,
+		"legacy":       legacy,
+	} {
+		key := MessageKey(&keyed)
+		if other, ok := keys[key]; ok {
+			t.Errorf("%s and %s share the key %q", name, other, key)
+		}
+		keys[key] = name
+	}
+	if key := MessageKey(&legacy); key != legacy.Signature {
+		t.Errorf("Expected a message without an id to be keyed by its signature. got=%q", key)
+	}
+}
+
+func TestJournalReplaysKeysWithoutSender(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.journal")
+	pkgMsgs := packageMessages(t, "Tuesday", "Wednesday")
+
+	// written before keys held the sender
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Unable to create journal due to: %q", err)
+	}
+	records := []Record{
+		{Op: OpPut, Box: "outbox", Msg: &pkgMsgs[0]},
+		{Op: OpPut, Box: "outbox", Msg: &pkgMsgs[1]},
+		{Op: OpDel, Box: "outbox", Key: pkgMsgs[0].ID},
+		{Op: OpDead, Box: "deadletter", Key: pkgMsgs[1].ID, Dead: &msg.DeadLetter{Message: pkgMsgs[1]}},
+		{Op: OpRevive, Box: "deadletter", Key: pkgMsgs[1].ID},
+	}
+	for _, rec := range records {
+		err = writeRecord(file, rec)
+		if err != nil {
+			t.Fatalf("Unable to write record due to: %q", err)
+		}
+	}
+	file.Close()
+
+	journal, boxes, err := Open(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to open journal due to: %q", err)
+	}
+	defer journal.Close()
+
+	if got := subjectsOf(boxes["outbox"]); !equalSubjects(got, []string{"Wednesday"}) {
+		t.Errorf("Expected the deleted message to stay deleted. got=%v", got)
+	}
+	if dead := journal.DeadLetters()["deadletter"]; len(dead) != 0 {
+		t.Errorf("Expected the revived dead letter to stay revived. got=%d", len(dead))
+	}
+}